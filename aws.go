@@ -14,11 +14,22 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"html/template"
+	"io"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
 	"time"
 
 	server "github.com/admacleod/aws/internal"
@@ -34,8 +45,73 @@ Serve the current directory over HTTPS using ACME certificates for HOST(s).
 	narg = `%[1]s: missing host operand
 Try '%[1]s -h' for more information.
 `
+
+	// compressCacheEntry is the largest compressed response that will be cached.
+	compressCacheEntry = 8 << 20
 )
 
+// listFlag is a flag.Value that collects every occurrence of a repeated flag.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// parseCIDRs parses every passed CIDR notation network.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+// logOutput returns the log output named by dest, or def if dest is empty.
+//
+// dest is either "journald", "syslog" for the local syslog socket, "syslog:NETWORK:ADDRESS"
+// for a remote syslog server, or the path of a file.
+// Entries sent to the journal or syslog are given the passed severity.
+func logOutput(dest string, def io.Writer, severity int, opts []server.LogFileOption) (io.Writer, error) {
+	switch {
+	case dest == "":
+		return def, nil
+	case dest == "journald":
+		return server.DialJournal(server.JournalPriority(severity))
+	case dest == "syslog":
+		return server.DialSyslog("", "", server.SyslogSeverity(severity))
+	case strings.HasPrefix(dest, "syslog:"):
+		network, addr, _ := strings.Cut(strings.TrimPrefix(dest, "syslog:"), ":")
+		return server.DialSyslog(network, addr, server.SyslogSeverity(severity))
+	}
+
+	return server.OpenLogFile(dest, opts...)
+}
+
+// localAddr returns addr with its host set to localhost if it has none, unless public is set.
+func localAddr(addr string, public bool) string {
+	if host, port, err := net.SplitHostPort(addr); err == nil && host == "" && !public {
+		return net.JoinHostPort("localhost", port)
+	}
+
+	return addr
+}
+
+// exitUsage reports an invalid command line argument and exits.
+func exitUsage(err error) {
+	fmt.Fprintf(flag.CommandLine.Output(), "%s: %v\n", os.Args[0], err)
+	os.Exit(2)
+}
+
 func main() {
 	flag.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(), usage, os.Args[0])
@@ -43,9 +119,130 @@ func main() {
 	}
 
 	var (
-		certDir string
+		certDir     string
+		quic        bool
+		noHTTP2     bool
+		h2Streams   uint
+		h2FrameSize uint
+		h2Idle      time.Duration
+		h2cAddr     string
+
+		readHeaderTimeout time.Duration
+		readTimeout       time.Duration
+		writeTimeout      time.Duration
+		idleTimeout       time.Duration
+		maxHeaderBytes    int
+		maxConnsPerIP     int
+		maxConns          int
+
+		rate           string
+		ratePatterns   listFlag
+		trustedProxies listFlag
+		proxyProtocol  listFlag
+		logFormat      string
+
+		accessPath  string
+		errorPath   string
+		logMaxSize  int64
+		logRotate   time.Duration
+		logKeep     int
+		logMaxAge   time.Duration
+		logCompress bool
+		logQueue    int
+		logDrop     bool
+		logFlush    time.Duration
+
+		logLevel        slog.Level
+		shutdownTimeout time.Duration
+
+		metricsAddr    string
+		metricsPublic  bool
+		adminAddr      string
+		adminPublic    bool
+		adminTokenFile string
+		readyNoCerts   bool
+
+		traceEndpoint string
+		traceService  string
+
+		maintenanceAll   bool
+		maintenanceHosts listFlag
+		maintenanceFile  string
+		maintenancePage  string
+		maintenanceRetry time.Duration
+		maintenanceAllow listFlag
+
+		showHidden        bool
+		noSymlinks        bool
+		listings          bool
+		listingTemplate   string
+		listingStylesheet string
+		indexes           listFlag
+		notFound          string
+		errorPages        string
+
+		compress          bool
+		compressMinSize   int
+		compressCache     string
+		compressCacheSize int64
 	)
 	flag.StringVar(&certDir, "c", "../certs", "certificate directory")
+	flag.BoolVar(&quic, "http3", false, "also serve HTTP/3 over QUIC")
+	flag.BoolVar(&noHTTP2, "no-http2", false, "disable HTTP/2")
+	flag.UintVar(&h2Streams, "http2-streams", 0, "maximum concurrent HTTP/2 streams per client (0 for the default)")
+	flag.UintVar(&h2FrameSize, "http2-frame-size", 0, "maximum HTTP/2 frame size to read (0 for the default)")
+	flag.DurationVar(&h2Idle, "http2-idle", 0, "HTTP/2 idle connection timeout (0 for the server idle timeout)")
+	flag.StringVar(&h2cAddr, "h2c", "", "also serve unencrypted HTTP/2 on `address` for use behind a proxy")
+	flag.DurationVar(&readHeaderTimeout, "read-header-timeout", 5*time.Second, "time allowed to read request headers")
+	flag.DurationVar(&readTimeout, "read-timeout", 10*time.Second, "time allowed to read an entire request")
+	flag.DurationVar(&writeTimeout, "write-timeout", 10*time.Second, "time allowed to write a response without progress")
+	flag.DurationVar(&idleTimeout, "idle-timeout", 10*time.Second, "time to keep idle connections open")
+	flag.IntVar(&maxHeaderBytes, "max-header-bytes", http.DefaultMaxHeaderBytes, "maximum size of request headers")
+	flag.IntVar(&maxConnsPerIP, "max-conns-per-ip", 64, "maximum concurrent connections from each client IP (0 for no limit)")
+	flag.IntVar(&maxConns, "max-conns", 0, "maximum concurrent connections in total (0 for no limit)")
+	flag.StringVar(&rate, "rate", "0", "requests per second allowed from each client as `rate[:burst]` (0 for no limit)")
+	flag.Var(&ratePatterns, "rate-for", "rate limit for requests matching a host and/or path prefix as `pattern=rate[:burst]` (repeatable)")
+	flag.Var(&trustedProxies, "trusted-proxy", "`CIDR` of a proxy trusted to set X-Forwarded-For (repeatable)")
+	flag.Var(&proxyProtocol, "proxy-protocol", "`CIDR` of a load balancer that sends PROXY protocol headers (repeatable)")
+	flag.StringVar(&logFormat, "log-format", "combined", "access log `format`: common, combined, vhost_combined, json, logfmt, or an Apache LogFormat template")
+	flag.StringVar(&accessPath, "access-log", "", "write the access log to `destination`: a file, journald, syslog, or syslog:NETWORK:ADDRESS")
+	flag.StringVar(&errorPath, "error-log", "", "write the error log to `destination`: a file, journald, syslog, or syslog:NETWORK:ADDRESS")
+	flag.Int64Var(&logMaxSize, "log-max-size", 0, "rotate log files before they exceed `bytes` (0 for no limit)")
+	flag.DurationVar(&logRotate, "log-rotate", 0, "rotate log files once they have been open for `duration` (0 to disable)")
+	flag.IntVar(&logKeep, "log-keep", 0, "number of rotated log files to keep (0 to keep all)")
+	flag.DurationVar(&logMaxAge, "log-max-age", 0, "remove rotated log files older than `duration` (0 to keep all)")
+	flag.BoolVar(&logCompress, "log-compress", false, "compress rotated log files with gzip")
+	flag.TextVar(&logLevel, "log-level", slog.LevelInfo, "lowest `level` of error log messages to write: debug, info, warn, or error")
+	flag.IntVar(&logQueue, "log-queue", 1024, "number of access log lines that may wait to be written")
+	flag.BoolVar(&logDrop, "log-drop", false, "drop access log lines when the queue is full rather than waiting")
+	flag.DurationVar(&logFlush, "log-flush", time.Second, "longest time access log lines are buffered before being written")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 10*time.Second, "time allowed for requests to finish when stopping")
+	flag.StringVar(&metricsAddr, "metrics", "", "serve Prometheus metrics at /metrics on `address`")
+	flag.BoolVar(&metricsPublic, "metrics-public", false, "serve metrics on every interface when -metrics has no host, rather than only localhost")
+	flag.StringVar(&adminAddr, "admin", "", "serve health checks at /healthz and /readyz and version information at /version on `address`")
+	flag.BoolVar(&adminPublic, "admin-public", false, "serve the admin endpoints on every interface when -admin has no host, rather than only localhost")
+	flag.StringVar(&adminTokenFile, "admin-token-file", "", "serve the admin API at /api/ to clients presenting the bearer token read from `file`")
+	flag.BoolVar(&readyNoCerts, "ready-without-certificates", false, "report ready before a certificate has been obtained for every host, until one expires")
+	flag.StringVar(&traceEndpoint, "trace-endpoint", "", "export request traces to the OTLP/HTTP traces `URL` of a collector, such as http://localhost:4318/v1/traces")
+	flag.StringVar(&traceService, "trace-service", "aws", "service `name` of exported traces")
+	flag.BoolVar(&maintenanceAll, "maintenance", false, "start with every host in maintenance")
+	flag.Var(&maintenanceHosts, "maintenance-host", "start with `hostname` in maintenance (repeatable)")
+	flag.StringVar(&maintenanceFile, "maintenance-file", "", "put hosts into maintenance while sentinel `file` exists, listing hosts one per line or none for every host")
+	flag.StringVar(&maintenancePage, "maintenance-page", "", "serve the HTML page in `file` to requests for hosts in maintenance")
+	flag.DurationVar(&maintenanceRetry, "maintenance-retry", 5*time.Minute, "time clients are asked to wait before retrying hosts in maintenance")
+	flag.Var(&maintenanceAllow, "maintenance-allow", "`CIDR` of clients allowed through to hosts in maintenance (repeatable)")
+	flag.BoolVar(&showHidden, "hidden", false, "serve hidden files, whose names begin with a dot")
+	flag.BoolVar(&noSymlinks, "no-symlinks", false, "refuse to follow symbolic links, even within the served directory")
+	flag.BoolVar(&listings, "listings", false, "list the contents of directories without an index file, not only those containing a .listing file")
+	flag.StringVar(&listingTemplate, "listing-template", "", "render directory listings with the HTML template in `file`")
+	flag.StringVar(&listingStylesheet, "listing-stylesheet", server.DefaultListingStylesheet, "link directory listings to the stylesheet at `URL`, or none if empty")
+	flag.Var(&indexes, "index", "serve `file` in place of directories (repeatable, default index.html)")
+	flag.StringVar(&notFound, "not-found", "", "serve `file`, relative to the served directory, as the not found page")
+	flag.StringVar(&errorPages, "error-pages", "", "serve error pages such as 404.html or 5xx.html from `directory`, or its subdirectory named after the host")
+	flag.BoolVar(&compress, "compress", false, "compress responses with brotli, zstd, or gzip")
+	flag.IntVar(&compressMinSize, "compress-min-size", 1024, "smallest response body in `bytes` to compress")
+	flag.StringVar(&compressCache, "compress-cache", "", "cache compressed files in `destination`: memory, or a directory")
+	flag.Int64Var(&compressCacheSize, "compress-cache-size", 64<<20, "maximum size in `bytes` of the compression cache")
 	flag.Parse()
 
 	if flag.NArg() == 0 {
@@ -54,48 +251,422 @@ func main() {
 	}
 
 	// Configure TLS and certificate management
-	mgr := autocert.Manager{
-		Prompt:     autocert.AcceptTOS,
-		HostPolicy: autocert.HostWhitelist(flag.Args()...),
-		Cache:      autocert.DirCache(certDir),
-	}
-	tlsCfg := mgr.TLSConfig()
+	certCache := autocert.DirCache(certDir)
+	certs := server.NewCertManager(certCache, flag.Args()...)
+	tlsCfg := certs.TLSConfig()
 	server.ModerniseTLS(tlsCfg)
+	metrics := server.NewMetrics(server.MetricsHosts(flag.Args()...))
+	server.InstrumentTLS(metrics, tlsCfg)
+
+	if noHTTP2 && h2cAddr != "" {
+		exitUsage(errors.New("-no-http2 cannot be used with -h2c"))
+	}
+
+	// Configure client identification and rate limiting
+	proxies, err := parseCIDRs(trustedProxies)
+	if err != nil {
+		exitUsage(err)
+	}
+	balancers, err := parseCIDRs(proxyProtocol)
+	if err != nil {
+		exitUsage(err)
+	}
+	maintenanceNets, err := parseCIDRs(maintenanceAllow)
+	if err != nil {
+		exitUsage(err)
+	}
+	defaultRate, err := server.ParseRate(rate)
+	if err != nil {
+		exitUsage(err)
+	}
+	var rateOpts []server.RateLimiterOption
+	for _, rp := range ratePatterns {
+		pattern, spec, _ := strings.Cut(rp, "=")
+		r, err := server.ParseRate(spec)
+		if err != nil {
+			exitUsage(err)
+		}
+		rateOpts = append(rateOpts, server.RateFor(pattern, r))
+	}
+
+	// Configure log outputs, reopening any files on SIGUSR1 to support external rotation
+	// and reloading certificates as well on SIGHUP
+	if logQueue < 1 {
+		exitUsage(fmt.Errorf("invalid -log-queue %d: must be at least 1", logQueue))
+	}
+	if logFlush <= 0 {
+		exitUsage(fmt.Errorf("invalid -log-flush %s: must be positive", logFlush))
+	}
+	logOpts := []server.LogFileOption{
+		server.RotateSize(logMaxSize),
+		server.RotateEvery(logRotate),
+		server.MaxBackups(logKeep),
+		server.MaxBackupAge(logMaxAge),
+	}
+	if logCompress {
+		logOpts = append(logOpts, server.CompressBackups())
+	}
+	accessOut, err := logOutput(accessPath, os.Stdout, server.SeverityInfo, logOpts)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	errOut, err := logOutput(errorPath, os.Stderr, server.SeverityError, logOpts)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	errOpts := &slog.HandlerOptions{Level: logLevel}
+	if _, ok := errOut.(server.FieldWriter); ok {
+		// The journal and syslog record the time themselves.
+		errOpts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		}
+	}
+	var errHandler slog.Handler = slog.NewTextHandler(errOut, errOpts)
+	if sw, ok := errOut.(server.SeverityWriter); ok {
+		// Record the level of each message as its severity.
+		errHandler = server.NewSeverityHandler(sw, errOpts)
+	}
+	errLog := slog.New(errHandler)
+	asyncOpts := []server.AsyncWriterOption{
+		server.QueueSize(logQueue),
+		server.FlushInterval(logFlush),
+	}
+	if !logDrop {
+		asyncOpts = append(asyncOpts, server.BlockWhenFull())
+	}
+	accessLog := server.NewAsyncWriter(accessOut, asyncOpts...)
+	reopenLogs := func() error {
+		var err error
+		for _, w := range []io.Writer{accessOut, errOut} {
+			if f, ok := w.(*server.LogFile); ok {
+				err = errors.Join(err, f.Reopen())
+			}
+		}
+		return err
+	}
+	var errorDocs *server.ErrorDocuments
+	if errorPages != "" {
+		errorDocs, err = server.NewErrorDocuments(errorPages)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		defer errorDocs.Close()
+	}
+	reload := func(context.Context) error {
+		certs.Reload()
+		var err error
+		if errorDocs != nil {
+			if rerr := errorDocs.Reload(); rerr != nil {
+				err = fmt.Errorf("reloading error pages: %w", rerr)
+			}
+		}
+		if rerr := reopenLogs(); rerr != nil {
+			err = errors.Join(err, fmt.Errorf("reopening log files: %w", rerr))
+		}
+		return err
+	}
+	reopen := make(chan os.Signal, 1)
+	signal.Notify(reopen, syscall.SIGUSR1, syscall.SIGHUP)
+	go func() {
+		for sig := range reopen {
+			if sig == syscall.SIGHUP {
+				errLog.Info("reloading configuration")
+				if err := reload(context.Background()); err != nil {
+					errLog.Error("reloading configuration", "error", err)
+				}
+			} else if err := reopenLogs(); err != nil {
+				errLog.Error("reopening log files", "error", err)
+			}
+		}
+	}()
 
 	// Setup our handler
+	accessFormat, err := server.LookupLogFormat(logFormat)
+	if err != nil {
+		exitUsage(err)
+	}
 	mux := &http.ServeMux{}
-	mw := server.ChainMiddleware(
+	rateLimiter := server.NewRateLimiter(defaultRate, rateOpts...)
+	maintenanceOpts := []server.MaintenanceOption{
+		server.MaintenanceRetryAfter(maintenanceRetry),
+		server.MaintenanceAllow(maintenanceNets...),
+	}
+	if maintenanceFile != "" {
+		maintenanceOpts = append(maintenanceOpts, server.MaintenanceFile(maintenanceFile))
+	}
+	if maintenancePage != "" {
+		page, err := os.ReadFile(maintenancePage)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		maintenanceOpts = append(maintenanceOpts, server.MaintenancePage(page))
+	}
+	maintenance := server.NewMaintenance(maintenanceOpts...)
+	if maintenanceAll {
+		maintenance.Enable()
+	}
+	if len(maintenanceHosts) > 0 {
+		maintenance.Enable(maintenanceHosts...)
+	}
+	toggle := make(chan os.Signal, 1)
+	signal.Notify(toggle, syscall.SIGUSR2)
+	go func() {
+		for range toggle {
+			errLog.Info("toggled maintenance", "all", maintenance.Toggle())
+		}
+	}()
+	middleware := []func(http.Handler) http.Handler{
+		server.ExtendWriteDeadline(writeTimeout),
+	}
+	if errorDocs != nil {
+		middleware = append(middleware, server.ErrorPages(errorDocs))
+	}
+	middleware = append(middleware, server.MaintenanceMode(maintenance))
+	if compress {
+		compressOpts := []server.CompressorOption{server.CompressMinSize(compressMinSize)}
+		var cache interface {
+			server.CompressionCache
+			Size() int64
+		}
+		switch compressCache {
+		case "":
+		case "memory":
+			cache = server.NewMemoryCompressionCache(compressCacheSize)
+		default:
+			var err error
+			cache, err = server.NewDiskCompressionCache(compressCache, compressCacheSize)
+			if err != nil {
+				log.Fatalf("%v", err)
+			}
+		}
+		if cache != nil {
+			compressOpts = append(compressOpts, server.CompressCache(cache, compressCacheEntry))
+			metrics.GaugeFunc("aws_compression_cache_bytes", "Size of the cached compressed responses.", func() float64 {
+				return float64(cache.Size())
+			})
+		}
+		middleware = append(middleware, server.Compress(server.NewCompressor(compressOpts...)))
+	}
+	middleware = append(middleware,
+		server.RateLimit(rateLimiter),
 		server.SecureHeaders,
-		server.CombinedLogFormatLogger(os.Stdout),
+		server.Instrument(metrics),
+		server.AccessLogger(accessLog, accessFormat),
 	)
-	handler := http.FileServer(http.Dir("."))
+	var tracer *server.Tracer
+	if traceEndpoint != "" {
+		tracer = server.NewTracer(traceEndpoint,
+			server.TraceServiceName(traceService),
+			server.TraceErrorLog(errHandler),
+		)
+		middleware = append(middleware, server.Trace(tracer))
+	}
+	mw := server.ChainMiddleware(append(middleware, server.TrustedProxies(proxies...))...)
+	staticOpts := []server.StaticOption{
+		server.StaticPrecompressed(),
+		server.StaticListingStylesheet(listingStylesheet),
+	}
+	if showHidden {
+		staticOpts = append(staticOpts, server.StaticAllowHidden())
+	}
+	if noSymlinks {
+		staticOpts = append(staticOpts, server.StaticDenySymlinks())
+	}
+	if listings {
+		staticOpts = append(staticOpts, server.StaticListings())
+	}
+	if listingTemplate != "" {
+		tmpl, err := template.ParseFiles(listingTemplate)
+		if err != nil {
+			log.Fatalf("Could not parse listing template: %v", err)
+		}
+		staticOpts = append(staticOpts, server.StaticListingTemplate(tmpl))
+	}
+	if len(indexes) > 0 {
+		staticOpts = append(staticOpts, server.StaticIndex(indexes...))
+	}
+	if notFound != "" {
+		staticOpts = append(staticOpts, server.StaticNotFound(notFound))
+	}
+	handler, err := server.NewStatic(".", staticOpts...)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	defer handler.Close()
 	mux.Handle("/", mw(handler))
 
-	timeout := 10 * time.Second
-	errLog := log.New(os.Stderr, "aws: ", log.LstdFlags)
-	// We need two servers, one for HTTP redirect and the other for HTTPS
-	srv := server.New(
-		server.Timeout(timeout),
-		server.ErrorLog(errLog),
-		server.Handle(mgr.HTTPHandler(nil)),
+	limiter := server.NewConnLimiter(maxConnsPerIP, maxConns)
+	var baseOpts []server.Option
+	if len(balancers) > 0 {
+		// Read PROXY protocol headers first so that connections are limited by client address.
+		baseOpts = append(baseOpts, server.ProxyProtocol(readHeaderTimeout, balancers...))
+	}
+	baseOpts = append(baseOpts,
+		server.LimitConnections(limiter),
+		server.ReadHeaderTimeout(readHeaderTimeout),
+		server.ReadTimeout(readTimeout),
+		server.WriteTimeout(writeTimeout),
+		server.IdleTimeout(idleTimeout),
+		server.MaxHeaderBytes(maxHeaderBytes),
+		server.ErrorLog(server.InstrumentErrors(metrics, errHandler)),
 	)
-	srvTLS := server.New(
-		server.Timeout(timeout),
-		server.ErrorLog(errLog),
+	metrics.GaugeFunc("aws_connections_active", "Connections currently open.", func() float64 {
+		return float64(limiter.Stats().Active)
+	})
+	metrics.GaugeFunc("aws_connections_clients", "Client IP addresses with open connections.", func() float64 {
+		return float64(limiter.Stats().Clients)
+	})
+	metrics.CounterFunc("aws_connections_accepted_total", "Connections accepted.", func() float64 {
+		return float64(limiter.Stats().Accepted)
+	})
+	metrics.CounterFunc("aws_connections_rejected_total", "Connections closed for exceeding a connection limit.", func() float64 {
+		return float64(limiter.Stats().Rejected)
+	})
+	metrics.GaugeFunc("aws_rate_limit_buckets", "Token buckets held by the rate limiter.", func() float64 {
+		return float64(rateLimiter.Buckets())
+	})
+	metrics.CounterFunc("aws_access_log_dropped_total", "Access log lines dropped because the queue was full.", func() float64 {
+		return float64(accessLog.Dropped())
+	})
+	if tracer != nil {
+		metrics.CounterFunc("aws_trace_spans_dropped_total", "Trace spans dropped because the export queue was full.", func() float64 {
+			return float64(tracer.Dropped())
+		})
+	}
+	// We need two servers, one for HTTP redirect and the other for HTTPS
+	srv := server.New(slices.Concat(baseOpts, []server.Option{
+		server.Handle(certs.HTTPHandler(nil)),
+	})...)
+	var h2Opts []server.Option
+	if h2Streams != 0 {
+		h2Opts = append(h2Opts, server.HTTP2MaxConcurrentStreams(uint32(h2Streams)))
+	}
+	if h2FrameSize != 0 {
+		h2Opts = append(h2Opts, server.HTTP2MaxReadFrameSize(uint32(h2FrameSize)))
+	}
+	if h2Idle != 0 {
+		h2Opts = append(h2Opts, server.HTTP2IdleTimeout(h2Idle))
+	}
+	if noHTTP2 {
+		h2Opts = append(h2Opts, server.DisableHTTP2())
+	}
+	tlsOpts := slices.Concat(baseOpts, h2Opts, []server.Option{
 		server.Handle(mux),
 		server.TLS(tlsCfg),
-	)
+	})
+	if quic {
+		tlsOpts = append(tlsOpts, server.HTTP3())
+	}
+	srvTLS := server.New(tlsOpts...)
 
 	// Spool up and listen for errors
-	e := make(chan error, 1)
+	servers := []*server.Server{srv, srvTLS}
+	e := make(chan error, 5)
 	go func() {
 		e <- srv.ListenAndServe()
 	}()
 	go func() {
 		e <- srvTLS.ListenAndServeTLS("", "")
 	}()
-	err := <-e
-	if err != nil {
-		errLog.Fatalf("%v", err)
+	if h2cAddr != "" {
+		srvH2C := server.New(slices.Concat(baseOpts, []server.Option{
+			server.Handle(mux),
+			server.H2C(),
+		}, h2Opts)...)
+		srvH2C.Addr = h2cAddr
+		servers = append(servers, srvH2C)
+		go func() {
+			e <- srvH2C.ListenAndServe()
+		}()
+	}
+	localOpts := []server.Option{
+		server.ReadHeaderTimeout(readHeaderTimeout),
+		server.ReadTimeout(readTimeout),
+		server.WriteTimeout(writeTimeout),
+		server.IdleTimeout(idleTimeout),
+		server.ErrorLog(errHandler),
+	}
+	if metricsAddr != "" {
+		metricsMux := &http.ServeMux{}
+		metricsMux.Handle("GET /metrics", metrics)
+		srvMetrics := server.New(slices.Concat(localOpts, []server.Option{server.Handle(metricsMux)})...)
+		srvMetrics.Addr = localAddr(metricsAddr, metricsPublic)
+		servers = append(servers, srvMetrics)
+		go func() {
+			e <- srvMetrics.ListenAndServe()
+		}()
+	}
+	if adminAddr != "" {
+		health := server.NewHealth(5 * time.Second)
+		health.AddCheck("listeners", server.ListeningCheck(slices.Clone(servers)...))
+		certCheck := server.CertificateCheck
+		if readyNoCerts {
+			certCheck = server.CertificateExpiryCheck
+		}
+		health.AddCheck("certificates", certCheck(certCache, flag.Args()...))
+		health.AddCheck("document_root", server.DirCheck("."))
+		adminMux := &http.ServeMux{}
+		adminMux.Handle("GET /healthz", health.Liveness())
+		adminMux.Handle("GET /readyz", health.Readiness())
+		adminMux.Handle("GET /version", server.VersionHandler())
+		if adminTokenFile != "" || strings.HasPrefix(adminAddr, "unix:") {
+			adminOpts := []server.AdminOption{
+				server.AdminCertificates(certs),
+				server.AdminConnections(limiter),
+				server.AdminReload(reload),
+				server.AdminMaintenance(maintenance),
+				server.AdminErrorLog(errHandler),
+			}
+			if adminTokenFile != "" {
+				token, err := os.ReadFile(adminTokenFile)
+				if err != nil {
+					log.Fatalf("%v", err)
+				}
+				if len(bytes.TrimSpace(token)) == 0 {
+					log.Fatalf("%s: empty admin token", adminTokenFile)
+				}
+				adminOpts = append(adminOpts, server.AdminToken(string(bytes.TrimSpace(token))))
+			}
+			adminMux.Handle("/api/", http.StripPrefix("/api", server.NewAdmin(adminOpts...)))
+		}
+		srvAdmin := server.New(slices.Concat(localOpts, []server.Option{server.Handle(adminMux)})...)
+		srvAdmin.Addr = localAddr(adminAddr, adminPublic)
+		servers = append(servers, srvAdmin)
+		go func() {
+			e <- srvAdmin.ListenAndServe()
+		}()
+	}
+
+	// Stop gracefully on SIGINT or SIGTERM, letting requests finish and writing out queued logs
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err = <-e:
+	case sig := <-stop:
+		errLog.Info("shutting down", "signal", sig.String())
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		for _, s := range servers {
+			err = errors.Join(err, s.Shutdown(ctx))
+		}
+		if tracer != nil {
+			err = errors.Join(err, tracer.Close(ctx))
+		}
+		cancel()
+	}
+	if closeErr := accessLog.Close(); closeErr != nil {
+		errLog.Error("writing access log", "error", closeErr)
+	}
+	if n := accessLog.Dropped(); n > 0 {
+		errLog.Warn("dropped access log lines", "count", n)
+	}
+	if c, ok := accessOut.(io.Closer); ok && accessPath != "" {
+		c.Close()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		errLog.Error("serving", "error", err)
+		os.Exit(1)
 	}
 }
@@ -1,10 +1,17 @@
 module github.com/admacleod/aws
 
-go 1.17
+go 1.26.0
 
-require golang.org/x/crypto v0.18.0
+require (
+	github.com/andybalholm/brotli v1.2.6
+	github.com/klauspost/compress v1.20.1
+	github.com/quic-go/quic-go v0.63.0
+	golang.org/x/crypto v0.54.0
+	golang.org/x/net v0.56.0
+)
 
 require (
-	golang.org/x/net v0.10.0 // indirect
-	golang.org/x/text v0.14.0 // indirect
+	github.com/quic-go/qpack v0.6.0 // indirect
+	golang.org/x/sys v0.47.0 // indirect
+	golang.org/x/text v0.40.0 // indirect
 )
@@ -0,0 +1,212 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// CertManager obtains certificates for a fixed set of hosts from an ACME CA using a single
+// autocert.Manager, which keeps them renewed.
+//
+// autocert provides no way of stopping a manager's renewal timers, so rather than replacing the
+// manager to reload certificates, reloaded certificates are served alongside it until it holds
+// a newer one itself.
+type CertManager struct {
+	hosts    []string
+	cache    autocert.Cache
+	manager  *autocert.Manager
+	reloaded atomic.Pointer[map[string]*tls.Certificate]
+}
+
+// CertificateStatus describes the certificate held in the cache for a host.
+type CertificateStatus struct {
+	Host string
+	// NotAfter is the expiry time of the certificate, or zero if it could not be read.
+	NotAfter time.Time
+	// Err is the reason the certificate could not be read, such as autocert.ErrCacheMiss.
+	Err error
+}
+
+// NewCertManager creates a CertManager that accepts the CA terms of service and obtains
+// certificates for the passed hosts only, storing them in the passed cache.
+func NewCertManager(cache autocert.Cache, hosts ...string) *CertManager {
+	return &CertManager{
+		hosts: hosts,
+		cache: cache,
+		manager: &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(hosts...),
+			Cache:      cache,
+		},
+	}
+}
+
+// Hosts returns the hosts that certificates are obtained for.
+func (c *CertManager) Hosts() []string {
+	return slices.Clone(c.hosts)
+}
+
+// GetCertificate implements the tls.Config.GetCertificate hook, serving the certificate of the
+// autocert.Manager unless a reloaded certificate of the same type is at least as new.
+func (c *CertManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, err := c.manager.GetCertificate(hello)
+	if err != nil || cert.Leaf == nil {
+		return cert, err
+	}
+	reloaded := c.reloaded.Load()
+	if reloaded == nil {
+		return cert, nil
+	}
+	// Certificates are cached under the host name, with a suffix for RSA certificates.
+	key := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+	if cert.Leaf.PublicKeyAlgorithm == x509.RSA {
+		key += "+rsa"
+	}
+	if rc, ok := (*reloaded)[key]; ok && !cert.Leaf.NotBefore.After(rc.Leaf.NotBefore) {
+		return rc, nil
+	}
+
+	return cert, nil
+}
+
+// TLSConfig creates a tls.Config that serves certificates from the CertManager, supporting
+// HTTP/2 and the tls-alpn-01 ACME challenge, as autocert.Manager.TLSConfig.
+func (c *CertManager) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: c.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1", acme.ALPNProto},
+	}
+}
+
+// HTTPHandler answers http-01 ACME challenges, passing all other requests to fallback, as
+// autocert.Manager.HTTPHandler.
+func (c *CertManager) HTTPHandler(fallback http.Handler) http.Handler {
+	return c.manager.HTTPHandler(fallback)
+}
+
+// Reload reads the certificates of every host from the cache again, picking up any that have
+// been replaced outside of the server, and serves them in place of older certificates.
+func (c *CertManager) Reload() {
+	reloaded := make(map[string]*tls.Certificate)
+	for _, host := range c.hosts {
+		for _, key := range []string{host, host + "+rsa"} {
+			data, err := c.cache.Get(context.Background(), key)
+			if err != nil {
+				continue
+			}
+			// The cache entry holds the private key followed by the certificate chain.
+			if cert, err := tls.X509KeyPair(data, data); err == nil && cert.Leaf != nil {
+				reloaded[strings.ToLower(key)] = &cert
+			}
+		}
+	}
+	c.reloaded.Store(&reloaded)
+}
+
+// Renew obtains a new certificate for host from the CA, replacing the cached certificate and
+// serving it once issued. Issuance may take several minutes.
+//
+// The existing certificate continues to be served if renewal fails.
+//
+// The certificate is obtained by a separate autocert.Manager, whose ACME client is disabled once
+// Renew returns so that the renewal timer it leaves behind never requests another certificate.
+func (c *CertManager) Renew(host string) error {
+	if !slices.Contains(c.hosts, host) {
+		return fmt.Errorf("unknown host %q", host)
+	}
+	transport := &renewTransport{}
+	defer transport.done.Store(true)
+	rc := &renewCache{Cache: c.cache, host: host}
+	defer rc.done.Store(true)
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(host),
+		Cache:      rc,
+		Client: &acme.Client{
+			DirectoryURL: autocert.DefaultACMEDirectory,
+			HTTPClient:   &http.Client{Transport: transport},
+		},
+	}
+	// Prefer the ECDSA certificate that supporting clients are served.
+	hello := &tls.ClientHelloInfo{
+		ServerName:       host,
+		CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		SupportedCurves:  []tls.CurveID{tls.CurveP256},
+	}
+	if _, err := m.GetCertificate(hello); err != nil {
+		return fmt.Errorf("renewing certificate for %s: %w", host, err)
+	}
+	c.Reload()
+
+	return nil
+}
+
+// errRenewDone is returned by the ACME client of a renewal manager once its renewal has finished.
+var errRenewDone = errors.New("certificate renewal finished")
+
+// renewTransport is the http.RoundTripper of the ACME client of a renewal manager, which fails
+// every request once the renewal has finished.
+type renewTransport struct {
+	done atomic.Bool
+}
+
+func (rt *renewTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if rt.done.Load() {
+		return nil, errRenewDone
+	}
+
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+// Status describes the cached certificate of every host.
+func (c *CertManager) Status(ctx context.Context) []CertificateStatus {
+	status := make([]CertificateStatus, len(c.hosts))
+	for i, host := range c.hosts {
+		status[i].Host = host
+		status[i].NotAfter, status[i].Err = cachedCertificateExpiry(ctx, c.cache, host)
+	}
+
+	return status
+}
+
+// renewCache hides the cached ECDSA certificate of host until the renewal has finished, so that
+// a new one is requested, while still sharing challenge tokens and storing the result in the
+// underlying cache.
+type renewCache struct {
+	autocert.Cache
+	host string
+	done atomic.Bool
+}
+
+func (rc *renewCache) Get(ctx context.Context, key string) ([]byte, error) {
+	if key == rc.host && !rc.done.Load() {
+		return nil, autocert.ErrCacheMiss
+	}
+
+	return rc.Cache.Get(ctx, key)
+}
@@ -0,0 +1,162 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"slices"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+
+	server "github.com/admacleod/aws/internal"
+)
+
+// cacheCertificate stores a new self-signed certificate for host in cache in the form used by autocert.
+func cacheCertificate(t *testing.T, cache autocert.Cache, host string) *x509.Certificate {
+	t.Helper()
+
+	return cacheCertificateFrom(t, cache, host, time.Now().Add(-time.Hour))
+}
+
+// cacheCertificateFrom is as cacheCertificate, with the certificate valid for 25 hours from notBefore.
+func cacheCertificateFrom(t *testing.T, cache autocert.Cache, host string, notBefore time.Time) *x509.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    notBefore,
+		NotAfter:     notBefore.Add(25 * time.Hour).Truncate(time.Second),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("could not create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("could not marshal key: %v", err)
+	}
+	entry := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	entry = append(entry, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	if err := cache.Put(context.Background(), host, entry); err != nil {
+		t.Fatalf("could not populate cache: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("could not parse certificate: %v", err)
+	}
+
+	return leaf
+}
+
+func TestCertManagerStatus(t *testing.T) {
+	cache := autocert.DirCache(t.TempDir())
+	cert := cacheCertificate(t, cache, "a.example.com")
+	c := server.NewCertManager(cache, "a.example.com", "b.example.com")
+
+	if hosts := c.Hosts(); !slices.Equal(hosts, []string{"a.example.com", "b.example.com"}) {
+		t.Errorf("incorrect hosts: expected=%v, got=%v", []string{"a.example.com", "b.example.com"}, hosts)
+	}
+	status := c.Status(context.Background())
+	if len(status) != 2 {
+		t.Fatalf("incorrect status count: expected=%d, got=%d", 2, len(status))
+	}
+	if status[0].Err != nil || !status[0].NotAfter.Equal(cert.NotAfter) {
+		t.Errorf("incorrect expiry: expected=%v, got=%v (err=%v)", cert.NotAfter, status[0].NotAfter, status[0].Err)
+	}
+	if !errors.Is(status[1].Err, autocert.ErrCacheMiss) {
+		t.Errorf("incorrect error: expected=%v, got=%v", autocert.ErrCacheMiss, status[1].Err)
+	}
+}
+
+func TestCertManagerReload(t *testing.T) {
+	cache := autocert.DirCache(t.TempDir())
+	first := cacheCertificate(t, cache, "example.com")
+	c := server.NewCertManager(cache, "example.com")
+	hello := &tls.ClientHelloInfo{
+		ServerName:       "example.com",
+		CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		SupportedCurves:  []tls.CurveID{tls.CurveP256},
+	}
+	served := func() []byte {
+		t.Helper()
+		cert, err := c.GetCertificate(hello)
+		if err != nil {
+			t.Fatalf("could not get certificate: %v", err)
+		}
+		return cert.Certificate[0]
+	}
+
+	if !slices.Equal(served(), first.Raw) {
+		t.Error("incorrect certificate served before replacement")
+	}
+	second := cacheCertificate(t, cache, "example.com")
+	if !slices.Equal(served(), first.Raw) {
+		t.Error("replaced certificate served before reload")
+	}
+	c.Reload()
+	if !slices.Equal(served(), second.Raw) {
+		t.Error("incorrect certificate served after reload")
+	}
+}
+
+func TestCertManagerReloadOlder(t *testing.T) {
+	cache := autocert.DirCache(t.TempDir())
+	current := cacheCertificate(t, cache, "example.com")
+	c := server.NewCertManager(cache, "example.com")
+	hello := &tls.ClientHelloInfo{
+		ServerName:       "example.com",
+		CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		SupportedCurves:  []tls.CurveID{tls.CurveP256},
+	}
+	if _, err := c.GetCertificate(hello); err != nil {
+		t.Fatalf("could not get certificate: %v", err)
+	}
+
+	// An older certificate put in the cache must not replace the one being served.
+	cacheCertificateFrom(t, cache, "example.com", time.Now().Add(-48*time.Hour))
+	c.Reload()
+	cert, err := c.GetCertificate(hello)
+	if err != nil {
+		t.Fatalf("could not get certificate: %v", err)
+	}
+	if !slices.Equal(cert.Certificate[0], current.Raw) {
+		t.Error("older certificate served after reload")
+	}
+}
+
+func TestCertManagerRenewUnknownHost(t *testing.T) {
+	c := server.NewCertManager(autocert.DirCache(t.TempDir()), "example.com")
+	if err := c.Renew("example.org"); err == nil {
+		t.Error("expected error renewing unknown host")
+	}
+}
@@ -0,0 +1,282 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Admin is a http.Handler serving a JSON API for inspecting and controlling the server at runtime.
+//
+// Only the endpoints for the parts of the server passed as AdminOptions are served:
+//
+//	GET    /hosts                     hosts served (AdminCertificates)
+//	GET    /certificates              cached certificate expiry of each host (AdminCertificates)
+//	POST   /certificates/{host}/renew start renewing the certificate of host (AdminCertificates)
+//	GET    /connections               connection counts (AdminConnections)
+//	POST   /reload                    reload configuration (AdminReload)
+//	GET    /maintenance               hosts in maintenance (AdminMaintenance)
+//	PUT    /maintenance[/{host}]      put every host, or host, into maintenance (AdminMaintenance)
+//	DELETE /maintenance[/{host}]      take every host, or host, out of maintenance (AdminMaintenance)
+//
+// The API should only be served on a unix socket or a listener restricted to localhost, and
+// AdminToken should be used unless access to that listener is otherwise controlled.
+type Admin struct {
+	mux         *http.ServeMux
+	token       []byte
+	certs       *CertManager
+	conns       *ConnLimiter
+	reload      func(context.Context) error
+	maintenance *Maintenance
+	logger      *slog.Logger
+
+	mu       sync.Mutex
+	renewing map[string]bool
+}
+
+// AdminOption is a function that will apply some option to an Admin.
+type AdminOption func(*Admin)
+
+// AdminToken creates an AdminOption that requires requests to present token as a bearer token
+// in the Authorization header.
+func AdminToken(token string) AdminOption {
+	return func(a *Admin) {
+		sum := sha256.Sum256([]byte(token))
+		a.token = sum[:]
+	}
+}
+
+// AdminCertificates creates an AdminOption that serves the hosts and certificates of the passed
+// CertManager, and allows certificates to be renewed.
+func AdminCertificates(c *CertManager) AdminOption {
+	return func(a *Admin) {
+		a.certs = c
+	}
+}
+
+// AdminConnections creates an AdminOption that serves the connection counts of the passed ConnLimiter.
+func AdminConnections(l *ConnLimiter) AdminOption {
+	return func(a *Admin) {
+		a.conns = l
+	}
+}
+
+// AdminReload creates an AdminOption that calls reload when a configuration reload is requested.
+func AdminReload(reload func(context.Context) error) AdminOption {
+	return func(a *Admin) {
+		a.reload = reload
+	}
+}
+
+// AdminMaintenance creates an AdminOption that allows hosts to be put into and taken out of
+// maintenance through the passed Maintenance.
+func AdminMaintenance(m *Maintenance) AdminOption {
+	return func(a *Admin) {
+		a.maintenance = m
+	}
+}
+
+// AdminErrorLog creates an AdminOption that will send changes made through the API, and the
+// outcome of certificate renewals, to the passed slog.Handler.
+func AdminErrorLog(h slog.Handler) AdminOption {
+	return func(a *Admin) {
+		a.logger = slog.New(h)
+	}
+}
+
+// NewAdmin creates an Admin with the passed AdminOptions applied to it.
+func NewAdmin(opts ...AdminOption) *Admin {
+	a := &Admin{
+		mux:      &http.ServeMux{},
+		logger:   slog.New(slog.DiscardHandler),
+		renewing: make(map[string]bool),
+	}
+	for _, o := range opts {
+		o(a)
+	}
+
+	if a.certs != nil {
+		a.mux.HandleFunc("GET /hosts", a.hosts)
+		a.mux.HandleFunc("GET /certificates", a.certificates)
+		a.mux.HandleFunc("POST /certificates/{host}/renew", a.renew)
+	}
+	if a.conns != nil {
+		a.mux.HandleFunc("GET /connections", a.connections)
+	}
+	if a.reload != nil {
+		a.mux.HandleFunc("POST /reload", a.reloadConfig)
+	}
+	if a.maintenance != nil {
+		a.mux.HandleFunc("GET /maintenance", a.maintenanceState)
+		a.mux.HandleFunc("PUT /maintenance", a.setMaintenance)
+		a.mux.HandleFunc("PUT /maintenance/{host}", a.setMaintenance)
+		a.mux.HandleFunc("DELETE /maintenance", a.setMaintenance)
+		a.mux.HandleFunc("DELETE /maintenance/{host}", a.setMaintenance)
+	}
+
+	return a
+}
+
+// ServeHTTP authenticates the request and passes it to the matching endpoint.
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if a.token != nil {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		sum := sha256.Sum256([]byte(token))
+		if !ok || subtle.ConstantTimeCompare(sum[:], a.token) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="aws admin"`)
+			writeAdminError(w, http.StatusUnauthorized, errors.New("invalid or missing bearer token"))
+			return
+		}
+	}
+	a.mux.ServeHTTP(w, r)
+}
+
+// writeAdminError writes err as a JSON error response with the passed status code.
+func writeAdminError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
+
+func (a *Admin) hosts(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, struct {
+		Hosts []string `json:"hosts"`
+	}{a.certs.Hosts()})
+}
+
+type adminCertificate struct {
+	Host      string     `json:"host"`
+	NotAfter  *time.Time `json:"not_after,omitempty"`
+	ExpiresIn float64    `json:"expires_in_seconds,omitempty"`
+	Renewing  bool       `json:"renewing"`
+	Error     string     `json:"error,omitempty"`
+}
+
+func (a *Admin) certificates(w http.ResponseWriter, r *http.Request) {
+	status := a.certs.Status(r.Context())
+	certs := make([]adminCertificate, len(status))
+	a.mu.Lock()
+	for i, s := range status {
+		certs[i] = adminCertificate{Host: s.Host, Renewing: a.renewing[s.Host]}
+		switch {
+		case errors.Is(s.Err, autocert.ErrCacheMiss):
+			certs[i].Error = "no certificate"
+		case s.Err != nil:
+			certs[i].Error = s.Err.Error()
+		default:
+			certs[i].NotAfter = &s.NotAfter
+			certs[i].ExpiresIn = time.Until(s.NotAfter).Round(time.Second).Seconds()
+		}
+	}
+	a.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, struct {
+		Certificates []adminCertificate `json:"certificates"`
+	}{certs})
+}
+
+// renew starts renewing a certificate in the background, as issuance can take longer than
+// clients are willing to wait for a response. Progress can be followed through /certificates.
+func (a *Admin) renew(w http.ResponseWriter, r *http.Request) {
+	host := r.PathValue("host")
+	if !slices.Contains(a.certs.Hosts(), host) {
+		writeAdminError(w, http.StatusNotFound, errors.New("unknown host "+host))
+		return
+	}
+	a.mu.Lock()
+	if a.renewing[host] {
+		a.mu.Unlock()
+		writeAdminError(w, http.StatusConflict, errors.New("already renewing "+host))
+		return
+	}
+	a.renewing[host] = true
+	a.mu.Unlock()
+
+	a.logger.Info("renewing certificate", "host", host)
+	go func() {
+		err := a.certs.Renew(host)
+		a.mu.Lock()
+		delete(a.renewing, host)
+		a.mu.Unlock()
+		if err != nil {
+			a.logger.Error("renewing certificate", "host", host, "error", err)
+			return
+		}
+		a.logger.Info("renewed certificate", "host", host)
+	}()
+
+	writeJSON(w, http.StatusAccepted, struct {
+		Host     string `json:"host"`
+		Renewing bool   `json:"renewing"`
+	}{host, true})
+}
+
+func (a *Admin) connections(w http.ResponseWriter, r *http.Request) {
+	s := a.conns.Stats()
+	writeJSON(w, http.StatusOK, struct {
+		Active   int    `json:"active"`
+		Clients  int    `json:"clients"`
+		Accepted uint64 `json:"accepted"`
+		Rejected uint64 `json:"rejected"`
+	}{s.Active, s.Clients, s.Accepted, s.Rejected})
+}
+
+func (a *Admin) reloadConfig(w http.ResponseWriter, r *http.Request) {
+	a.logger.Info("reloading configuration")
+	if err := a.reload(r.Context()); err != nil {
+		a.logger.Error("reloading configuration", "error", err)
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Reloaded bool `json:"reloaded"`
+	}{true})
+}
+
+func (a *Admin) maintenanceState(w http.ResponseWriter, r *http.Request) {
+	all, hosts := a.maintenance.State()
+	if hosts == nil {
+		hosts = []string{}
+	}
+	writeJSON(w, http.StatusOK, struct {
+		All   bool     `json:"all"`
+		Hosts []string `json:"hosts"`
+	}{all, hosts})
+}
+
+func (a *Admin) setMaintenance(w http.ResponseWriter, r *http.Request) {
+	var hosts []string
+	if host := r.PathValue("host"); host != "" {
+		hosts = append(hosts, host)
+	}
+	if r.Method == http.MethodPut {
+		a.maintenance.Enable(hosts...)
+		a.logger.Info("enabled maintenance", "hosts", hosts)
+	} else {
+		a.maintenance.Disable(hosts...)
+		a.logger.Info("disabled maintenance", "hosts", hosts)
+	}
+	a.maintenanceState(w, r)
+}
@@ -0,0 +1,117 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/acme/autocert"
+
+	server "github.com/admacleod/aws/internal"
+)
+
+func TestAdminToken(t *testing.T) {
+	admin := server.NewAdmin(
+		server.AdminToken("secret"),
+		server.AdminConnections(server.NewConnLimiter(0, 0)),
+	)
+
+	for _, tt := range []struct {
+		name     string
+		auth     string
+		expected int
+	}{
+		{"Missing", "", http.StatusUnauthorized},
+		{"Incorrect", "Bearer wrong", http.StatusUnauthorized},
+		{"WrongScheme", "Basic secret", http.StatusUnauthorized},
+		{"Correct", "Bearer secret", http.StatusOK},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/connections", nil)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			rec := httptest.NewRecorder()
+			admin.ServeHTTP(rec, req)
+			if rec.Code != tt.expected {
+				t.Errorf("incorrect status: expected=%d, got=%d", tt.expected, rec.Code)
+			}
+		})
+	}
+}
+
+func TestAdminEndpoints(t *testing.T) {
+	cache := autocert.DirCache(t.TempDir())
+	cacheCertificate(t, cache, "a.example.com")
+	maintenance := server.NewMaintenance()
+	reloaded := 0
+	admin := server.NewAdmin(
+		server.AdminCertificates(server.NewCertManager(cache, "a.example.com", "b.example.com")),
+		server.AdminConnections(server.NewConnLimiter(0, 0)),
+		server.AdminMaintenance(maintenance),
+		server.AdminReload(func(context.Context) error {
+			reloaded++
+			if reloaded > 1 {
+				return errors.New("reload failed")
+			}
+			return nil
+		}),
+	)
+
+	for _, tt := range []struct {
+		method   string
+		path     string
+		status   int
+		contains string
+	}{
+		{http.MethodGet, "/hosts", http.StatusOK, `"b.example.com"`},
+		{http.MethodGet, "/certificates", http.StatusOK, `"error": "no certificate"`},
+		{http.MethodGet, "/certificates", http.StatusOK, `"not_after"`},
+		{http.MethodPost, "/certificates/c.example.com/renew", http.StatusNotFound, `"error"`},
+		{http.MethodGet, "/connections", http.StatusOK, `"active": 0`},
+		{http.MethodPost, "/reload", http.StatusOK, `"reloaded": true`},
+		{http.MethodPost, "/reload", http.StatusInternalServerError, `"error": "reload failed"`},
+		{http.MethodPut, "/maintenance/a.example.com", http.StatusOK, `"a.example.com"`},
+		{http.MethodPut, "/maintenance", http.StatusOK, `"all": true`},
+		{http.MethodDelete, "/maintenance", http.StatusOK, `"hosts": []`},
+		{http.MethodGet, "/maintenance", http.StatusOK, `"all": false`},
+		{http.MethodPost, "/hosts", http.StatusMethodNotAllowed, ""},
+	} {
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, nil))
+		if rec.Code != tt.status {
+			t.Errorf("incorrect status for %s %s: expected=%d, got=%d", tt.method, tt.path, tt.status, rec.Code)
+		}
+		if !strings.Contains(rec.Body.String(), tt.contains) {
+			t.Errorf("incorrect body for %s %s: expected to contain %s, got=%s", tt.method, tt.path, tt.contains, rec.Body)
+		}
+	}
+	if maintenance.Enabled("a.example.com") {
+		t.Error("maintenance still enabled after disabling")
+	}
+}
+
+func TestAdminUnconfiguredEndpoints(t *testing.T) {
+	admin := server.NewAdmin()
+	rec := httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/connections", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("incorrect status: expected=%d, got=%d", http.StatusNotFound, rec.Code)
+	}
+}
@@ -0,0 +1,256 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrQueueFull is returned by AsyncWriter.Write when the queue is full and the write has been dropped.
+var ErrQueueFull = errors.New("log queue full")
+
+// AsyncWriter is an io.Writer that queues writes to be made to an underlying io.Writer by a
+// background goroutine, keeping slow disks and blocked pipes off the request path.
+//
+// Writes are buffered and flushed to the underlying io.Writer when the buffer fills, and at least
+// every flush interval.
+// When the queue is full writes are dropped and counted, unless BlockWhenFull is applied.
+// An AsyncWriter is safe for concurrent use and each call to Write is passed to the underlying
+// io.Writer whole, although several may be combined into a single call.
+//
+// If the underlying io.Writer is a FieldWriter, such as a SyslogWriter, then writes are not buffered
+// and are passed on individually, along with any fields given to WriteFields.
+type AsyncWriter struct {
+	out        io.Writer
+	queueSize  int
+	bufferSize int
+	flushEvery time.Duration
+	block      bool
+
+	queue   chan asyncRecord
+	flushes chan chan error
+	done    chan error
+	dropped atomic.Uint64
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// asyncRecord is a single queued write.
+type asyncRecord struct {
+	line   []byte
+	fields []LogField
+}
+
+// AsyncWriterOption is a function that will apply some option to an AsyncWriter.
+type AsyncWriterOption func(*AsyncWriter)
+
+// QueueSize creates an AsyncWriterOption that will set how many writes may be queued
+// before the AsyncWriter is full. The default is 1024, and sizes below one are ignored.
+func QueueSize(n int) AsyncWriterOption {
+	return func(w *AsyncWriter) {
+		if n > 0 {
+			w.queueSize = n
+		}
+	}
+}
+
+// BufferSize creates an AsyncWriterOption that will set the number of bytes buffered before
+// being written to the underlying io.Writer. The default is 64KiB.
+func BufferSize(bytes int) AsyncWriterOption {
+	return func(w *AsyncWriter) {
+		w.bufferSize = bytes
+	}
+}
+
+// FlushInterval creates an AsyncWriterOption that will set the longest time that a write may
+// be buffered for before being written to the underlying io.Writer. The default is one second,
+// and intervals that are not positive are ignored.
+func FlushInterval(interval time.Duration) AsyncWriterOption {
+	return func(w *AsyncWriter) {
+		if interval > 0 {
+			w.flushEvery = interval
+		}
+	}
+}
+
+// BlockWhenFull creates an AsyncWriterOption that will cause writes to wait for space in the
+// queue rather than being dropped.
+func BlockWhenFull() AsyncWriterOption {
+	return func(w *AsyncWriter) {
+		w.block = true
+	}
+}
+
+// NewAsyncWriter creates an AsyncWriter writing to out, with the passed AsyncWriterOptions applied
+// to it, and starts its background goroutine.
+// Close must be called to write any remaining queued writes and stop the goroutine.
+func NewAsyncWriter(out io.Writer, opts ...AsyncWriterOption) *AsyncWriter {
+	w := &AsyncWriter{
+		out:        out,
+		queueSize:  1024,
+		bufferSize: 64 << 10,
+		flushEvery: time.Second,
+		flushes:    make(chan chan error),
+		done:       make(chan error, 1),
+	}
+	for _, o := range opts {
+		o(w)
+	}
+	w.queue = make(chan asyncRecord, w.queueSize)
+	go w.run()
+
+	return w
+}
+
+// Write queues a copy of b to be written to the underlying io.Writer.
+//
+// Errors from the underlying io.Writer are not reported by Write, but by the next call to Flush or Close.
+func (w *AsyncWriter) Write(b []byte) (int, error) {
+	if err := w.enqueue(asyncRecord{line: append([]byte(nil), b...)}); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// WriteFields queues a copy of line to be written to the underlying io.Writer along with fields,
+// which are dropped if the underlying io.Writer is not a FieldWriter.
+func (w *AsyncWriter) WriteFields(line []byte, fields []LogField) error {
+	return w.enqueue(asyncRecord{line: append([]byte(nil), line...), fields: fields})
+}
+
+func (w *AsyncWriter) enqueue(rec asyncRecord) error {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if w.closed {
+		return os.ErrClosed
+	}
+	if w.block {
+		w.queue <- rec
+		return nil
+	}
+	select {
+	case w.queue <- rec:
+		return nil
+	default:
+		w.dropped.Add(1)
+		return ErrQueueFull
+	}
+}
+
+// Dropped returns the number of writes dropped because the queue was full.
+func (w *AsyncWriter) Dropped() uint64 {
+	return w.dropped.Load()
+}
+
+// Flush waits for every write queued before it was called to be written to the underlying io.Writer,
+// returning the first error encountered since the last flush.
+func (w *AsyncWriter) Flush() error {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if w.closed {
+		return os.ErrClosed
+	}
+	errc := make(chan error)
+	w.flushes <- errc
+
+	return <-errc
+}
+
+// Close stops accepting writes, writes any that are still queued to the underlying io.Writer,
+// and stops the background goroutine.
+// The underlying io.Writer is not closed.
+func (w *AsyncWriter) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return os.ErrClosed
+	}
+	w.closed = true
+	close(w.queue)
+	w.mu.Unlock()
+
+	return <-w.done
+}
+
+// run writes queued writes to the underlying io.Writer until the queue is closed.
+func (w *AsyncWriter) run() {
+	bw := bufio.NewWriterSize(w.out, w.bufferSize)
+	var err error
+	// fail records the first error since the last report. A failed bufio.Writer refuses all
+	// further writes so it is replaced, losing whatever it held.
+	fail := func(ferr error) {
+		if err == nil {
+			err = ferr
+		}
+		bw = bufio.NewWriterSize(w.out, w.bufferSize)
+	}
+	fw, _ := w.out.(FieldWriter)
+	write := func(rec asyncRecord) {
+		var werr error
+		if fw != nil {
+			werr = fw.WriteFields(rec.line, rec.fields)
+		} else {
+			_, werr = bw.Write(rec.line)
+		}
+		if werr != nil {
+			fail(werr)
+		}
+	}
+	flush := func() {
+		if ferr := bw.Flush(); ferr != nil {
+			fail(ferr)
+		}
+	}
+	report := func() error {
+		flush()
+		ferr := err
+		err = nil
+
+		return ferr
+	}
+
+	ticker := time.NewTicker(w.flushEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case rec, ok := <-w.queue:
+			if !ok {
+				w.done <- report()
+				return
+			}
+			write(rec)
+			// Drain whatever else is waiting so that bursts are written together.
+			for n := len(w.queue); n > 0; n-- {
+				write(<-w.queue)
+			}
+		case errc := <-w.flushes:
+			for n := len(w.queue); n > 0; n-- {
+				write(<-w.queue)
+			}
+			errc <- report()
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	server "github.com/admacleod/aws/internal"
+)
+
+// gatedWriter records writes, blocking each one until the gate is opened.
+type gatedWriter struct {
+	started chan struct{}
+	gate    chan struct{}
+	err     error
+
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func newGatedWriter(open bool) *gatedWriter {
+	w := &gatedWriter{started: make(chan struct{}, 16), gate: make(chan struct{})}
+	if open {
+		close(w.gate)
+	}
+
+	return w
+}
+
+func (w *gatedWriter) Write(b []byte) (int, error) {
+	w.started <- struct{}{}
+	<-w.gate
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	return w.buf.Write(b)
+}
+
+func (w *gatedWriter) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.buf.String()
+}
+
+func TestAsyncWriter(t *testing.T) {
+	out := newGatedWriter(true)
+	w := server.NewAsyncWriter(out, server.FlushInterval(time.Hour))
+	for _, l := range []string{"one\n", "two\n", "three\n"} {
+		if _, err := io.WriteString(w, l); err != nil {
+			t.Fatalf("could not write: %v", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("could not flush: %v", err)
+	}
+	if got := out.String(); got != "one\ntwo\nthree\n" {
+		t.Errorf("incorrect output after flush: expected=%q, got=%q", "one\ntwo\nthree\n", got)
+	}
+
+	io.WriteString(w, "four\n")
+	if err := w.Close(); err != nil {
+		t.Fatalf("could not close: %v", err)
+	}
+	if got := out.String(); got != "one\ntwo\nthree\nfour\n" {
+		t.Errorf("incorrect output after close: expected=%q, got=%q", "one\ntwo\nthree\nfour\n", got)
+	}
+	if _, err := io.WriteString(w, "late\n"); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("incorrect error writing after close: expected=%v, got=%v", os.ErrClosed, err)
+	}
+}
+
+func TestAsyncWriterFlushInterval(t *testing.T) {
+	out := newGatedWriter(true)
+	w := server.NewAsyncWriter(out, server.FlushInterval(10*time.Millisecond))
+	defer w.Close()
+	io.WriteString(w, "line\n")
+
+	deadline := time.Now().Add(time.Second)
+	for out.String() == "" && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := out.String(); got != "line\n" {
+		t.Errorf("incorrect output: expected=%q, got=%q", "line\n", got)
+	}
+}
+
+func TestAsyncWriterInvalidOptions(t *testing.T) {
+	out := newGatedWriter(true)
+	// Invalid sizes and intervals are ignored rather than panicking.
+	w := server.NewAsyncWriter(out, server.QueueSize(-1), server.FlushInterval(0))
+	io.WriteString(w, "line\n")
+	if err := w.Close(); err != nil {
+		t.Fatalf("could not close: %v", err)
+	}
+	if got := out.String(); got != "line\n" {
+		t.Errorf("incorrect output: expected=%q, got=%q", "line\n", got)
+	}
+}
+
+func TestAsyncWriterFull(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		opts    []server.AsyncWriterOption
+		dropped uint64
+		output  string
+	}{
+		{"Drop", nil, 1, "one\ntwo\n"},
+		{"Block", []server.AsyncWriterOption{server.BlockWhenFull()}, 0, "one\ntwo\nthree\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			out := newGatedWriter(false)
+			opts := append([]server.AsyncWriterOption{server.QueueSize(1), server.BufferSize(1)}, tt.opts...)
+			w := server.NewAsyncWriter(out, opts...)
+
+			// The first line is taken from the queue and blocks in the underlying writer,
+			// the second fills the queue, and the third has nowhere to go.
+			io.WriteString(w, "one\n")
+			<-out.started
+			io.WriteString(w, "two\n")
+			written := make(chan error, 1)
+			go func() {
+				_, err := io.WriteString(w, "three\n")
+				written <- err
+			}()
+			select {
+			case err := <-written:
+				if tt.dropped == 0 {
+					t.Fatalf("write returned while queue full: %v", err)
+				}
+				if !errors.Is(err, server.ErrQueueFull) {
+					t.Errorf("incorrect error: expected=%v, got=%v", server.ErrQueueFull, err)
+				}
+			case <-time.After(50 * time.Millisecond):
+				if tt.dropped != 0 {
+					t.Fatal("write blocked while queue full")
+				}
+			}
+
+			close(out.gate)
+			w.Close()
+			if got := w.Dropped(); got != tt.dropped {
+				t.Errorf("incorrect dropped count: expected=%d, got=%d", tt.dropped, got)
+			}
+			if got := out.String(); got != tt.output {
+				t.Errorf("incorrect output: expected=%q, got=%q", tt.output, got)
+			}
+		})
+	}
+}
+
+func TestAsyncWriterError(t *testing.T) {
+	out := newGatedWriter(true)
+	out.err = errors.New("disk full")
+	w := server.NewAsyncWriter(out, server.FlushInterval(time.Hour))
+	defer w.Close()
+
+	io.WriteString(w, "lost\n")
+	if err := w.Flush(); !errors.Is(err, out.err) {
+		t.Errorf("incorrect flush error: expected=%v, got=%v", out.err, err)
+	}
+
+	out.mu.Lock()
+	out.err = nil
+	out.mu.Unlock()
+	io.WriteString(w, "kept\n")
+	if err := w.Flush(); err != nil {
+		t.Errorf("unexpected flush error: %v", err)
+	}
+	if got := out.String(); got != "kept\n" {
+		t.Errorf("incorrect output: expected=%q, got=%q", "kept\n", got)
+	}
+}
+
+func TestAsyncWriterFields(t *testing.T) {
+	out := &fieldRecorder{}
+	w := server.NewAsyncWriter(out)
+	fields := []server.LogField{{Key: "status", Value: 200}}
+	io.WriteString(w, "plain\n")
+	w.WriteFields([]byte("structured\n"), fields)
+	w.Close()
+
+	expected := []string{"plain\n", "structured\n"}
+	if !reflect.DeepEqual(out.lines, expected) {
+		t.Errorf("incorrect lines: expected=%q, got=%q", expected, out.lines)
+	}
+	if len(out.fields) != 2 || out.fields[0] != nil || !reflect.DeepEqual(out.fields[1], fields) {
+		t.Errorf("incorrect fields: expected=%v, got=%v", [][]server.LogField{nil, fields}, out.fields)
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+type clientIPKey struct{}
+
+// TrustedProxies is a middleware generator function that will determine the real client IP address
+// for requests to the wrapped handler that arrive from one of the passed trusted networks.
+//
+// The client address is taken from the RFC 7239 Forwarded header, or the X-Forwarded-For header if
+// there is no Forwarded header, by working back from the closest proxy to the first address that is
+// not itself trusted. The result is stored in the request context for retrieval with ClientIP.
+//
+// Connections accepted through the ProxyProtocol listener already carry the client address and
+// so do not need this middleware unless there are further proxies in front of the load balancer.
+func TrustedProxies(nets ...*net.IPNet) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := remoteIP(r.RemoteAddr)
+			if !containsIP(nets, ip) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			hops := forwardedFor(r.Header)
+			for i := len(hops) - 1; i >= 0; i-- {
+				hop, err := netip.ParseAddr(remoteIP(hops[i]))
+				if err != nil {
+					// Obfuscated or unknown identifiers cannot be followed any further.
+					break
+				}
+				ip = hop.String()
+				if !containsIP(nets, ip) {
+					break
+				}
+			}
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPKey{}, ip)))
+		})
+	}
+}
+
+// ClientIP returns the IP address of the client that made the request.
+//
+// This is the address determined by the TrustedProxies middleware if it has been applied,
+// otherwise the address of the connection that the request arrived on.
+func ClientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+
+	return remoteIP(r.RemoteAddr)
+}
+
+// remoteIP returns the host part of a remote address such as http.Request.RemoteAddr.
+//
+// The port is removed if there is one, as are the brackets surrounding IPv6 addresses,
+// so that "192.0.2.1:443", "[2001:db8::1]:443", and "[fe80::1%eth0]" become "192.0.2.1",
+// "2001:db8::1", and "fe80::1%eth0" respectively.
+func remoteIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	if strings.HasPrefix(addr, "[") && strings.HasSuffix(addr, "]") {
+		return addr[1 : len(addr)-1]
+	}
+
+	return addr
+}
+
+// forwardedFor returns the chain of client addresses recorded by proxies, with the original
+// client first, from the Forwarded header or else the X-Forwarded-For header.
+func forwardedFor(h http.Header) []string {
+	var hops []string
+	if values := h.Values("Forwarded"); len(values) > 0 {
+		for _, element := range strings.Split(strings.Join(values, ","), ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+				if !strings.EqualFold(key, "for") {
+					continue
+				}
+				hops = append(hops, remoteIP(strings.Trim(value, `"`)))
+			}
+		}
+		return hops
+	}
+
+	for _, hop := range strings.Split(strings.Join(h.Values("X-Forwarded-For"), ","), ",") {
+		if hop = strings.TrimSpace(hop); hop != "" {
+			hops = append(hops, hop)
+		}
+	}
+
+	return hops
+}
+
+// containsIP reports whether the passed IP address, which may include an IPv6 zone, is within
+// any of the passed networks.
+func containsIP(nets []*net.IPNet, ip string) bool {
+	parsed, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(parsed.WithZone("").AsSlice()) {
+			return true
+		}
+	}
+
+	return false
+}
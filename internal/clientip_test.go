@@ -0,0 +1,87 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal_test
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	server "github.com/admacleod/aws/internal"
+)
+
+func TestTrustedProxies(t *testing.T) {
+	_, proxies4, _ := net.ParseCIDR("10.0.0.0/8")
+	_, proxies6, _ := net.ParseCIDR("fd00::/8")
+
+	for _, tt := range []struct {
+		name      string
+		remote    string
+		forwarded string
+		xff       string
+		expected  string
+	}{
+		{"Direct", "192.0.2.1:1234", "", "", "192.0.2.1"},
+		{"UntrustedXFF", "192.0.2.1:1234", "", "198.51.100.1", "192.0.2.1"},
+		{"UntrustedForwarded", "192.0.2.1:1234", "for=198.51.100.1", "", "192.0.2.1"},
+		{"TrustedNoHeader", "10.0.0.1:1234", "", "", "10.0.0.1"},
+		{"XFF", "10.0.0.1:1234", "", "198.51.100.1", "198.51.100.1"},
+		{"XFFChain", "10.0.0.1:1234", "", "203.0.113.1, 198.51.100.1, 10.0.0.2", "198.51.100.1"},
+		{"XFFAllTrusted", "10.0.0.1:1234", "", "10.0.0.3, 10.0.0.2", "10.0.0.3"},
+		{"XFFGarbage", "10.0.0.1:1234", "", "not-an-ip", "10.0.0.1"},
+		{"Forwarded", "10.0.0.1:1234", "for=198.51.100.1;proto=https;by=10.0.0.1", "", "198.51.100.1"},
+		{"ForwardedPort", "10.0.0.1:1234", `for="198.51.100.1:4711"`, "", "198.51.100.1"},
+		{"ForwardedIPv6", "10.0.0.1:1234", `for="[2001:db8:cafe::17]:4711"`, "", "2001:db8:cafe::17"},
+		{"ForwardedChain", "10.0.0.1:1234", "for=203.0.113.1, For=198.51.100.1, for=10.0.0.2", "", "198.51.100.1"},
+		{"ForwardedPreferred", "10.0.0.1:1234", "for=198.51.100.1", "203.0.113.1", "198.51.100.1"},
+		{"ForwardedObfuscated", "10.0.0.1:1234", "for=_hidden, for=10.0.0.2", "", "10.0.0.2"},
+		{"ForwardedUnknown", "10.0.0.1:1234", "for=unknown", "", "10.0.0.1"},
+		{"TrustedIPv6", "[fd00::1]:1234", "", "2001:db8::1", "2001:db8::1"},
+		{"TrustedIPv6Zone", "[fd00::1%eth0]:1234", "", "2001:db8::1", "2001:db8::1"},
+		{"ForwardedIPv6NoPort", "10.0.0.1:1234", `for="[2001:db8:cafe::17]"`, "", "2001:db8:cafe::17"},
+		{"XFFIPv6Bracketed", "10.0.0.1:1234", "", "[2001:db8::1]:4711", "2001:db8::1"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			handler := server.TrustedProxies(proxies4, proxies6)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = server.ClientIP(r)
+			}))
+
+			req := httptest.NewRequest("GET", "http://test.example.com", nil)
+			req.RemoteAddr = tt.remote
+			if tt.forwarded != "" {
+				req.Header.Set("Forwarded", tt.forwarded)
+			}
+			if tt.xff != "" {
+				req.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			if got != tt.expected {
+				t.Errorf("incorrect client IP: expected=%s, got=%s", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestClientIPWithoutMiddleware(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://test.example.com", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+
+	if got := server.ClientIP(req); got != "192.0.2.1" {
+		t.Errorf("incorrect client IP: expected=%s, got=%s", "192.0.2.1", got)
+	}
+}
@@ -0,0 +1,418 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// DefaultCompressTypes are the media types compressed by a Compressor unless CompressTypes is
+// applied. Types ending in "/" match every subtype, and types beginning with "+" match every
+// type with that structured syntax suffix.
+var DefaultCompressTypes = []string{
+	"text/",
+	"+json",
+	"+xml",
+	"application/javascript",
+	"application/json",
+	"application/manifest+json",
+	"application/wasm",
+	"application/xml",
+	"font/otf",
+	"font/ttf",
+	"image/bmp",
+	"image/svg+xml",
+	"image/vnd.microsoft.icon",
+	"image/x-icon",
+}
+
+// compressEncodings are the content codings a Compressor can produce, in order of preference.
+var compressEncodings = []string{"br", "zstd", "gzip"}
+
+// encoder is implemented by the gzip, brotli, and zstd writers.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+var encoderPools = map[string]*sync.Pool{
+	"gzip": {New: func() any {
+		return gzip.NewWriter(nil)
+	}},
+	"br": {New: func() any {
+		return brotli.NewWriterLevel(nil, 5)
+	}},
+	"zstd": {New: func() any {
+		// Browsers only support zstd windows of up to 8MiB.
+		enc, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(8<<20))
+		return enc
+	}},
+}
+
+// errServedFromCache is returned from writes of handlers whose response was served from a
+// CompressionCache, so that they stop producing the body.
+var errServedFromCache = errors.New("response served from compression cache")
+
+// Compressor holds the configuration of the Compress middleware.
+type Compressor struct {
+	minSize  int
+	types    []string
+	cache    CompressionCache
+	maxEntry int
+}
+
+// CompressorOption is a function that will apply some option to a Compressor.
+type CompressorOption func(*Compressor)
+
+// CompressMinSize creates a CompressorOption that sets the smallest response body, in bytes, that
+// will be compressed. The default is 1024 bytes.
+func CompressMinSize(bytes int) CompressorOption {
+	return func(c *Compressor) {
+		c.minSize = bytes
+	}
+}
+
+// CompressTypes creates a CompressorOption that sets the media types that will be compressed,
+// replacing DefaultCompressTypes.
+func CompressTypes(types ...string) CompressorOption {
+	return func(c *Compressor) {
+		c.types = types
+	}
+}
+
+// CompressCache creates a CompressorOption that stores compressed responses of up to maxEntry
+// bytes in the passed CompressionCache so that they are not compressed again.
+//
+// Only complete 200 OK responses to GET requests with a Last-Modified header, such as those of
+// http.FileServer, are cached. They are keyed by their coding, host, and cleaned path, ignoring
+// any query as files do not vary by it, and are replaced once their Last-Modified or uncompressed
+// Content-Length changes.
+func CompressCache(cache CompressionCache, maxEntry int) CompressorOption {
+	return func(c *Compressor) {
+		c.cache = cache
+		c.maxEntry = maxEntry
+	}
+}
+
+// NewCompressor creates a Compressor with the passed CompressorOptions applied to it.
+func NewCompressor(opts ...CompressorOption) *Compressor {
+	c := &Compressor{
+		minSize: 1024,
+		types:   DefaultCompressTypes,
+	}
+	for _, o := range opts {
+		o(c)
+	}
+
+	return c
+}
+
+// compressible reports whether responses with the passed Content-Type should be compressed.
+func (c *Compressor) compressible(ctype string) bool {
+	mediaType, _, _ := strings.Cut(ctype, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	for _, t := range c.types {
+		switch {
+		case strings.HasSuffix(t, "/") && strings.HasPrefix(mediaType, t),
+			strings.HasPrefix(t, "+") && strings.HasSuffix(mediaType, t),
+			mediaType == t:
+			return true
+		}
+	}
+
+	return false
+}
+
+// Compress is a middleware generator function that compresses responses from the wrapped handler
+// with brotli, zstd, or gzip, as preferred by the Accept-Encoding header of the request.
+//
+// Responses are only compressed if their media type is one of the compressible types of the
+// passed Compressor and their body is at least its minimum size. Responses that already have a
+// Content-Encoding, such as those from PrecompressedFileServer, are left alone, as are requests
+// with a Range header so that byte ranges continue to refer to the uncompressed content.
+func Compress(c *Compressor) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Range") != "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			cw := &compressWriter{
+				ResponseWriter: NewResponseWriter(w),
+				c:              c,
+				r:              r,
+				coding:         negotiateEncoding(r.Header, compressEncodings),
+			}
+			next.ServeHTTP(cw, r)
+			cw.finish()
+		})
+	}
+}
+
+// compressWriter buffers the start of a response until it can decide whether to compress it,
+// then writes the rest through an encoder if it does. Responses that are not compressed are
+// passed through ReadFrom so that files may still be sent without copying them through user space.
+type compressWriter struct {
+	*ResponseWriter
+	c      *Compressor
+	r      *http.Request
+	coding string
+
+	status  int
+	decided bool
+	buf     []byte
+	enc     encoder
+	err     error
+
+	cached       bool
+	cacheBuf     *limitBuffer
+	cacheKey     string
+	cacheVersion string
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.status != 0 {
+		return
+	}
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	cw.status = code
+	if cw.Header().Get("Content-Length") != "" || cw.r.Method == http.MethodHead || !bodyAllowed(code) {
+		cw.decide()
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.cached {
+		return 0, errServedFromCache
+	}
+	if !cw.decided {
+		cw.buf = append(cw.buf, b...)
+		if len(cw.buf) < cw.c.minSize {
+			return len(b), nil
+		}
+		cw.decide()
+		if err := cw.flushBuffer(); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+
+	return cw.write(b)
+}
+
+// write sends b to the client through the encoder, if the response is being compressed.
+func (cw *compressWriter) write(b []byte) (int, error) {
+	var n int
+	if cw.enc != nil {
+		n, cw.err = cw.enc.Write(b)
+	} else {
+		n, cw.err = cw.ResponseWriter.Write(b)
+	}
+
+	return n, cw.err
+}
+
+func (cw *compressWriter) flushBuffer() error {
+	if len(cw.buf) == 0 {
+		return nil
+	}
+	_, err := cw.write(cw.buf)
+	cw.buf = nil
+
+	return err
+}
+
+// decide writes the header of the response, choosing whether to compress it from the header and
+// any buffered start of the body.
+func (cw *compressWriter) decide() {
+	cw.decided = true
+	h := cw.Header()
+	if h.Get("Content-Type") == "" && h.Get("Content-Encoding") == "" && len(cw.buf) > 0 {
+		// Match the type that the server would otherwise detect.
+		h.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+	if !bodyAllowed(cw.status) || cw.status == http.StatusPartialContent ||
+		h.Get("Content-Encoding") != "" || !cw.c.compressible(h.Get("Content-Type")) {
+		cw.ResponseWriter.WriteHeader(cw.status)
+		return
+	}
+	if !headerContains(h, "Vary", "Accept-Encoding") {
+		h.Add("Vary", "Accept-Encoding")
+	}
+	length := h.Get("Content-Length")
+	if n, err := strconv.Atoi(length); (err == nil && n < cw.c.minSize) || (err != nil && len(cw.buf) < cw.c.minSize) || cw.coding == "" {
+		cw.ResponseWriter.WriteHeader(cw.status)
+		return
+	}
+
+	h.Del("Content-Length")
+	h.Del("Accept-Ranges")
+	h.Set("Content-Encoding", cw.coding)
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag)
+	}
+	if cw.r.Method == http.MethodHead {
+		cw.ResponseWriter.WriteHeader(cw.status)
+		return
+	}
+
+	dst := io.Writer(cw.ResponseWriter)
+	if lastModified := h.Get("Last-Modified"); cw.c.cache != nil && cw.status == http.StatusOK &&
+		cw.r.Method == http.MethodGet && lastModified != "" {
+		cw.cacheKey = cw.coding + " " + strings.ToLower(requestHost(cw.r)) + path.Clean("/"+cw.r.URL.Path)
+		cw.cacheVersion = lastModified + " " + length
+		if data, ok := cw.c.cache.Get(cw.cacheKey, cw.cacheVersion); ok {
+			h.Set("Content-Length", strconv.Itoa(len(data)))
+			cw.ResponseWriter.WriteHeader(cw.status)
+			cw.ResponseWriter.Write(data)
+			cw.cached = true
+			cw.buf = nil
+			return
+		}
+		cw.cacheBuf = &limitBuffer{max: cw.c.maxEntry}
+		dst = io.MultiWriter(cw.ResponseWriter, cw.cacheBuf)
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+	cw.enc = encoderPools[cw.coding].Get().(encoder)
+	cw.enc.Reset(dst)
+}
+
+// ReadFrom reads enough of src to decide whether to compress the response, then passes the rest
+// of it to the wrapped writer if the response is not being compressed.
+func (cw *compressWriter) ReadFrom(src io.Reader) (int64, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	var total int64
+	if !cw.decided {
+		// Hide ReadFrom so that io.Copy does not recurse.
+		n, err := io.Copy(struct{ io.Writer }{cw}, io.LimitReader(src, int64(max(cw.c.minSize-len(cw.buf), 1))))
+		total += n
+		if err != nil || !cw.decided {
+			return total, err
+		}
+	}
+	if cw.enc != nil || cw.cached {
+		n, err := io.Copy(struct{ io.Writer }{cw}, src)
+		return total + n, err
+	}
+	n, err := cw.ResponseWriter.ReadFrom(src)
+	cw.err = err
+
+	return total + n, err
+}
+
+// finish completes the response once the handler has returned.
+func (cw *compressWriter) finish() {
+	if cw.status == 0 {
+		return
+	}
+	if !cw.decided {
+		cw.decide()
+		cw.flushBuffer()
+	}
+	if cw.enc == nil {
+		return
+	}
+	if err := cw.enc.Close(); err != nil && cw.err == nil {
+		cw.err = err
+	}
+	cw.enc.Reset(nil)
+	encoderPools[cw.coding].Put(cw.enc)
+	cw.enc = nil
+	if cw.cacheBuf != nil && !cw.cacheBuf.over && cw.err == nil {
+		cw.c.cache.Put(cw.cacheKey, cw.cacheVersion, cw.cacheBuf.Bytes())
+	}
+}
+
+// Flush sends any buffered response to the client, deciding whether to compress the response
+// from what has been written so far.
+func (cw *compressWriter) Flush() {
+	cw.FlushError()
+}
+
+// FlushError is as Flush, returning any error that occurs.
+func (cw *compressWriter) FlushError() error {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.decided {
+		cw.decide()
+		if err := cw.flushBuffer(); err != nil {
+			return err
+		}
+	}
+	if cw.enc != nil {
+		if err := cw.enc.Flush(); err != nil {
+			return err
+		}
+	}
+
+	return cw.ResponseWriter.FlushError()
+}
+
+// bodyAllowed reports whether a response with the passed status may have a body.
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+// headerContains reports whether the comma separated list in header key contains token.
+func headerContains(h http.Header, key, token string) bool {
+	for _, value := range h.Values(key) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// limitBuffer collects writes until they exceed max bytes, after which it discards them.
+type limitBuffer struct {
+	bytes.Buffer
+	max  int
+	over bool
+}
+
+func (lb *limitBuffer) Write(b []byte) (int, error) {
+	if !lb.over && lb.Len()+len(b) > lb.max {
+		lb.over = true
+		lb.Reset()
+	}
+	if !lb.over {
+		lb.Buffer.Write(b)
+	}
+
+	return len(b), nil
+}
@@ -0,0 +1,299 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+
+	server "github.com/admacleod/aws/internal"
+)
+
+// decode decompresses body according to the passed content coding.
+func decode(t *testing.T, coding string, body []byte) string {
+	t.Helper()
+
+	var r io.Reader
+	switch coding {
+	case "":
+		return string(body)
+	case "gzip":
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("could not read gzip: %v", err)
+		}
+		r = gz
+	case "br":
+		r = brotli.NewReader(bytes.NewReader(body))
+	case "zstd":
+		zr, err := zstd.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("could not read zstd: %v", err)
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		t.Fatalf("unexpected coding %q", coding)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("could not decode %s: %v", coding, err)
+	}
+
+	return string(b)
+}
+
+func TestCompress(t *testing.T) {
+	large := strings.Repeat("compressible ", 200)
+	for _, tt := range []struct {
+		name     string
+		accept   string
+		ctype    string
+		encoding string
+		body     string
+		coding   string
+		vary     bool
+	}{
+		{"Gzip", "gzip", "text/html; charset=utf-8", "", large, "gzip", true},
+		{"Brotli", "gzip, br", "text/css", "", large, "br", true},
+		{"Zstandard", "gzip;q=0.5, zstd", "application/json", "", large, "zstd", true},
+		{"StructuredSuffix", "gzip", "application/ld+json", "", large, "gzip", true},
+		{"NotAccepted", "", "text/html", "", large, "", true},
+		{"TooSmall", "gzip", "text/html", "", "small", "", true},
+		{"Incompressible", "gzip", "image/png", "", large, "", false},
+		{"AlreadyEncoded", "gzip", "text/css", "br", large, "br", false},
+		{"Sniffed", "gzip", "", "", "<html>" + large, "gzip", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := server.Compress(server.NewCompressor())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.ctype != "" {
+					w.Header().Set("Content-Type", tt.ctype)
+				}
+				if tt.encoding != "" {
+					w.Header().Set("Content-Encoding", tt.encoding)
+				}
+				// Write in pieces to exercise buffering before the decision to compress.
+				for chunk := range strings.SplitSeq(tt.body, " ") {
+					io.WriteString(w, chunk+" ")
+				}
+			}))
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept-Encoding", tt.accept)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			coding := rec.Header().Get("Content-Encoding")
+			if coding != tt.coding {
+				t.Errorf("incorrect Content-Encoding: expected=%q, got=%q", tt.coding, coding)
+			}
+			if got := rec.Header().Get("Vary") == "Accept-Encoding"; got != tt.vary {
+				t.Errorf("incorrect Vary: expected=%t, got=%t", tt.vary, got)
+			}
+			if tt.encoding != "" {
+				coding = ""
+			}
+			expected := tt.body + " "
+			if got := decode(t, coding, rec.Body.Bytes()); got != expected {
+				t.Errorf("incorrect body: expected=%d bytes, got=%d bytes", len(expected), len(got))
+			}
+		})
+	}
+}
+
+func TestCompressFileServer(t *testing.T) {
+	dir := t.TempDir()
+	contents := strings.Repeat("body { color: black; }\n", 100)
+	if err := os.WriteFile(filepath.Join(dir, "style.css"), []byte(contents), 0o644); err != nil {
+		t.Fatalf("could not create file: %v", err)
+	}
+	handler := server.Compress(server.NewCompressor())(http.FileServer(http.Dir(dir)))
+
+	for _, tt := range []struct {
+		name   string
+		method string
+		header http.Header
+		status int
+		coding string
+		body   string
+	}{
+		{"Get", http.MethodGet, http.Header{}, http.StatusOK, "gzip", contents},
+		{"Head", http.MethodHead, http.Header{}, http.StatusOK, "gzip", ""},
+		{"Range", http.MethodGet, http.Header{"Range": {"bytes=0-3"}}, http.StatusPartialContent, "", "body"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/style.css", nil)
+			req.Header = tt.header
+			req.Header.Set("Accept-Encoding", "gzip")
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Errorf("incorrect status: expected=%d, got=%d", tt.status, rec.Code)
+			}
+			if got := rec.Header().Get("Content-Encoding"); got != tt.coding {
+				t.Errorf("incorrect Content-Encoding: expected=%q, got=%q", tt.coding, got)
+			}
+			if tt.coding != "" && rec.Header().Get("Content-Length") != "" {
+				t.Errorf("unexpected Content-Length on compressed response: %s", rec.Header().Get("Content-Length"))
+			}
+			if tt.method == http.MethodHead {
+				if rec.Body.Len() != 0 {
+					t.Errorf("unexpected body for HEAD: %d bytes", rec.Body.Len())
+				}
+				return
+			}
+			if got := decode(t, tt.coding, rec.Body.Bytes()); got != tt.body {
+				t.Errorf("incorrect body: expected=%d bytes, got=%d bytes", len(tt.body), len(got))
+			}
+		})
+	}
+}
+
+// countingHandler serves a fixed compressible body, counting the requests where it writes it all.
+type countingHandler struct {
+	modified time.Time
+	body     string
+	complete int
+}
+
+func (h *countingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Last-Modified", h.modified.UTC().Format(http.TimeFormat))
+	w.Header().Set("Content-Length", strconv.Itoa(len(h.body)))
+	for i := 0; i < len(h.body); i += 512 {
+		if _, err := io.WriteString(w, h.body[i:min(i+512, len(h.body))]); err != nil {
+			return
+		}
+	}
+	h.complete++
+}
+
+func TestCompressCache(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		cache func(t *testing.T) server.CompressionCache
+	}{
+		{"Memory", func(t *testing.T) server.CompressionCache {
+			return server.NewMemoryCompressionCache(1 << 20)
+		}},
+		{"Disk", func(t *testing.T) server.CompressionCache {
+			c, err := server.NewDiskCompressionCache(t.TempDir(), 1<<20)
+			if err != nil {
+				t.Fatalf("could not create cache: %v", err)
+			}
+			return c
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &countingHandler{modified: time.Now(), body: strings.Repeat("cache me ", 1000)}
+			handler := server.Compress(server.NewCompressor(server.CompressCache(tt.cache(t), 1<<20)))(h)
+			get := func(target string) string {
+				t.Helper()
+				req := httptest.NewRequest(http.MethodGet, target, nil)
+				req.Header.Set("Accept-Encoding", "br")
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, req)
+				return decode(t, rec.Header().Get("Content-Encoding"), rec.Body.Bytes())
+			}
+
+			// Queries and unclean paths must not create entries of their own.
+			for i, target := range []string{"/file.txt", "/file.txt?1", "/./file.txt?2"} {
+				if got := get(target); got != h.body {
+					t.Fatalf("incorrect body on request %d: expected=%d bytes, got=%d bytes", i, len(h.body), len(got))
+				}
+			}
+			if h.complete != 1 {
+				t.Errorf("incorrect complete responses from handler: expected=%d, got=%d", 1, h.complete)
+			}
+
+			// A modified resource must be compressed again.
+			h.modified = h.modified.Add(time.Hour)
+			h.body = strings.Repeat("changed ", 1000)
+			if got := get("/file.txt"); got != h.body {
+				t.Errorf("stale body served after modification")
+			}
+			if h.complete != 2 {
+				t.Errorf("incorrect complete responses from handler: expected=%d, got=%d", 2, h.complete)
+			}
+		})
+	}
+}
+
+// readFromRecorder is a httptest.ResponseRecorder that records whether ReadFrom was used, as it
+// is by the server to send files with sendfile.
+type readFromRecorder struct {
+	*httptest.ResponseRecorder
+	readFrom bool
+}
+
+func (rec *readFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	rec.readFrom = true
+
+	return io.Copy(struct{ io.Writer }{rec.ResponseRecorder}, src)
+}
+
+func TestCompressReadFrom(t *testing.T) {
+	body := strings.Repeat("read from ", 1000)
+	for _, tt := range []struct {
+		name     string
+		ctype    string
+		length   bool
+		coding   string
+		readFrom bool
+	}{
+		{"Incompressible", "image/png", true, "", true},
+		{"IncompressibleWithoutLength", "image/png", false, "", true},
+		{"Compressed", "text/plain", true, "gzip", false},
+		{"CompressedWithoutLength", "text/plain", false, "gzip", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := server.Compress(server.NewCompressor())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.ctype)
+				if tt.length {
+					w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+				}
+				// Hide WriteTo so that io.Copy uses ReadFrom, as it does for files.
+				io.Copy(w, struct{ io.Reader }{strings.NewReader(body)})
+			}))
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			rec := &readFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+			handler.ServeHTTP(rec, req)
+
+			if got := rec.Header().Get("Content-Encoding"); got != tt.coding {
+				t.Errorf("incorrect Content-Encoding: expected=%q, got=%q", tt.coding, got)
+			}
+			if got := decode(t, tt.coding, rec.Body.Bytes()); got != body {
+				t.Errorf("incorrect body: expected=%d bytes, got=%d bytes", len(body), len(got))
+			}
+			if rec.readFrom != tt.readFrom {
+				t.Errorf("incorrect use of ReadFrom: expected=%t, got=%t", tt.readFrom, rec.readFrom)
+			}
+		})
+	}
+}
@@ -0,0 +1,272 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// CompressionCache stores compressed responses for the Compress middleware.
+//
+// Each entry is stored under a key along with a version, and is only returned for that version
+// so that a changed resource is compressed again rather than served stale.
+type CompressionCache interface {
+	// Get returns the entry stored for key if it has the passed version.
+	Get(key, version string) ([]byte, bool)
+	// Put stores data for key with the passed version, replacing any existing entry.
+	Put(key, version string, data []byte)
+}
+
+// MemoryCompressionCache is a CompressionCache holding entries in memory, evicting the least
+// recently used entries to stay within its size.
+type MemoryCompressionCache struct {
+	max int64
+
+	mu      sync.Mutex
+	size    int64
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type memoryCacheEntry struct {
+	key     string
+	version string
+	data    []byte
+}
+
+// NewMemoryCompressionCache creates a MemoryCompressionCache holding at most maxBytes of entries.
+func NewMemoryCompressionCache(maxBytes int64) *MemoryCompressionCache {
+	return &MemoryCompressionCache{
+		max:     maxBytes,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Get returns the entry stored for key if it has the passed version, removing it if it has another.
+func (c *MemoryCompressionCache) Get(key, version string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*memoryCacheEntry)
+	if e.version != version {
+		c.remove(el)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+
+	return e.data, true
+}
+
+// Put stores data for key with the passed version, unless it is larger than the whole cache.
+func (c *MemoryCompressionCache) Put(key, version string, data []byte) {
+	if int64(len(data)) > c.max {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	c.entries[key] = c.order.PushFront(&memoryCacheEntry{key, version, bytes.Clone(data)})
+	c.size += int64(len(data))
+	for c.size > c.max {
+		c.remove(c.order.Back())
+	}
+}
+
+// Size returns the total size of the cached entries in bytes.
+func (c *MemoryCompressionCache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.size
+}
+
+func (c *MemoryCompressionCache) remove(el *list.Element) {
+	e := c.order.Remove(el).(*memoryCacheEntry)
+	delete(c.entries, e.key)
+	c.size -= int64(len(e.data))
+}
+
+// DiskCompressionCache is a CompressionCache holding entries as files in a directory, evicting the
+// least recently used entries to stay within its size.
+//
+// Each key has a single file, named by a hash of the key, that is replaced when a new version
+// is stored. Cache files left in the directory by an earlier run are counted towards the size,
+// oldest first in line for eviction. Any other files in the directory are left alone.
+type DiskCompressionCache struct {
+	dir string
+	max int64
+
+	mu      sync.Mutex
+	size    int64
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type diskCacheEntry struct {
+	name string
+	size int64
+}
+
+// NewDiskCompressionCache creates a DiskCompressionCache storing at most maxBytes of entries in
+// dir, creating it if it does not exist.
+func NewDiskCompressionCache(dir string, maxBytes int64) (*DiskCompressionCache, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	c := &DiskCompressionCache{
+		dir:     dir,
+		max:     maxBytes,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var existing []fs.FileInfo
+	for _, de := range dirEntries {
+		if isDiskCacheTemp(de.Name()) {
+			// Left behind by an interrupted Put.
+			os.Remove(filepath.Join(dir, de.Name()))
+			continue
+		}
+		if !isDiskCacheName(de.Name()) {
+			continue
+		}
+		if fi, err := de.Info(); err == nil && fi.Mode().IsRegular() {
+			existing = append(existing, fi)
+		}
+	}
+	slices.SortFunc(existing, func(a, b fs.FileInfo) int {
+		return a.ModTime().Compare(b.ModTime())
+	})
+	for _, fi := range existing {
+		c.entries[fi.Name()] = c.order.PushFront(&diskCacheEntry{fi.Name(), fi.Size()})
+		c.size += fi.Size()
+	}
+	c.evict()
+
+	return c, nil
+}
+
+func (c *DiskCompressionCache) name(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// isDiskCacheName reports whether name is that of a cache file, a hex encoded SHA-256 sum.
+func isDiskCacheName(name string) bool {
+	if len(name) != 2*sha256.Size {
+		return false
+	}
+	return strings.Trim(name, "0123456789abcdef") == ""
+}
+
+// isDiskCacheTemp reports whether name is that of a temporary file created by Put.
+func isDiskCacheTemp(name string) bool {
+	suffix, ok := strings.CutPrefix(name, ".tmp-")
+	return ok && suffix != "" && strings.Trim(suffix, "0123456789") == ""
+}
+
+// Get returns the entry stored for key if it has the passed version.
+func (c *DiskCompressionCache) Get(key, version string) ([]byte, bool) {
+	name := c.name(key)
+	b, err := os.ReadFile(filepath.Join(c.dir, name))
+	if err != nil {
+		return nil, false
+	}
+	stored, data, ok := bytes.Cut(b, []byte{'\n'})
+	if !ok || string(stored) != version {
+		return nil, false
+	}
+	c.mu.Lock()
+	if el, ok := c.entries[name]; ok {
+		c.order.MoveToFront(el)
+	}
+	c.mu.Unlock()
+
+	return data, true
+}
+
+// Put stores data for key with the passed version, unless it is larger than the whole cache,
+// replacing the file of any existing entry atomically so that concurrent readers never see a
+// partial entry.
+func (c *DiskCompressionCache) Put(key, version string, data []byte) {
+	entry := append([]byte(version+"\n"), data...)
+	if int64(len(entry)) > c.max {
+		return
+	}
+	f, err := os.CreateTemp(c.dir, ".tmp-*")
+	if err != nil {
+		return
+	}
+	_, err = f.Write(entry)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	name := c.name(key)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(c.dir, name))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return
+	}
+
+	if el, ok := c.entries[name]; ok {
+		c.size -= c.order.Remove(el).(*diskCacheEntry).size
+	}
+	c.entries[name] = c.order.PushFront(&diskCacheEntry{name, int64(len(entry))})
+	c.size += int64(len(entry))
+	c.evict()
+}
+
+// Size returns the total size of the cache files in bytes.
+func (c *DiskCompressionCache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.size
+}
+
+// evict removes the least recently used entries until the cache is within its size. It must be
+// called with mu held once the cache is in use.
+func (c *DiskCompressionCache) evict() {
+	for c.size > c.max && c.order.Len() > 0 {
+		e := c.order.Remove(c.order.Back()).(*diskCacheEntry)
+		delete(c.entries, e.name)
+		c.size -= e.size
+		os.Remove(filepath.Join(c.dir, e.name))
+	}
+}
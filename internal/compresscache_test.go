@@ -0,0 +1,117 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	server "github.com/admacleod/aws/internal"
+)
+
+func TestMemoryCompressionCache(t *testing.T) {
+	c := server.NewMemoryCompressionCache(10)
+	c.Put("a", "1", []byte("aaaa"))
+	c.Put("b", "1", []byte("bbbb"))
+	if _, ok := c.Get("a", "1"); !ok {
+		t.Error("missing entry a")
+	}
+	// Adding c evicts b, the least recently used entry.
+	c.Put("c", "1", []byte("cccc"))
+	if _, ok := c.Get("b", "1"); ok {
+		t.Error("least recently used entry not evicted")
+	}
+	if _, ok := c.Get("a", "2"); ok {
+		t.Error("entry returned for a different version")
+	}
+	if _, ok := c.Get("a", "1"); ok {
+		t.Error("entry of a different version not removed")
+	}
+	c.Put("d", "1", []byte("too large to cache"))
+	if _, ok := c.Get("d", "1"); ok {
+		t.Error("entry larger than the cache stored")
+	}
+	if size := c.Size(); size != 4 {
+		t.Errorf("incorrect size: expected=%d, got=%d", 4, size)
+	}
+}
+
+func TestDiskCompressionCache(t *testing.T) {
+	dir := t.TempDir()
+	c, err := server.NewDiskCompressionCache(dir, 1<<20)
+	if err != nil {
+		t.Fatalf("could not create cache: %v", err)
+	}
+	c.Put("key", "1", []byte("first"))
+	c.Put("key", "2", []byte("second"))
+
+	if _, ok := c.Get("key", "1"); ok {
+		t.Error("replaced version returned")
+	}
+	if data, ok := c.Get("key", "2"); !ok || string(data) != "second" {
+		t.Errorf("incorrect entry: expected=%q, got=%q", "second", data)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("incorrect number of cache files: expected=%d, got=%d", 1, len(entries))
+	}
+}
+
+func TestDiskCompressionCacheEviction(t *testing.T) {
+	dir := t.TempDir()
+	// Entries take their data plus the version and a newline.
+	c, err := server.NewDiskCompressionCache(dir, 12)
+	if err != nil {
+		t.Fatalf("could not create cache: %v", err)
+	}
+	c.Put("a", "1", []byte("aaaa"))
+	c.Put("b", "1", []byte("bbbb"))
+	if _, ok := c.Get("a", "1"); !ok {
+		t.Error("missing entry a")
+	}
+	// Adding c evicts b, the least recently used entry.
+	c.Put("c", "1", []byte("cccc"))
+	if _, ok := c.Get("b", "1"); ok {
+		t.Error("least recently used entry not evicted")
+	}
+	c.Put("d", "1", []byte("too large to cache"))
+	if _, ok := c.Get("d", "1"); ok {
+		t.Error("entry larger than the cache stored")
+	}
+	if size := c.Size(); size != 12 {
+		t.Errorf("incorrect size: expected=%d, got=%d", 12, size)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+		t.Errorf("incorrect number of cache files: expected=%d, got=%d", 2, len(entries))
+	}
+
+	// Files from an earlier run count towards the size of a new cache over the same directory,
+	// while files the cache did not create are neither counted nor removed.
+	for _, name := range []string{"unrelated", ".tmp-unrelated", strings.Repeat("A", 64)} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("unrelated file"), 0o600); err != nil {
+			t.Fatalf("could not create unrelated file: %v", err)
+		}
+	}
+	reopened, err := server.NewDiskCompressionCache(dir, 6)
+	if err != nil {
+		t.Fatalf("could not reopen cache: %v", err)
+	}
+	if size := reopened.Size(); size != 6 {
+		t.Errorf("incorrect size after reopening: expected=%d, got=%d", 6, size)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 4 {
+		t.Errorf("incorrect number of files after reopening: expected=%d, got=%d", 4, len(entries))
+	}
+}
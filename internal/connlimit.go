@@ -0,0 +1,168 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// ConnLimiter limits the number of concurrent connections accepted by a server, both from each
+// remote IP address and in total.
+//
+// Connections over either limit are closed as soon as they are accepted, before any TLS handshake
+// or request parsing takes place, which stops a single client from tying up the server with many
+// slow connections.
+// A single ConnLimiter may be shared by several servers, in which case the limits apply across all of them.
+type ConnLimiter struct {
+	perIP int
+	total int
+
+	mu      sync.Mutex
+	active  int
+	clients map[string]int
+
+	accepted atomic.Uint64
+	rejected atomic.Uint64
+}
+
+// ConnStats is a snapshot of the counters kept by a ConnLimiter.
+type ConnStats struct {
+	// Active is the number of connections currently open.
+	Active int
+	// Clients is the number of distinct remote IP addresses with open connections.
+	Clients int
+	// Accepted is the total number of connections allowed through the limiter.
+	Accepted uint64
+	// Rejected is the total number of connections closed for exceeding a limit.
+	Rejected uint64
+}
+
+// NewConnLimiter creates a ConnLimiter allowing at most perIP concurrent connections from each
+// remote IP address and total concurrent connections overall.
+// A limit of zero or less disables that limit.
+func NewConnLimiter(perIP, total int) *ConnLimiter {
+	return &ConnLimiter{
+		perIP:   perIP,
+		total:   total,
+		clients: make(map[string]int),
+	}
+}
+
+// LimitConnections creates a server.Option function that will apply the passed ConnLimiter to
+// the connections accepted by the server.
+func LimitConnections(l *ConnLimiter) Option {
+	return func(srv *Server) {
+		srv.listeners = append(srv.listeners, l.Listener)
+	}
+}
+
+// Listener wraps the passed net.Listener so that connections exceeding the limits are closed
+// rather than returned from Accept.
+func (l *ConnLimiter) Listener(ln net.Listener) net.Listener {
+	return &limitListener{ln, l}
+}
+
+// Stats returns a snapshot of the current connection counters.
+func (l *ConnLimiter) Stats() ConnStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return ConnStats{
+		Active:   l.active,
+		Clients:  len(l.clients),
+		Accepted: l.accepted.Load(),
+		Rejected: l.rejected.Load(),
+	}
+}
+
+func (l *ConnLimiter) acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if (l.total > 0 && l.active >= l.total) || (l.perIP > 0 && l.clients[ip] >= l.perIP) {
+		return false
+	}
+	l.active++
+	l.clients[ip]++
+
+	return true
+}
+
+func (l *ConnLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.active--
+	if l.clients[ip]--; l.clients[ip] <= 0 {
+		delete(l.clients, ip)
+	}
+}
+
+type limitListener struct {
+	net.Listener
+	limiter *ConnLimiter
+}
+
+func (ll *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := ll.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		ip := remoteIP(conn.RemoteAddr().String())
+		if !ll.limiter.acquire(ip) {
+			ll.limiter.rejected.Add(1)
+			conn.Close()
+			continue
+		}
+		ll.limiter.accepted.Add(1)
+
+		return &limitConn{Conn: conn, release: func() { ll.limiter.release(ip) }}, nil
+	}
+}
+
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+// ReadFrom allows the underlying connection to use sendfile where it is able to.
+func (lc *limitConn) ReadFrom(r io.Reader) (int64, error) {
+	if rf, ok := lc.Conn.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+
+	return io.Copy(struct{ io.Writer }{lc.Conn}, r)
+}
+
+// CloseWrite shuts down the writing side of the underlying connection where it is able to, as
+// the server does before closing a connection so that the client receives the whole response.
+func (lc *limitConn) CloseWrite() error {
+	if cw, ok := lc.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+
+	return errors.ErrUnsupported
+}
+
+func (lc *limitConn) Close() error {
+	lc.once.Do(lc.release)
+
+	return lc.Conn.Close()
+}
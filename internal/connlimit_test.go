@@ -0,0 +1,193 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	server "github.com/admacleod/aws/internal"
+)
+
+// dialFrom connects to addr using the passed local IP address as the source.
+func dialFrom(t *testing.T, ip, addr string) net.Conn {
+	t.Helper()
+
+	d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(ip)}, Timeout: time.Second}
+	conn, err := d.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("could not dial %s from %s: %v", addr, ip, err)
+	}
+
+	return conn
+}
+
+// isClosed reports whether the remote end has closed conn.
+func isClosed(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err := conn.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return false
+	}
+
+	return true
+}
+
+func TestConnLimiter(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	limiter := server.NewConnLimiter(2, 3)
+	ln = limiter.Listener(ln)
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	addr := ln.Addr().String()
+	var clients []net.Conn
+	for _, tt := range []struct {
+		ip     string
+		closed bool
+	}{
+		{"127.0.0.1", false},
+		{"127.0.0.1", false},
+		{"127.0.0.1", true}, // over the per IP limit
+		{"127.0.0.2", false},
+		{"127.0.0.3", true}, // over the total limit
+	} {
+		conn := dialFrom(t, tt.ip, addr)
+		defer conn.Close()
+		if closed := isClosed(conn); closed != tt.closed {
+			t.Errorf("incorrect connection state from %s: expected closed=%t, got=%t", tt.ip, tt.closed, closed)
+		}
+		clients = append(clients, conn)
+	}
+
+	expected := server.ConnStats{Active: 3, Clients: 2, Accepted: 3, Rejected: 2}
+	if got := limiter.Stats(); got != expected {
+		t.Errorf("incorrect stats: expected=%+v, got=%+v", expected, got)
+	}
+
+	// Closing an accepted connection on the server side frees up space for the client.
+	(<-accepted).Close()
+	conn := dialFrom(t, "127.0.0.1", addr)
+	defer conn.Close()
+	if isClosed(conn) {
+		t.Errorf("connection was rejected after space was freed")
+	}
+
+	expected = server.ConnStats{Active: 3, Clients: 2, Accepted: 4, Rejected: 2}
+	if got := limiter.Stats(); got != expected {
+		t.Errorf("incorrect stats: expected=%+v, got=%+v", expected, got)
+	}
+}
+
+func TestLimitConnectionsOption(t *testing.T) {
+	addr := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	limiter := server.NewConnLimiter(10, 0)
+	testSrv := server.New(
+		server.LimitConnections(limiter),
+	)
+	testSrv.Addr = addr
+	startServer(t, testSrv, addr, testSrv.ListenAndServe)
+
+	res, err := http.Get(fmt.Sprintf("http://%s/", addr))
+	if err != nil {
+		t.Fatalf("could not make request: %v", err)
+	}
+	res.Body.Close()
+
+	// startServer's own probe connection counts towards the accepted total.
+	if got := limiter.Stats().Accepted; got < 2 {
+		t.Errorf("incorrect accepted connections: expected>=2, got=%d", got)
+	}
+}
+
+func TestConnLimiterIPv6(t *testing.T) {
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback unavailable: %v", err)
+	}
+	limiter := server.NewConnLimiter(1, 0)
+	ln = limiter.Listener(ln)
+	defer ln.Close()
+	go func() {
+		for {
+			if _, err := ln.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+
+	first := dialFrom(t, "::1", ln.Addr().String())
+	defer first.Close()
+	if isClosed(first) {
+		t.Errorf("first connection from ::1 was rejected")
+	}
+	second := dialFrom(t, "::1", ln.Addr().String())
+	defer second.Close()
+	if !isClosed(second) {
+		t.Errorf("second connection from ::1 was not rejected")
+	}
+}
+
+func TestConnLimiterCloseWrite(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	ln = server.NewConnLimiter(0, 0).Listener(ln)
+	defer ln.Close()
+
+	client := dialFrom(t, "127.0.0.1", ln.Addr().String())
+	defer client.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("could not accept: %v", err)
+	}
+	defer conn.Close()
+
+	cw, ok := conn.(interface{ CloseWrite() error })
+	if !ok {
+		t.Fatal("connection does not implement CloseWrite")
+	}
+	if err := cw.CloseWrite(); err != nil {
+		t.Fatalf("could not close for writing: %v", err)
+	}
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("incorrect read error after CloseWrite: expected=%v, got=%v", io.EOF, err)
+	}
+	// The connection can still be read from after shutting down writes.
+	client.Write([]byte("x"))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		t.Errorf("could not read after CloseWrite: %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+// deadlineChunk is how much of the body is sent by ReadFrom between extensions of the deadline,
+// matching the buffer used by io.Copy so that clients must make the same progress either way.
+const deadlineChunk = 32 << 10
+
+type deadlineResponseWriter struct {
+	*ResponseWriter
+	rc      *http.ResponseController
+	timeout time.Duration
+}
+
+// extend pushes the write deadline back by the timeout.
+func (drw *deadlineResponseWriter) extend() {
+	// Not every http.ResponseWriter supports deadlines, in which case the server
+	// WriteTimeout continues to apply.
+	_ = drw.rc.SetWriteDeadline(time.Now().Add(drw.timeout))
+}
+
+func (drw *deadlineResponseWriter) Write(bb []byte) (int, error) {
+	drw.extend()
+
+	return drw.ResponseWriter.Write(bb)
+}
+
+// ReadFrom sends the body in chunks, extending the deadline before each, while still allowing
+// the wrapped writer to send files without copying them through user space.
+func (drw *deadlineResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	var total int64
+	for {
+		drw.extend()
+		n, err := drw.ResponseWriter.ReadFrom(io.LimitReader(src, deadlineChunk))
+		total += n
+		if err != nil || n < deadlineChunk {
+			if errors.Is(err, io.EOF) {
+				err = nil
+			}
+			return total, err
+		}
+	}
+}
+
+// ExtendWriteDeadline is a middleware generator function that will push the write deadline
+// of the connection back by the passed timeout every time the wrapped handler writes
+// part of the response body.
+//
+// This allows large responses, such as file downloads, to slow clients to take longer than
+// the server WriteTimeout so long as the client continues to make progress.
+func ExtendWriteDeadline(timeout time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			drw := &deadlineResponseWriter{NewResponseWriter(w), http.NewResponseController(w), timeout}
+			next.ServeHTTP(drw, r)
+		})
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	server "github.com/admacleod/aws/internal"
+)
+
+func TestExtendWriteDeadline(t *testing.T) {
+	chunk := strings.Repeat("a", 64*1024)
+	chunks := 10
+	testHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < chunks; i++ {
+			if _, err := io.WriteString(w, chunk); err != nil {
+				return
+			}
+			time.Sleep(25 * time.Millisecond)
+		}
+	})
+
+	for _, tt := range []struct {
+		name     string
+		mw       func(http.Handler) http.Handler
+		complete bool
+	}{
+		{"WithoutExtension", server.ChainMiddleware(), false},
+		{"WithExtension", server.ExtendWriteDeadline(100 * time.Millisecond), true},
+		{"WithExtensionThroughLogger", server.ChainMiddleware(
+			server.ExtendWriteDeadline(100*time.Millisecond),
+			server.CombinedLogFormatLogger(io.Discard),
+		), true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+			testSrv := server.New(
+				server.WriteTimeout(100*time.Millisecond),
+				server.Handle(tt.mw(testHandler)),
+			)
+			testSrv.Addr = addr
+			startServer(t, testSrv, addr, testSrv.ListenAndServe)
+
+			res, err := http.Get(fmt.Sprintf("http://%s/", addr))
+			var body []byte
+			if err == nil {
+				body, err = io.ReadAll(res.Body)
+				res.Body.Close()
+			}
+
+			complete := err == nil && len(body) == chunks*len(chunk)
+			if complete != tt.complete {
+				t.Errorf("incorrect response completion: expected=%t, got=%t (read %d bytes, err=%v)", tt.complete, complete, len(body), err)
+			}
+		})
+	}
+}
+
+// slowReader returns remaining bytes in reads of at most size, pausing before each.
+type slowReader struct {
+	remaining int
+	size      int
+	pause     time.Duration
+}
+
+func (s *slowReader) Read(b []byte) (int, error) {
+	if s.remaining == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(s.pause)
+	n := min(len(b), s.size, s.remaining)
+	for i := range n {
+		b[i] = 'a'
+	}
+	s.remaining -= n
+
+	return n, nil
+}
+
+func TestExtendWriteDeadlineReadFrom(t *testing.T) {
+	size, chunks := 32*1024, 10
+	testHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(io.ReaderFrom); !ok {
+			t.Error("response writer does not implement io.ReaderFrom")
+		}
+		io.Copy(w, &slowReader{chunks * size, size, 25 * time.Millisecond})
+	})
+
+	addr := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	testSrv := server.New(
+		server.WriteTimeout(100*time.Millisecond),
+		server.Handle(server.ExtendWriteDeadline(100*time.Millisecond)(testHandler)),
+	)
+	testSrv.Addr = addr
+	startServer(t, testSrv, addr, testSrv.ListenAndServe)
+
+	res, err := http.Get(fmt.Sprintf("http://%s/", addr))
+	if err != nil {
+		t.Fatalf("could not get response: %v", err)
+	}
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil || len(body) != chunks*size {
+		t.Errorf("incomplete response: expected=%d bytes, got=%d (err=%v)", chunks*size, len(body), err)
+	}
+}
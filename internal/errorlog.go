@@ -0,0 +1,190 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal
+
+import (
+	"context"
+	"io"
+	"log"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// Kinds of server error, recorded in the "kind" attribute of error log records.
+const (
+	ErrorKindTLSHandshake     = "tls_handshake"
+	ErrorKindACME             = "acme"
+	ErrorKindClientDisconnect = "client_disconnect"
+	ErrorKindPanic            = "panic"
+	ErrorKindAccept           = "accept"
+)
+
+// NewErrorLogger creates a log.Logger, suitable for use as a http.Server ErrorLog, that passes each
+// message to the passed slog.Handler.
+//
+// Common server errors are recognised and recorded with a short message, a level, and attributes
+// for the kind of error, the remote address, and the underlying error:
+//
+//	TLS handshake failures      kind=tls_handshake at LevelWarn
+//	certificate manager errors  kind=acme at LevelWarn
+//	clients going away          kind=client_disconnect at LevelDebug
+//	handler panics              kind=panic at LevelError, with the stack trace
+//	failures to accept          kind=accept at LevelError
+//
+// All other messages are recorded as they are at LevelError.
+func NewErrorLogger(h slog.Handler) *log.Logger {
+	return log.New(errorLogWriter{h}, "", 0)
+}
+
+// errorLogWriter adapts the output of a log.Logger into slog records.
+type errorLogWriter struct {
+	handler slog.Handler
+}
+
+func (w errorLogWriter) Write(b []byte) (int, error) {
+	level, msg, attrs := classifyError(strings.TrimRight(string(b), "\n"))
+	ctx := context.Background()
+	if !w.handler.Enabled(ctx, level) {
+		return len(b), nil
+	}
+	r := slog.NewRecord(time.Now(), level, msg, 0)
+	r.AddAttrs(attrs...)
+
+	return len(b), w.handler.Handle(ctx, r)
+}
+
+// SeverityWriter is implemented by log outputs that record a syslog severity with each message,
+// such as SyslogWriter and JournalWriter.
+type SeverityWriter interface {
+	io.Writer
+	// WriteSeverity writes b as a single message with the passed severity.
+	WriteSeverity(severity int, b []byte) (int, error)
+}
+
+// NewSeverityHandler creates a slog.Handler that formats records as slog.TextHandler does, writing
+// each to the passed SeverityWriter with the severity matching its level:
+//
+//	below LevelInfo   SeverityDebug
+//	LevelInfo         SeverityInfo
+//	LevelWarn         SeverityWarning
+//	LevelError        SeverityError
+func NewSeverityHandler(w SeverityWriter, opts *slog.HandlerOptions) slog.Handler {
+	var h severityHandler
+	for i, severity := range []int{SeverityDebug, SeverityInfo, SeverityWarning, SeverityError} {
+		h[i] = slog.NewTextHandler(severityWriter{w, severity}, opts)
+	}
+
+	return h
+}
+
+// severityHandler holds a handler for each severity, indexed as in NewSeverityHandler.
+type severityHandler [4]slog.Handler
+
+func (h severityHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h[0].Enabled(ctx, level)
+}
+
+func (h severityHandler) Handle(ctx context.Context, r slog.Record) error {
+	var i int
+	switch {
+	case r.Level >= slog.LevelError:
+		i = 3
+	case r.Level >= slog.LevelWarn:
+		i = 2
+	case r.Level >= slog.LevelInfo:
+		i = 1
+	}
+
+	return h[i].Handle(ctx, r)
+}
+
+func (h severityHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	for i := range h {
+		h[i] = h[i].WithAttrs(attrs)
+	}
+
+	return h
+}
+
+func (h severityHandler) WithGroup(name string) slog.Handler {
+	for i := range h {
+		h[i] = h[i].WithGroup(name)
+	}
+
+	return h
+}
+
+// severityWriter writes every message to a SeverityWriter with the same severity.
+type severityWriter struct {
+	w        SeverityWriter
+	severity int
+}
+
+func (w severityWriter) Write(b []byte) (int, error) {
+	return w.w.WriteSeverity(w.severity, b)
+}
+
+// classifyError recognises messages logged by the http servers, returning the level, message, and
+// attributes to record them with.
+func classifyError(msg string) (slog.Level, string, []slog.Attr) {
+	if rest, ok := strings.CutPrefix(msg, "http: TLS handshake error from "); ok {
+		addr, err, _ := strings.Cut(rest, ": ")
+		kind, level := ErrorKindTLSHandshake, slog.LevelWarn
+		switch {
+		case strings.Contains(err, "acme"):
+			// Both autocert errors and failures to reach the ACME directory.
+			kind = ErrorKindACME
+		case isDisconnect(err):
+			kind, level = ErrorKindClientDisconnect, slog.LevelDebug
+		}
+		return level, "TLS handshake error", []slog.Attr{
+			slog.String("kind", kind),
+			slog.String("remote_addr", addr),
+			slog.String("error", err),
+		}
+	}
+	if rest, ok := strings.CutPrefix(msg, "http: panic serving "); ok {
+		rest, stack, _ := strings.Cut(rest, "\n")
+		addr, err, _ := strings.Cut(rest, ": ")
+		return slog.LevelError, "panic serving request", []slog.Attr{
+			slog.String("kind", ErrorKindPanic),
+			slog.String("remote_addr", addr),
+			slog.String("error", err),
+			slog.String("stack", stack),
+		}
+	}
+	if err, ok := strings.CutPrefix(msg, "http: Accept error: "); ok {
+		return slog.LevelError, "accept error", []slog.Attr{
+			slog.String("kind", ErrorKindAccept),
+			slog.String("error", err),
+		}
+	}
+	if isDisconnect(msg) {
+		return slog.LevelDebug, msg, []slog.Attr{slog.String("kind", ErrorKindClientDisconnect)}
+	}
+
+	return slog.LevelError, msg, nil
+}
+
+// isDisconnect reports whether the error text describes a client closing or abandoning its connection.
+func isDisconnect(err string) bool {
+	for _, s := range []string{"EOF", "connection reset by peer", "broken pipe", "i/o timeout", "use of closed network connection"} {
+		if strings.Contains(err, s) {
+			return true
+		}
+	}
+
+	return false
+}
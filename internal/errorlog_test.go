@@ -0,0 +1,136 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"slices"
+	"strings"
+	"testing"
+
+	server "github.com/admacleod/aws/internal"
+)
+
+func TestErrorLogger(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		message  string
+		expected map[string]any
+	}{
+		{
+			"TLSHandshake",
+			"http: TLS handshake error from 192.0.2.1:1234: remote error: tls: bad certificate",
+			map[string]any{"level": "WARN", "msg": "TLS handshake error", "kind": server.ErrorKindTLSHandshake, "remote_addr": "192.0.2.1:1234", "error": "remote error: tls: bad certificate"},
+		},
+		{
+			"ACME",
+			`http: TLS handshake error from [2001:db8::1]:1234: acme/autocert: host "other.example.com" not configured in HostWhitelist`,
+			map[string]any{"level": "WARN", "msg": "TLS handshake error", "kind": server.ErrorKindACME, "remote_addr": "[2001:db8::1]:1234", "error": `acme/autocert: host "other.example.com" not configured in HostWhitelist`},
+		},
+		{
+			"ACMEDirectory",
+			`http: TLS handshake error from 192.0.2.1:1234: Get "https://acme-v02.api.letsencrypt.org/directory": dial tcp: i/o timeout`,
+			map[string]any{"level": "WARN", "kind": server.ErrorKindACME},
+		},
+		{
+			"HandshakeDisconnect",
+			"http: TLS handshake error from 192.0.2.1:1234: EOF",
+			map[string]any{"level": "DEBUG", "msg": "TLS handshake error", "kind": server.ErrorKindClientDisconnect, "remote_addr": "192.0.2.1:1234", "error": "EOF"},
+		},
+		{
+			"Disconnect",
+			"http2: server: error reading preface from client 192.0.2.1:1234: read tcp 192.0.2.2:443->192.0.2.1:1234: read: connection reset by peer",
+			map[string]any{"level": "DEBUG", "kind": server.ErrorKindClientDisconnect},
+		},
+		{
+			"Panic",
+			"http: panic serving 192.0.2.1:1234: oops\ngoroutine 1 [running]:",
+			map[string]any{"level": "ERROR", "msg": "panic serving request", "kind": server.ErrorKindPanic, "remote_addr": "192.0.2.1:1234", "error": "oops", "stack": "goroutine 1 [running]:"},
+		},
+		{
+			"Accept",
+			"http: Accept error: accept tcp [::]:443: accept4: too many open files; retrying in 5ms",
+			map[string]any{"level": "ERROR", "msg": "accept error", "kind": server.ErrorKindAccept},
+		},
+		{
+			"Other",
+			"http: superfluous response.WriteHeader call",
+			map[string]any{"level": "ERROR", "msg": "http: superfluous response.WriteHeader call"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := server.NewErrorLogger(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+			logger.Print(tt.message)
+
+			var got map[string]any
+			if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+				t.Fatalf("could not decode log record %q: %v", buf.String(), err)
+			}
+			for k, v := range tt.expected {
+				if got[k] != v {
+					t.Errorf("incorrect %s: expected=%v, got=%v", k, v, got[k])
+				}
+			}
+		})
+	}
+}
+
+func TestErrorLoggerLevel(t *testing.T) {
+	var buf bytes.Buffer
+	logger := server.NewErrorLogger(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	logger.Print("http: TLS handshake error from 192.0.2.1:1234: EOF")
+	if buf.Len() != 0 {
+		t.Errorf("unexpected record below level: %q", buf.String())
+	}
+}
+
+// severityRecorder is a SeverityWriter recording the severity of each message.
+type severityRecorder struct {
+	severities []int
+	messages   []string
+}
+
+func (r *severityRecorder) Write(b []byte) (int, error) {
+	return r.WriteSeverity(-1, b)
+}
+
+func (r *severityRecorder) WriteSeverity(severity int, b []byte) (int, error) {
+	r.severities = append(r.severities, severity)
+	r.messages = append(r.messages, string(b))
+	return len(b), nil
+}
+
+func TestSeverityHandler(t *testing.T) {
+	var rec severityRecorder
+	logger := slog.New(server.NewSeverityHandler(&rec, &slog.HandlerOptions{Level: slog.LevelDebug})).With("kind", "test")
+	logger.Debug("debug")
+	logger.Info("info")
+	logger.Warn("warn")
+	logger.Error("error")
+	logger.Log(context.Background(), slog.LevelError+4, "critical")
+
+	expected := []int{server.SeverityDebug, server.SeverityInfo, server.SeverityWarning, server.SeverityError, server.SeverityError}
+	if !slices.Equal(rec.severities, expected) {
+		t.Errorf("incorrect severities: expected=%v, got=%v", expected, rec.severities)
+	}
+	for _, msg := range rec.messages {
+		if !strings.Contains(msg, "kind=test") {
+			t.Errorf("incorrect message: expected to contain %s, got=%s", "kind=test", msg)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal
+
+import (
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// ErrorDocuments holds the pages served in place of error responses by the ErrorPages middleware.
+//
+// Documents are HTML files in a directory named after their status code, such as 404.html, or
+// after their class, such as 5xx.html, to cover every status in the class without its own page.
+// Pages for a particular site are placed in a subdirectory named after its host, such as
+// example.com/404.html, and are preferred to those for every site.
+//
+// Pages are read into memory when the ErrorDocuments are created, and again by Reload, so that
+// errors are answered without reading from disk.
+type ErrorDocuments struct {
+	root  *os.Root
+	pages atomic.Pointer[map[string][]byte]
+}
+
+// NewErrorDocuments creates ErrorDocuments serving the pages in dir. Close must be called
+// once they are no longer needed.
+func NewErrorDocuments(dir string) (*ErrorDocuments, error) {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	d := &ErrorDocuments{root: root}
+	if err := d.Reload(); err != nil {
+		root.Close()
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// Reload reads the pages from the directory again, replacing those served. The pages served
+// are left unchanged if they cannot be read.
+func (d *ErrorDocuments) Reload() error {
+	fsys := d.root.FS()
+	pages := make(map[string][]byte)
+	var load func(dir string, depth int) error
+	load = func(dir string, depth int) error {
+		entries, err := fs.ReadDir(fsys, dir)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			name := path.Join(dir, e.Name())
+			// Follow symbolic links, such as one naming a site after another, as long as they
+			// stay within the directory.
+			fi, err := fs.Stat(fsys, name)
+			if err != nil {
+				continue
+			}
+			switch {
+			case fi.IsDir() && depth == 0:
+				// Pages for a particular site.
+				if err := load(name, 1); err != nil {
+					return err
+				}
+			case fi.Mode().IsRegular() && isErrorDocumentName(e.Name()):
+				page, err := fs.ReadFile(fsys, name)
+				if err != nil {
+					return err
+				}
+				pages[name] = page
+			}
+		}
+		return nil
+	}
+	if err := load(".", 0); err != nil {
+		return err
+	}
+	d.pages.Store(&pages)
+
+	return nil
+}
+
+// isErrorDocumentName reports whether name is that of a page for a status, such as 404.html,
+// or a class of status, such as 5xx.html.
+func isErrorDocumentName(name string) bool {
+	const digits = "0123456789"
+	code, ok := strings.CutSuffix(name, ".html")
+
+	return ok && len(code) == 3 && strings.Trim(code[:1], digits) == "" &&
+		(code[1:] == "xx" || strings.Trim(code[1:], digits) == "")
+}
+
+// Close closes the directory of pages.
+func (d *ErrorDocuments) Close() error {
+	return d.root.Close()
+}
+
+// Lookup returns the name and content of the page for status on host, if there is one.
+func (d *ErrorDocuments) Lookup(host string, status int) (string, []byte, bool) {
+	code := strconv.Itoa(status)
+	names := []string{code + ".html", code[:1] + "xx.html"}
+	var dirs []string
+	if host = strings.ToLower(host); host != "" && fs.ValidPath(host) && !strings.ContainsAny(host, `/\`) {
+		dirs = append(dirs, host)
+	}
+	dirs = append(dirs, ".")
+
+	pages := *d.pages.Load()
+	for _, dir := range dirs {
+		for _, name := range names {
+			name = path.Join(dir, name)
+			if page, ok := pages[name]; ok {
+				return name, page, true
+			}
+		}
+	}
+
+	return "", nil, false
+}
+
+// ErrorPages is a middleware generator function that replaces the body of error responses from
+// the wrapped handler, those with a status of 400 or above, with the page from the passed
+// ErrorDocuments for the status and host of the request, if there is one.
+//
+// The status of the response is left unchanged, as are headers set by outer middleware such as
+// SecureHeaders, so that they and the access log still apply to the error page.
+func ErrorPages(d *ErrorDocuments) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(&errorPageWriter{ResponseWriter: NewResponseWriter(w), d: d, r: r}, r)
+		})
+	}
+}
+
+// errorPageWriter writes an error document in place of the body of error responses, passing every
+// other response through untouched.
+type errorPageWriter struct {
+	*ResponseWriter
+	d *ErrorDocuments
+	r *http.Request
+
+	replaced bool
+}
+
+func (ew *errorPageWriter) WriteHeader(code int) {
+	if ew.Written() {
+		return
+	}
+	if code < http.StatusBadRequest {
+		ew.ResponseWriter.WriteHeader(code)
+		return
+	}
+
+	name, page, ok := ew.d.Lookup(requestHost(ew.r), code)
+	if !ok {
+		ew.ResponseWriter.WriteHeader(code)
+		return
+	}
+	ew.replaced = true
+	h := ew.Header()
+	ctype := mime.TypeByExtension(path.Ext(name))
+	if ctype == "" {
+		ctype = "text/html; charset=utf-8"
+	}
+	h.Set("Content-Type", ctype)
+	h.Set("Content-Length", strconv.Itoa(len(page)))
+	h.Set("Cache-Control", "no-store")
+	h.Del("Content-Encoding")
+	h.Del("ETag")
+	h.Del("Last-Modified")
+	ew.ResponseWriter.WriteHeader(code)
+	if ew.r.Method != http.MethodHead {
+		ew.ResponseWriter.Write(page)
+	}
+}
+
+func (ew *errorPageWriter) Write(b []byte) (int, error) {
+	if !ew.Written() {
+		ew.WriteHeader(http.StatusOK)
+	}
+	if ew.replaced {
+		// Discard the original body of the error response.
+		return len(b), nil
+	}
+
+	return ew.ResponseWriter.Write(b)
+}
+
+// ReadFrom passes the body of responses that are not replaced to the wrapped writer, so that
+// files may still be sent without copying them through user space.
+func (ew *errorPageWriter) ReadFrom(src io.Reader) (int64, error) {
+	if !ew.Written() {
+		ew.WriteHeader(http.StatusOK)
+	}
+	if ew.replaced {
+		return io.Copy(io.Discard, src)
+	}
+
+	return ew.ResponseWriter.ReadFrom(src)
+}
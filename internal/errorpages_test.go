@@ -0,0 +1,184 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal_test
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	server "github.com/admacleod/aws/internal"
+)
+
+func TestErrorPages(t *testing.T) {
+	dir := t.TempDir()
+	for name, contents := range map[string]string{
+		"404.html":             "<p>not found</p>",
+		"5xx.html":             "<p>server error</p>",
+		"example.com/404.html": "<p>example not found</p>",
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("could not create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+			t.Fatalf("could not create %s: %v", name, err)
+		}
+	}
+	docs, err := server.NewErrorDocuments(dir)
+	if err != nil {
+		t.Fatalf("could not open error documents: %v", err)
+	}
+	defer docs.Close()
+
+	var logs bytes.Buffer
+	handler := server.ChainMiddleware(
+		server.ErrorPages(docs),
+		server.SecureHeaders,
+		server.AccessLogger(&logs, server.CommonLogFormat),
+	)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, _ := strconv.Atoi(r.URL.Query().Get("status"))
+		if status == http.StatusOK {
+			w.Write([]byte("ok"))
+			return
+		}
+		http.Error(w, "original", status)
+	}))
+
+	for _, tt := range []struct {
+		name   string
+		method string
+		host   string
+		status int
+		body   string
+	}{
+		{"OK", http.MethodGet, "example.org", http.StatusOK, "ok"},
+		{"NotFound", http.MethodGet, "example.org", http.StatusNotFound, "<p>not found</p>"},
+		{"NotFoundForHost", http.MethodGet, "example.com", http.StatusNotFound, "<p>example not found</p>"},
+		{"NotFoundForHostWithPort", http.MethodGet, "EXAMPLE.com:443", http.StatusNotFound, "<p>example not found</p>"},
+		{"Class", http.MethodGet, "example.org", http.StatusBadGateway, "<p>server error</p>"},
+		{"ClassForHost", http.MethodGet, "example.com", http.StatusInternalServerError, "<p>server error</p>"},
+		{"NoDocument", http.MethodGet, "example.org", http.StatusForbidden, "original\n"},
+		{"Head", http.MethodHead, "example.org", http.StatusNotFound, ""},
+		{"TraversalHost", http.MethodGet, "..", http.StatusNotFound, "<p>not found</p>"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			logs.Reset()
+			req := httptest.NewRequest(tt.method, "/?status="+strconv.Itoa(tt.status), nil)
+			req.Host = tt.host
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Errorf("incorrect status: expected=%d, got=%d", tt.status, rec.Code)
+			}
+			if rec.Body.String() != tt.body {
+				t.Errorf("incorrect body: expected=%q, got=%q", tt.body, rec.Body)
+			}
+			if rec.Header().Get("X-Frame-Options") != "DENY" {
+				t.Error("secure headers missing from response")
+			}
+			if !strings.Contains(logs.String(), " "+strconv.Itoa(tt.status)+" ") {
+				t.Errorf("incorrect logged status: expected=%d, got=%q", tt.status, logs.String())
+			}
+			if strings.HasPrefix(tt.body, "<p>") && rec.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+				t.Errorf("incorrect Content-Type: expected=%q, got=%q", "text/html; charset=utf-8", rec.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestErrorPagesReadFrom(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "404.html"), []byte("<p>not found</p>"), 0o644); err != nil {
+		t.Fatalf("could not create page: %v", err)
+	}
+	docs, err := server.NewErrorDocuments(dir)
+	if err != nil {
+		t.Fatalf("could not open error documents: %v", err)
+	}
+	defer docs.Close()
+
+	for _, tt := range []struct {
+		status   int
+		body     string
+		readFrom bool
+	}{
+		{http.StatusOK, "file contents", true},
+		{http.StatusNotFound, "<p>not found</p>", false},
+	} {
+		t.Run(strconv.Itoa(tt.status), func(t *testing.T) {
+			handler := server.ErrorPages(docs)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if _, ok := w.(http.Flusher); !ok {
+					t.Error("response writer does not implement http.Flusher")
+				}
+				w.WriteHeader(tt.status)
+				// Hide WriteTo so that io.Copy uses ReadFrom, as it does for files.
+				io.Copy(w, struct{ io.Reader }{strings.NewReader("file contents")})
+			}))
+			rec := &readFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if rec.Body.String() != tt.body {
+				t.Errorf("incorrect body: expected=%q, got=%q", tt.body, rec.Body)
+			}
+			if rec.readFrom != tt.readFrom {
+				t.Errorf("incorrect use of ReadFrom: expected=%t, got=%t", tt.readFrom, rec.readFrom)
+			}
+		})
+	}
+}
+
+func TestErrorDocumentsReload(t *testing.T) {
+	dir := t.TempDir()
+	page := filepath.Join(dir, "404.html")
+	if err := os.WriteFile(page, []byte("<p>old</p>"), 0o644); err != nil {
+		t.Fatalf("could not create page: %v", err)
+	}
+	docs, err := server.NewErrorDocuments(dir)
+	if err != nil {
+		t.Fatalf("could not open error documents: %v", err)
+	}
+	defer docs.Close()
+
+	// Pages are served from memory until reloaded.
+	if err := os.WriteFile(page, []byte("<p>new</p>"), 0o644); err != nil {
+		t.Fatalf("could not update page: %v", err)
+	}
+	if _, got, _ := docs.Lookup("", http.StatusNotFound); string(got) != "<p>old</p>" {
+		t.Errorf("incorrect page before reload: expected=%q, got=%q", "<p>old</p>", got)
+	}
+	if err := docs.Reload(); err != nil {
+		t.Fatalf("could not reload: %v", err)
+	}
+	if _, got, _ := docs.Lookup("", http.StatusNotFound); string(got) != "<p>new</p>" {
+		t.Errorf("incorrect page after reload: expected=%q, got=%q", "<p>new</p>", got)
+	}
+
+	if err := os.Remove(page); err != nil {
+		t.Fatalf("could not remove page: %v", err)
+	}
+	if err := docs.Reload(); err != nil {
+		t.Fatalf("could not reload: %v", err)
+	}
+	if _, _, ok := docs.Lookup("", http.StatusNotFound); ok {
+		t.Error("removed page still served after reload")
+	}
+}
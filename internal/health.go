@@ -0,0 +1,272 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// HealthCheck reports whether some part of the server is ready to serve requests.
+type HealthCheck func(ctx context.Context) error
+
+// Health serves liveness and readiness probes for use by orchestrators and load balancers.
+//
+// Liveness only reports that the process is able to respond, while readiness runs every registered
+// HealthCheck and reports ready only if all of them pass.
+type Health struct {
+	timeout time.Duration
+
+	mu     sync.Mutex
+	names  []string
+	checks map[string]HealthCheck
+}
+
+// NewHealth creates a Health that allows readiness checks to take up to timeout in total.
+func NewHealth(timeout time.Duration) *Health {
+	return &Health{timeout: timeout, checks: make(map[string]HealthCheck)}
+}
+
+// AddCheck registers a named HealthCheck to be run by the readiness probe, replacing any
+// existing check with the same name.
+func (h *Health) AddCheck(name string, check HealthCheck) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.checks[name]; !ok {
+		h.names = append(h.names, name)
+	}
+	h.checks[name] = check
+}
+
+// Check runs every registered HealthCheck concurrently, returning the error of each failing
+// check by name.
+func (h *Health) Check(ctx context.Context) map[string]error {
+	h.mu.Lock()
+	names := append([]string(nil), h.names...)
+	checks := make([]HealthCheck, len(names))
+	for i, n := range names {
+		checks[i] = h.checks[n]
+	}
+	h.mu.Unlock()
+
+	if h.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.timeout)
+		defer cancel()
+	}
+	errs := make([]error, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Go(func() {
+			errs[i] = check(ctx)
+		})
+	}
+	wg.Wait()
+
+	failed := make(map[string]error)
+	for i, err := range errs {
+		if err != nil {
+			failed[names[i]] = err
+		}
+	}
+
+	return failed
+}
+
+// Liveness returns a http.Handler that always responds 200 OK, showing that the process is alive.
+func (h *Health) Liveness() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("ok\n"))
+	})
+}
+
+// Readiness returns a http.Handler that runs every registered HealthCheck, responding 200 OK if
+// they all pass or 503 Service Unavailable if any fail, with the result of each check as JSON:
+//
+//	{"status":"unavailable","checks":{"listeners":"ok","certificates":"no certificate for example.com"}}
+func (h *Health) Readiness() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		failed := h.Check(r.Context())
+
+		h.mu.Lock()
+		results := make(map[string]string, len(h.names))
+		for _, n := range h.names {
+			results[n] = "ok"
+		}
+		h.mu.Unlock()
+		status, code := "ok", http.StatusOK
+		for n, err := range failed {
+			results[n] = err.Error()
+			status, code = "unavailable", http.StatusServiceUnavailable
+		}
+
+		writeJSON(w, code, struct {
+			Status string            `json:"status"`
+			Checks map[string]string `json:"checks"`
+		}{status, results})
+	})
+}
+
+// writeJSON writes v as an indented JSON response with the passed status code.
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	w.Write(append(b, '\n'))
+}
+
+// ListeningCheck creates a HealthCheck that passes while all of the passed servers are listening.
+func ListeningCheck(servers ...*Server) HealthCheck {
+	return func(context.Context) error {
+		for _, srv := range servers {
+			if !srv.Listening() {
+				addr := srv.Addr
+				if addr == "" {
+					addr = "default address"
+				}
+				return fmt.Errorf("not listening on %s", addr)
+			}
+		}
+		return nil
+	}
+}
+
+// CertificateCheck creates a HealthCheck that passes while the autocert.Cache holds an unexpired
+// certificate for every one of the passed hosts.
+//
+// Hosts are looked up using the cache keys used by autocert.Manager for ECDSA certificates,
+// which it prefers for clients that support them.
+func CertificateCheck(cache autocert.Cache, hosts ...string) HealthCheck {
+	return certificateCheck(cache, hosts, false)
+}
+
+// CertificateExpiryCheck creates a HealthCheck that is as CertificateCheck, except that hosts
+// without a certificate pass. It only fails once a certificate has expired, meaning that it could
+// not be renewed, or cannot be read.
+//
+// autocert.Manager only obtains a certificate during the first TLS handshake for a host, which
+// never happens if traffic waits for the server to be ready, so this check suits servers whose
+// certificates are first obtained while serving.
+func CertificateExpiryCheck(cache autocert.Cache, hosts ...string) HealthCheck {
+	return certificateCheck(cache, hosts, true)
+}
+
+func certificateCheck(cache autocert.Cache, hosts []string, allowMissing bool) HealthCheck {
+	return func(ctx context.Context) error {
+		var errs []error
+		for _, host := range hosts {
+			notAfter, err := cachedCertificateExpiry(ctx, cache, host)
+			switch {
+			case errors.Is(err, autocert.ErrCacheMiss):
+				if !allowMissing {
+					errs = append(errs, fmt.Errorf("no certificate for %s", host))
+				}
+			case err != nil:
+				errs = append(errs, fmt.Errorf("certificate for %s: %w", host, err))
+			case time.Now().After(notAfter):
+				errs = append(errs, fmt.Errorf("certificate for %s expired at %s", host, notAfter.Format(time.RFC3339)))
+			}
+		}
+		return errors.Join(errs...)
+	}
+}
+
+// cachedCertificateExpiry returns the expiry time of the leaf certificate cached for host.
+func cachedCertificateExpiry(ctx context.Context, cache autocert.Cache, host string) (time.Time, error) {
+	data, err := cache.Get(ctx, host)
+	if err != nil {
+		return time.Time{}, err
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return time.Time{}, errors.New("no certificate in cache entry")
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		leaf, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return leaf.NotAfter, nil
+	}
+}
+
+// DirCheck creates a HealthCheck that passes while the directory at path can be read.
+func DirCheck(path string) HealthCheck {
+	return func(context.Context) error {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err := f.Readdirnames(1); err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		return nil
+	}
+}
+
+// VersionHandler returns a http.Handler that describes the running build as JSON, using the
+// information embedded by the Go toolchain.
+func VersionHandler() http.Handler {
+	info := struct {
+		Path      string `json:"path,omitempty"`
+		Version   string `json:"version"`
+		GoVersion string `json:"go_version"`
+		Revision  string `json:"revision,omitempty"`
+		Time      string `json:"time,omitempty"`
+		Modified  bool   `json:"modified,omitempty"`
+	}{Version: "unknown"}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		info.Path = bi.Main.Path
+		info.Version = bi.Main.Version
+		info.GoVersion = bi.GoVersion
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				info.Revision = s.Value
+			case "vcs.time":
+				info.Time = s.Value
+			case "vcs.modified":
+				info.Modified = s.Value == "true"
+			}
+		}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, info)
+	})
+}
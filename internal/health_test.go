@@ -0,0 +1,170 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+
+	server "github.com/admacleod/aws/internal"
+)
+
+func TestHealthLiveness(t *testing.T) {
+	h := server.NewHealth(0)
+	h.AddCheck("failing", func(context.Context) error { return errors.New("broken") })
+
+	rec := httptest.NewRecorder()
+	h.Liveness().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("incorrect status: expected=%d, got=%d", http.StatusOK, rec.Code)
+	}
+}
+
+func TestHealthReadiness(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		checks   map[string]error
+		status   int
+		expected map[string]string
+	}{
+		{"NoChecks", nil, http.StatusOK, map[string]string{}},
+		{"Passing", map[string]error{"a": nil, "b": nil}, http.StatusOK, map[string]string{"a": "ok", "b": "ok"}},
+		{"Failing", map[string]error{"a": nil, "b": errors.New("broken")}, http.StatusServiceUnavailable, map[string]string{"a": "ok", "b": "broken"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := server.NewHealth(0)
+			for name, err := range tt.checks {
+				h.AddCheck(name, func(context.Context) error { return err })
+			}
+
+			rec := httptest.NewRecorder()
+			h.Readiness().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if rec.Code != tt.status {
+				t.Errorf("incorrect status: expected=%d, got=%d", tt.status, rec.Code)
+			}
+			var body struct {
+				Checks map[string]string `json:"checks"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("could not decode response: %v", err)
+			}
+			if len(body.Checks) != len(tt.expected) {
+				t.Errorf("incorrect checks: expected=%v, got=%v", tt.expected, body.Checks)
+			}
+			for name, result := range tt.expected {
+				if body.Checks[name] != result {
+					t.Errorf("incorrect result for %s: expected=%q, got=%q", name, result, body.Checks[name])
+				}
+			}
+		})
+	}
+}
+
+func TestHealthTimeout(t *testing.T) {
+	h := server.NewHealth(10 * time.Millisecond)
+	h.AddCheck("slow", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	failed := h.Check(context.Background())
+	if !errors.Is(failed["slow"], context.DeadlineExceeded) {
+		t.Errorf("incorrect error: expected=%v, got=%v", context.DeadlineExceeded, failed["slow"])
+	}
+}
+
+func TestListeningCheck(t *testing.T) {
+	addr := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	testSrv := server.New(server.Handle(http.NotFoundHandler()))
+	testSrv.Addr = addr
+	check := server.ListeningCheck(testSrv)
+
+	if err := check(context.Background()); err == nil {
+		t.Error("expected error before listening")
+	}
+	startServer(t, testSrv, addr, testSrv.ListenAndServe)
+	if err := check(context.Background()); err != nil {
+		t.Errorf("unexpected error while listening: %v", err)
+	}
+	testSrv.Shutdown(context.Background())
+	if err := check(context.Background()); err == nil {
+		t.Error("expected error after shutdown")
+	}
+}
+
+func TestCertificateCheck(t *testing.T) {
+	cache := autocert.DirCache(t.TempDir())
+	cacheCertificate(t, cache, "localhost")
+
+	if err := server.CertificateCheck(cache, "localhost")(context.Background()); err != nil {
+		t.Errorf("unexpected error for cached host: %v", err)
+	}
+	if err := server.CertificateCheck(cache, "localhost", "example.com")(context.Background()); err == nil {
+		t.Error("expected error for missing host")
+	}
+	cacheCertificateFrom(t, cache, "expired.example.com", time.Now().Add(-48*time.Hour))
+	if err := server.CertificateCheck(cache, "localhost", "expired.example.com")(context.Background()); err == nil {
+		t.Error("expected error for expired certificate")
+	}
+}
+
+func TestCertificateExpiryCheck(t *testing.T) {
+	cache := autocert.DirCache(t.TempDir())
+	cacheCertificate(t, cache, "localhost")
+	if err := server.CertificateExpiryCheck(cache, "localhost", "example.com")(context.Background()); err != nil {
+		t.Errorf("unexpected error for host without a certificate: %v", err)
+	}
+	cacheCertificateFrom(t, cache, "expired.example.com", time.Now().Add(-48*time.Hour))
+	if err := server.CertificateExpiryCheck(cache, "localhost", "expired.example.com")(context.Background()); err == nil {
+		t.Error("expected error for expired certificate")
+	}
+}
+
+func TestDirCheck(t *testing.T) {
+	dir := t.TempDir()
+	if err := server.DirCheck(dir)(context.Background()); err != nil {
+		t.Errorf("unexpected error for empty directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), nil, 0o644); err != nil {
+		t.Fatalf("could not create file: %v", err)
+	}
+	if err := server.DirCheck(dir)(context.Background()); err != nil {
+		t.Errorf("unexpected error for directory: %v", err)
+	}
+	if err := server.DirCheck(filepath.Join(dir, "missing"))(context.Background()); err == nil {
+		t.Error("expected error for missing directory")
+	}
+}
+
+func TestVersionHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	server.VersionHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/version", nil))
+	var body map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("could not decode response: %v", err)
+	}
+	if body["go_version"] == "" || body["version"] == "" {
+		t.Errorf("incomplete version information: got=%v", body)
+	}
+}
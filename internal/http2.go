@@ -0,0 +1,101 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal
+
+import (
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// HTTP2MaxConcurrentStreams creates a server.Option function that will limit the number of
+// concurrent HTTP/2 streams each client may have open at a time.
+func HTTP2MaxConcurrentStreams(n uint32) Option {
+	return func(srv *Server) {
+		srv.http2Server().MaxConcurrentStreams = n
+	}
+}
+
+// HTTP2MaxReadFrameSize creates a server.Option function that will set the largest HTTP/2 frame
+// the server is willing to read. Valid values are between 16KiB and 16MiB inclusive.
+func HTTP2MaxReadFrameSize(n uint32) Option {
+	return func(srv *Server) {
+		srv.http2Server().MaxReadFrameSize = n
+	}
+}
+
+// HTTP2IdleTimeout creates a server.Option function that will set how long an idle HTTP/2
+// connection is kept open before it is closed with a GOAWAY frame.
+//
+// If unset then the server IdleTimeout is used.
+func HTTP2IdleTimeout(timeout time.Duration) Option {
+	return func(srv *Server) {
+		srv.http2Server().IdleTimeout = timeout
+	}
+}
+
+// DisableHTTP2 creates a server.Option function that will prevent the server from negotiating
+// HTTP/2 with clients, over TLS or otherwise, so that only HTTP/1.1 is served.
+func DisableHTTP2() Option {
+	return func(srv *Server) {
+		p := srv.protocols()
+		p.SetHTTP2(false)
+		p.SetUnencryptedHTTP2(false)
+	}
+}
+
+// H2C creates a server.Option function that will allow clients to speak HTTP/2 with prior
+// knowledge over an unencrypted connection, alongside HTTP/1.1.
+//
+// This is only intended for serving behind a TLS-terminating proxy using ListenAndServe.
+func H2C() Option {
+	return func(srv *Server) {
+		srv.protocols().SetUnencryptedHTTP2(true)
+	}
+}
+
+func (srv *Server) http2Server() *http2.Server {
+	if srv.http2 == nil {
+		srv.http2 = &http2.Server{}
+	}
+
+	return srv.http2
+}
+
+func (srv *Server) protocols() *http.Protocols {
+	if srv.Protocols == nil {
+		srv.Protocols = &http.Protocols{}
+		srv.Protocols.SetHTTP1(true)
+		srv.Protocols.SetHTTP2(true)
+	}
+
+	return srv.Protocols
+}
+
+// configureHTTP2 applies any HTTP/2 settings to the underlying http.Server.
+// It must be called before the server begins serving.
+func (srv *Server) configureHTTP2() error {
+	srv.http2Once.Do(func() {
+		if srv.http2 == nil {
+			return
+		}
+		if p := srv.Protocols; p != nil && !p.HTTP2() && !p.UnencryptedHTTP2() {
+			return
+		}
+		srv.http2Err = http2.ConfigureServer(&srv.Server, srv.http2)
+	})
+
+	return srv.http2Err
+}
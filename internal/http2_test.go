@@ -0,0 +1,162 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal_test
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+
+	server "github.com/admacleod/aws/internal"
+)
+
+// startServer runs the passed listen function for testSrv in the background and waits until
+// addr is accepting connections.
+func startServer(t *testing.T, testSrv *server.Server, addr string, listen func() error) {
+	t.Helper()
+
+	if testSrv.ErrorLog == nil {
+		// Probing the server for readiness upsets TLS listeners.
+		testSrv.ErrorLog = log.New(io.Discard, "", 0)
+	}
+	e := make(chan error, 1)
+	go func() {
+		e <- listen()
+	}()
+	t.Cleanup(func() {
+		testSrv.Close()
+		if err := <-e; err != http.ErrServerClosed {
+			t.Errorf("unexpected server error: %v", err)
+		}
+	})
+
+	for i := 0; i < 50; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("server did not start listening on %s", addr)
+}
+
+func TestHTTP2Settings(t *testing.T) {
+	cert, pool := testCertificate(t)
+	addr := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+
+	testSrv := server.New(
+		server.TLS(&tls.Config{Certificates: []tls.Certificate{cert}}),
+		server.HTTP2MaxConcurrentStreams(42),
+		server.HTTP2MaxReadFrameSize(1<<20),
+		server.HTTP2IdleTimeout(time.Minute),
+	)
+	testSrv.Addr = addr
+	startServer(t, testSrv, addr, func() error { return testSrv.ListenAndServeTLS("", "") })
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: pool, NextProtos: []string{http2.NextProtoTLS}})
+	if err != nil {
+		t.Fatalf("could not dial server: %v", err)
+	}
+	defer conn.Close()
+
+	if got := conn.ConnectionState().NegotiatedProtocol; got != http2.NextProtoTLS {
+		t.Fatalf("incorrect negotiated protocol: expected=%s, got=%s", http2.NextProtoTLS, got)
+	}
+	if _, err := io.WriteString(conn, http2.ClientPreface); err != nil {
+		t.Fatalf("could not write client preface: %v", err)
+	}
+	framer := http2.NewFramer(conn, conn)
+	if err := framer.WriteSettings(); err != nil {
+		t.Fatalf("could not write settings: %v", err)
+	}
+	frame, err := framer.ReadFrame()
+	if err != nil {
+		t.Fatalf("could not read settings: %v", err)
+	}
+	settings, ok := frame.(*http2.SettingsFrame)
+	if !ok {
+		t.Fatalf("incorrect first frame: expected=SETTINGS, got=%v", frame.Header().Type)
+	}
+
+	for _, tt := range []struct {
+		id       http2.SettingID
+		expected uint32
+	}{
+		{http2.SettingMaxConcurrentStreams, 42},
+		{http2.SettingMaxFrameSize, 1 << 20},
+	} {
+		got, _ := settings.Value(tt.id)
+		if got != tt.expected {
+			t.Errorf("incorrect %v: expected=%d, got=%d", tt.id, tt.expected, got)
+		}
+	}
+}
+
+func TestDisableHTTP2(t *testing.T) {
+	cert, pool := testCertificate(t)
+	addr := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+
+	testSrv := server.New(
+		server.TLS(&tls.Config{Certificates: []tls.Certificate{cert}}),
+		server.DisableHTTP2(),
+	)
+	testSrv.Addr = addr
+	startServer(t, testSrv, addr, func() error { return testSrv.ListenAndServeTLS("", "") })
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: pool},
+		ForceAttemptHTTP2: true,
+	}}
+	res, err := client.Get(fmt.Sprintf("https://%s/", addr))
+	if err != nil {
+		t.Fatalf("could not make request: %v", err)
+	}
+	res.Body.Close()
+
+	if res.ProtoMajor != 1 {
+		t.Errorf("incorrect protocol: expected=HTTP/1.1, got=%s", res.Proto)
+	}
+}
+
+func TestH2C(t *testing.T) {
+	addr := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+
+	testSrv := server.New(
+		server.H2C(),
+		server.HTTP2MaxConcurrentStreams(42),
+	)
+	testSrv.Addr = addr
+	startServer(t, testSrv, addr, testSrv.ListenAndServe)
+
+	protocols := &http.Protocols{}
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+	res, err := client.Get(fmt.Sprintf("http://%s/", addr))
+	if err != nil {
+		t.Fatalf("could not make request: %v", err)
+	}
+	res.Body.Close()
+
+	if res.ProtoMajor != 2 {
+		t.Errorf("incorrect protocol: expected=HTTP/2.0, got=%s", res.Proto)
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// HTTP3 creates a server.Option function that will enable serving HTTP/3 over QUIC alongside
+// the TLS server when ListenAndServeTLS is called.
+//
+// The QUIC listener binds to the UDP port of the server Addr and shares the server Handler,
+// TLSConfig, IdleTimeout, MaxHeaderBytes, and any ErrorLog handler.
+// Responses served over TLS advertise the HTTP/3 endpoint to clients using the Alt-Svc header.
+func HTTP3() Option {
+	return func(srv *Server) {
+		srv.http3 = &http3.Server{}
+	}
+}
+
+// serveHTTP3 serves TLS connections from ln alongside HTTP/3 over QUIC.
+func (srv *Server) serveHTTP3(ln net.Listener, certFile, keyFile string) error {
+	tlsCfg := &tls.Config{}
+	if srv.TLSConfig != nil {
+		tlsCfg = srv.TLSConfig.Clone()
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			ln.Close()
+			return err
+		}
+		tlsCfg.Certificates = append(tlsCfg.Certificates, cert)
+	}
+
+	handler := srv.Handler
+	if a, ok := handler.(*altSvcHandler); ok {
+		// Installed by an earlier call, so advertise around the original handler only once.
+		handler = a.next
+	}
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+
+	h3 := srv.http3
+	h3.Addr = srv.Addr
+	h3.Handler = handler
+	h3.TLSConfig = tlsCfg
+	h3.IdleTimeout = srv.IdleTimeout
+	h3.MaxHeaderBytes = srv.MaxHeaderBytes
+	if h3.Logger == nil {
+		h3.Logger = srv.logger
+	}
+	srv.Handler = &altSvcHandler{h3: h3, next: handler}
+
+	e := make(chan error, 2)
+	go func() {
+		e <- h3.ListenAndServe()
+	}()
+	go func() {
+		e <- srv.Server.ServeTLS(ln, certFile, keyFile)
+	}()
+	err := <-e
+	if !srv.shutdown.Load() {
+		// One listener has failed on its own so take the other down with it.
+		h3.Close()
+		srv.Server.Close()
+	}
+	<-e
+
+	return err
+}
+
+// altSvcHandler is a http.Handler that advertises the HTTP/3 server to clients before passing
+// requests on to next.
+type altSvcHandler struct {
+	h3   *http3.Server
+	next http.Handler
+}
+
+func (a *altSvcHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// An error here only means that the QUIC listener is not yet up so there is
+	// nothing to advertise.
+	_ = a.h3.SetQUICHeaders(w.Header())
+	a.next.ServeHTTP(w, r)
+}
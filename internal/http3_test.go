@@ -0,0 +1,156 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+
+	server "github.com/admacleod/aws/internal"
+)
+
+// testCertificate generates a self-signed certificate for localhost along with
+// a pool that trusts it.
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("could not create certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("could not parse certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
+// freePort finds a port that is currently unused for both TCP and UDP on localhost.
+func freePort(t *testing.T) int {
+	t.Helper()
+
+	for i := 0; i < 10; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("could not listen on tcp: %v", err)
+		}
+		port := l.Addr().(*net.TCPAddr).Port
+		l.Close()
+		pc, err := net.ListenPacket("udp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			continue
+		}
+		pc.Close()
+		return port
+	}
+	t.Fatal("could not find a free port")
+	return 0
+}
+
+func TestHTTP3(t *testing.T) {
+	cert, pool := testCertificate(t)
+	port := freePort(t)
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	testBody := "test"
+
+	testSrv := server.New(
+		server.HTTP3(),
+		server.TLS(&tls.Config{Certificates: []tls.Certificate{cert}}),
+		server.Handle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, testBody)
+		})),
+	)
+	testSrv.Addr = addr
+
+	e := make(chan error, 1)
+	go func() {
+		e <- testSrv.ListenAndServeTLS("", "")
+	}()
+	defer func() {
+		testSrv.Close()
+		if err := <-e; err != http.ErrServerClosed {
+			t.Errorf("unexpected server error: %v", err)
+		}
+	}()
+
+	tlsClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	h3Client := &http.Client{Transport: &http3.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	url := fmt.Sprintf("https://%s/", addr)
+
+	var res *http.Response
+	var err error
+	for i := 0; i < 50; i++ {
+		res, err = tlsClient.Get(url)
+		if err == nil && res.Header.Get("Alt-Svc") != "" {
+			break
+		}
+		if err == nil {
+			res.Body.Close()
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("could not make TLS request: %v", err)
+	}
+	res.Body.Close()
+
+	expected := fmt.Sprintf(`h3=":%d"; ma=2592000`, port)
+	if got := res.Header.Get("Alt-Svc"); got != expected {
+		t.Errorf("incorrect Alt-Svc header: expected=%s, got=%s", expected, got)
+	}
+
+	res, err = h3Client.Get(url)
+	if err != nil {
+		t.Fatalf("could not make HTTP/3 request: %v", err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+
+	if res.ProtoMajor != 3 {
+		t.Errorf("incorrect protocol: expected=HTTP/3.0, got=%s", res.Proto)
+	}
+	if string(body) != testBody {
+		t.Errorf("returned body is incorrect: expected=%s, got=%s", testBody, body)
+	}
+}
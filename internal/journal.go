@@ -0,0 +1,185 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// JournalWriter is an io.Writer that sends each write as an entry to the systemd journal using
+// its native protocol, described at https://systemd.io/JOURNAL_NATIVE_PROTOCOL/.
+//
+// A JournalWriter is a FieldWriter, sending the fields of access log entries as journal fields
+// with upper case names, for example STATUS and DURATION_MS, and a SeverityWriter.
+// The connection is redialled once if a write fails, such as when the journal has restarted.
+// Entries too large for a single datagram are rejected by the socket rather than being passed
+// through a memfd.
+type JournalWriter struct {
+	socket     string
+	identifier string
+	priority   int
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// JournalOption is a function that will apply some option to a JournalWriter.
+type JournalOption func(*JournalWriter)
+
+// JournalIdentifier creates a JournalOption that will set the SYSLOG_IDENTIFIER of entries.
+// The default is the name of the running program.
+func JournalIdentifier(name string) JournalOption {
+	return func(w *JournalWriter) {
+		w.identifier = name
+	}
+}
+
+// JournalPriority creates a JournalOption that will set the PRIORITY of entries to the passed
+// syslog severity. The default is SeverityInfo.
+func JournalPriority(severity int) JournalOption {
+	return func(w *JournalWriter) {
+		w.priority = severity
+	}
+}
+
+// JournalSocket creates a JournalOption that will send entries to the socket at the passed path
+// rather than /run/systemd/journal/socket.
+func JournalSocket(path string) JournalOption {
+	return func(w *JournalWriter) {
+		w.socket = path
+	}
+}
+
+// DialJournal connects to the systemd journal with the passed JournalOptions applied to it.
+func DialJournal(opts ...JournalOption) (*JournalWriter, error) {
+	w := &JournalWriter{
+		socket:     "/run/systemd/journal/socket",
+		identifier: filepath.Base(os.Args[0]),
+		priority:   SeverityInfo,
+	}
+	for _, o := range opts {
+		o(w)
+	}
+	if err := w.dial(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (w *JournalWriter) dial() error {
+	conn, err := net.Dial("unixgram", w.socket)
+	if err != nil {
+		return err
+	}
+	w.conn = conn
+
+	return nil
+}
+
+// Write sends b as the MESSAGE of a single journal entry, without any trailing newline.
+func (w *JournalWriter) Write(b []byte) (int, error) {
+	return w.WriteSeverity(w.priority, b)
+}
+
+// WriteSeverity is as Write, sending the entry with the passed severity as its PRIORITY.
+func (w *JournalWriter) WriteSeverity(severity int, b []byte) (int, error) {
+	if err := w.send(w.entry(severity, b, nil)); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// WriteFields sends line as the MESSAGE of a single journal entry, along with fields.
+func (w *JournalWriter) WriteFields(line []byte, fields []LogField) error {
+	return w.send(w.entry(w.priority, line, fields))
+}
+
+// Close closes the connection to the journal.
+func (w *JournalWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.conn.Close()
+}
+
+// send writes the entry to the connection, redialling once on failure.
+func (w *JournalWriter) send(entry []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	_, err := w.conn.Write(entry)
+	if err == nil {
+		return nil
+	}
+	w.conn.Close()
+	if err := w.dial(); err != nil {
+		return err
+	}
+	_, err = w.conn.Write(entry)
+
+	return err
+}
+
+// entry encodes a journal entry in the native protocol.
+func (w *JournalWriter) entry(priority int, msg []byte, fields []LogField) []byte {
+	b := make([]byte, 0, 128+len(msg))
+	b = appendJournalField(b, "MESSAGE", bytes.TrimRight(msg, "\n"))
+	b = appendJournalField(b, "PRIORITY", strconv.AppendInt(nil, int64(priority), 10))
+	b = appendJournalField(b, "SYSLOG_IDENTIFIER", []byte(w.identifier))
+	for _, f := range fields {
+		b = appendJournalField(b, journalFieldName(f.Key), appendFieldValue(nil, f.Value))
+	}
+
+	return b
+}
+
+// appendJournalField appends a single field, using the binary form for values containing newlines.
+func appendJournalField(b []byte, name string, value []byte) []byte {
+	b = append(b, name...)
+	if bytes.IndexByte(value, '\n') < 0 {
+		b = append(b, '=')
+		b = append(b, value...)
+		return append(b, '\n')
+	}
+	b = append(b, '\n')
+	b = binary.LittleEndian.AppendUint64(b, uint64(len(value)))
+	b = append(b, value...)
+
+	return append(b, '\n')
+}
+
+// journalFieldName converts key into a valid journal field name, which may only contain upper
+// case letters, digits, and underscores, and may not start with an underscore or digit.
+func journalFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+
+	return strings.TrimLeft(name, "_0123456789")
+}
@@ -0,0 +1,117 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal_test
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	server "github.com/admacleod/aws/internal"
+)
+
+func TestJournalWriter(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "journal.sock")
+	pc, err := net.ListenPacket("unixgram", socket)
+	if err != nil {
+		t.Skipf("unix datagram sockets unavailable: %v", err)
+	}
+	defer pc.Close()
+
+	w, err := server.DialJournal(
+		server.JournalSocket(socket),
+		server.JournalIdentifier("aws-test"),
+		server.JournalPriority(server.SeverityWarning),
+	)
+	if err != nil {
+		t.Fatalf("could not dial journal: %v", err)
+	}
+	defer w.Close()
+
+	read := func() string {
+		t.Helper()
+		buf := make([]byte, 2048)
+		pc.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("could not read entry: %v", err)
+		}
+		return string(buf[:n])
+	}
+
+	io.WriteString(w, "single line\n")
+	expected := "MESSAGE=single line\nPRIORITY=4\nSYSLOG_IDENTIFIER=aws-test\n"
+	if got := read(); got != expected {
+		t.Errorf("incorrect entry: expected=%q, got=%q", expected, got)
+	}
+
+	io.WriteString(w, "two\nlines\n")
+	size := binary.LittleEndian.AppendUint64(nil, uint64(len("two\nlines")))
+	expected = "MESSAGE\n" + string(size) + "two\nlines\nPRIORITY=4\nSYSLOG_IDENTIFIER=aws-test\n"
+	if got := read(); got != expected {
+		t.Errorf("incorrect multi-line entry: expected=%q, got=%q", expected, got)
+	}
+
+	err = w.WriteFields([]byte("GET /\n"), []server.LogField{
+		{Key: "duration_ms", Value: 1.5},
+		{Key: "user-agent", Value: "test"},
+		{Key: "_private", Value: 1},
+	})
+	if err != nil {
+		t.Fatalf("could not write fields: %v", err)
+	}
+	expected = "MESSAGE=GET /\nPRIORITY=4\nSYSLOG_IDENTIFIER=aws-test\nDURATION_MS=1.5\nUSER_AGENT=test\nPRIVATE=1\n"
+	if got := read(); got != expected {
+		t.Errorf("incorrect entry with fields: expected=%q, got=%q", expected, got)
+	}
+}
+
+func TestJournalWriterRedial(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "journal.sock")
+	pc, err := net.ListenPacket("unixgram", socket)
+	if err != nil {
+		t.Skipf("unix datagram sockets unavailable: %v", err)
+	}
+	w, err := server.DialJournal(server.JournalSocket(socket), server.JournalIdentifier("aws-test"))
+	if err != nil {
+		t.Fatalf("could not dial journal: %v", err)
+	}
+	defer w.Close()
+
+	// Restart the journal, replacing its socket.
+	pc.Close()
+	os.Remove(socket)
+	if pc, err = net.ListenPacket("unixgram", socket); err != nil {
+		t.Fatalf("could not listen again: %v", err)
+	}
+	defer pc.Close()
+
+	if _, err := w.WriteSeverity(server.SeverityError, []byte("after restart\n")); err != nil {
+		t.Fatalf("could not write after restart: %v", err)
+	}
+	buf := make([]byte, 2048)
+	pc.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("could not read entry: %v", err)
+	}
+	expected := "MESSAGE=after restart\nPRIORITY=3\nSYSLOG_IDENTIFIER=aws-test\n"
+	if got := string(buf[:n]); got != expected {
+		t.Errorf("incorrect entry: expected=%q, got=%q", expected, got)
+	}
+}
@@ -0,0 +1,338 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ListingMarker is the name of the file that enables listing of the directory containing it
+// when listings are not enabled for the whole site.
+const ListingMarker = ".listing"
+
+// DefaultListingStylesheet is the URL path at which a Static handler serves the stylesheet of its
+// default listing template, unless StaticListingStylesheet is applied.
+const DefaultListingStylesheet = "/.listing.css"
+
+// DefaultListingTemplate is the template used to render directory listings as HTML unless
+// StaticListingTemplate is applied. It is executed with a Listing.
+//
+// The template uses no inline styles or scripts so that it is allowed by the CSP of SecureHeaders.
+var DefaultListingTemplate = template.Must(template.New("listing").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Index of {{.Path}}</title>
+{{with .Stylesheet}}<link rel="stylesheet" href="{{.}}">
+{{end}}</head>
+<body>
+<h1>Index of {{.Path}}</h1>
+<table>
+<thead>
+<tr>
+<th class="name"><a href="{{.SortURL "name"}}">Name</a></th>
+<th class="size"><a href="{{.SortURL "size"}}">Size</a></th>
+<th class="modified"><a href="{{.SortURL "modified"}}">Modified</a></th>
+</tr>
+</thead>
+<tbody>
+{{if .Parent}}<tr class="parent"><td class="name"><a href="../">../</a></td><td class="size"></td><td class="modified"></td></tr>
+{{end}}{{range .Entries}}<tr{{if .Dir}} class="dir"{{end}}>
+<td class="name"><a href="{{.URL}}">{{.Name}}{{if .Dir}}/{{end}}</a></td>
+<td class="size">{{if not .Dir}}{{.HumanSize}}{{end}}</td>
+<td class="modified"><time datetime="{{.ModTime.UTC.Format "2006-01-02T15:04:05Z"}}">{{.ModTime.UTC.Format "2006-01-02 15:04"}}</time></td>
+</tr>
+{{end}}</tbody>
+</table>
+</body>
+</html>
+`))
+
+// defaultListingCSS is the stylesheet of DefaultListingTemplate.
+const defaultListingCSS = `body {
+	font-family: system-ui, sans-serif;
+	margin: 2em auto;
+	max-width: 60em;
+	padding: 0 1em;
+	color: #222;
+	background: #fff;
+}
+h1 {
+	font-size: 1.4em;
+	font-weight: normal;
+	overflow-wrap: anywhere;
+}
+table {
+	border-collapse: collapse;
+	width: 100%;
+}
+th, td {
+	padding: 0.3em 0.6em;
+	text-align: left;
+	border-bottom: 1px solid #ddd;
+}
+th a {
+	color: inherit;
+}
+td.name {
+	overflow-wrap: anywhere;
+}
+.size, .modified {
+	white-space: nowrap;
+	font-variant-numeric: tabular-nums;
+}
+.size {
+	text-align: right;
+}
+tr.dir td.name, tr.parent td.name {
+	font-weight: bold;
+}
+a {
+	color: #0645ad;
+	text-decoration: none;
+}
+a:hover {
+	text-decoration: underline;
+}
+@media (prefers-color-scheme: dark) {
+	body {
+		color: #ddd;
+		background: #111;
+	}
+	th, td {
+		border-color: #333;
+	}
+	a {
+		color: #8ab4f8;
+	}
+}
+`
+
+// Listing describes the contents of a directory for rendering by a listing template.
+type Listing struct {
+	// Path is the URL path of the directory.
+	Path string
+	// Parent reports whether the directory has a parent that can be linked to.
+	Parent bool
+	// Stylesheet is the URL of the stylesheet of the listing, if there is one.
+	Stylesheet string
+	// Sort is the field that the entries are sorted by: name, size, or modified.
+	Sort string
+	// Descending reports whether the entries are sorted in descending order.
+	Descending bool
+	// Entries are the entries of the directory, directories first when sorted by name.
+	Entries []ListingEntry
+}
+
+// SortURL returns the relative URL of the listing sorted by field, in descending order if it is
+// already sorted by field in ascending order.
+func (l Listing) SortURL(field string) string {
+	order := "asc"
+	if l.Sort == field && !l.Descending {
+		order = "desc"
+	}
+
+	return "?" + url.Values{"sort": {field}, "order": {order}}.Encode()
+}
+
+// ListingEntry describes a single entry of a directory listing.
+type ListingEntry struct {
+	Name    string    `json:"name"`
+	URL     string    `json:"url"`
+	Dir     bool      `json:"dir"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modified"`
+}
+
+// HumanSize returns the size of the entry in bytes, or in KiB, MiB, GiB, or TiB with one decimal
+// place for larger entries.
+func (e ListingEntry) HumanSize() string {
+	if e.Size < 1024 {
+		return strconv.FormatInt(e.Size, 10) + " B"
+	}
+	size := float64(e.Size)
+	unit := 0
+	for size >= 1024 && unit < 4 {
+		size /= 1024
+		unit++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", size, "KMGT"[unit-1])
+}
+
+// sortListing sorts the entries of l by the field and order in the query of the request.
+func sortListing(l *Listing, query url.Values) {
+	l.Sort = query.Get("sort")
+	if l.Sort != "size" && l.Sort != "modified" {
+		l.Sort = "name"
+	}
+	l.Descending = query.Get("order") == "desc"
+
+	slices.SortStableFunc(l.Entries, func(a, b ListingEntry) int {
+		var c int
+		switch l.Sort {
+		case "size":
+			c = cmp.Compare(a.Size, b.Size)
+		case "modified":
+			c = a.ModTime.Compare(b.ModTime)
+		default:
+			if a.Dir != b.Dir {
+				// Directories are kept first whichever order names are sorted in.
+				if a.Dir {
+					return -1
+				}
+				return 1
+			}
+		}
+		if c == 0 {
+			c = strings.Compare(a.Name, b.Name)
+		}
+		if l.Descending {
+			return -c
+		}
+		return c
+	})
+}
+
+// prefersJSON reports whether the Accept header of the request prefers application/json to HTML.
+func prefersJSON(r *http.Request) bool {
+	quality := func(mediaType string) float64 {
+		best, specificity := 0.0, -1
+		major, _, _ := strings.Cut(mediaType, "/")
+		for _, value := range r.Header.Values("Accept") {
+			for _, element := range strings.Split(value, ",") {
+				accepted, params, _ := strings.Cut(element, ";")
+				accepted = strings.ToLower(strings.TrimSpace(accepted))
+				s := -1
+				switch accepted {
+				case mediaType:
+					s = 2
+				case major + "/*":
+					s = 1
+				case "*/*":
+					s = 0
+				}
+				if s < specificity || s < 0 {
+					continue
+				}
+				q := 1.0
+				for _, param := range strings.Split(params, ";") {
+					key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+					if strings.EqualFold(key, "q") {
+						if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+							q = parsed
+						}
+					}
+				}
+				best, specificity = q, s
+			}
+		}
+		return best
+	}
+	json := quality("application/json")
+
+	return json > 0 && json > quality("text/html")
+}
+
+// serveListing lists the entries of the directory at name as HTML, or as JSON if the client
+// prefers it, leaving out hidden entries unless they are allowed and entries that cannot be
+// served, such as symbolic links leading out of the directory.
+func (s *Static) serveListing(w http.ResponseWriter, r *http.Request, name string) {
+	f, err := s.root.Open(name)
+	if err != nil {
+		s.serveError(w, r, errorStatus(err))
+		return
+	}
+	dirEntries, err := f.ReadDir(-1)
+	f.Close()
+	if err != nil {
+		s.serveError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	l := Listing{
+		Path:       r.URL.Path,
+		Parent:     name != ".",
+		Stylesheet: s.stylesheet,
+	}
+	for _, de := range dirEntries {
+		if de.Name() == ListingMarker || (!s.allowHidden && strings.HasPrefix(de.Name(), ".")) {
+			continue
+		}
+		if de.Type()&fs.ModeSymlink != 0 && s.denySymlinks {
+			continue
+		}
+		fi, err := s.root.Stat(path.Join(name, de.Name()))
+		if err != nil || (!fi.IsDir() && !fi.Mode().IsRegular()) {
+			continue
+		}
+		e := ListingEntry{Name: de.Name(), Dir: fi.IsDir(), ModTime: fi.ModTime()}
+		href := url.URL{Path: e.Name}
+		e.URL = href.String()
+		if e.Dir {
+			e.URL += "/"
+		} else {
+			e.Size = fi.Size()
+		}
+		l.Entries = append(l.Entries, e)
+	}
+	sortListing(&l, r.URL.Query())
+
+	w.Header().Add("Vary", "Accept")
+	if prefersJSON(r) {
+		if l.Entries == nil {
+			l.Entries = []ListingEntry{}
+		}
+		b, err := json.Marshal(struct {
+			Path    string         `json:"path"`
+			Entries []ListingEntry `json:"entries"`
+		}{l.Path, l.Entries})
+		if err != nil {
+			s.serveError(w, r, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodHead {
+			w.Write(append(b, '\n'))
+		}
+		return
+	}
+	var b strings.Builder
+	if err := s.listingTemplate.Execute(&b, l); err != nil {
+		s.serveError(w, r, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if r.Method != http.MethodHead {
+		w.Write([]byte(b.String()))
+	}
+}
+
+// serveListingStylesheet serves the stylesheet of DefaultListingTemplate.
+func serveListingStylesheet(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/css; charset=utf-8")
+	http.ServeContent(w, r, "listing.css", time.Time{}, strings.NewReader(defaultListingCSS))
+}
@@ -0,0 +1,273 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal_test
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	server "github.com/admacleod/aws/internal"
+)
+
+// listingTree creates a directory to list holding files of differing sizes and ages.
+func listingTree(t *testing.T) string {
+	t.Helper()
+
+	root := staticTree(t)
+	now := time.Now()
+	for name, size := range map[string]int{"big.bin": 3 << 20, "old.txt": 10, "sub/mid.txt": 2048} {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.WriteFile(path, make([]byte, size), 0o644); err != nil {
+			t.Fatalf("could not create %s: %v", name, err)
+		}
+	}
+	if err := os.Chtimes(filepath.Join(root, "old.txt"), now, now.Add(-24*time.Hour)); err != nil {
+		t.Fatalf("could not change modification time: %v", err)
+	}
+
+	return root
+}
+
+// listingNames returns the names of the entries of a JSON listing of path.
+func listingNames(t *testing.T, h http.Handler, path string) []string {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("Accept", "application/json")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("incorrect status: expected=%d, got=%d", http.StatusOK, rec.Code)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("incorrect Content-Type: expected=%q, got=%q", "application/json", got)
+	}
+	var listing struct {
+		Entries []server.ListingEntry `json:"entries"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &listing); err != nil {
+		t.Fatalf("could not decode listing: %v", err)
+	}
+	var names []string
+	for _, e := range listing.Entries {
+		names = append(names, e.Name)
+	}
+
+	return names
+}
+
+func TestListingJSON(t *testing.T) {
+	static, err := server.NewStatic(listingTree(t), server.StaticListings(), server.StaticIndex("default.htm"))
+	if err != nil {
+		t.Fatalf("could not create handler: %v", err)
+	}
+	defer static.Close()
+
+	for _, tt := range []struct {
+		name     string
+		path     string
+		expected []string
+	}{
+		// Directories come first when sorted by name, and symlinks leading out of the root are omitted.
+		{"Name", "/", []string{"link-sub", "sub", "404.html", "big.bin", "file.txt", "home.htm", "index.html", "link-in", "old.txt"}},
+		{"NameDescending", "/sub/?order=desc", []string{"dir", "mid.txt", "a.txt", "<script>.txt"}},
+		{"Size", "/sub/?sort=size", []string{"dir", "a.txt", "<script>.txt", "mid.txt"}},
+		{"SizeDescending", "/sub/?sort=size&order=desc", []string{"mid.txt", "<script>.txt", "a.txt", "dir"}},
+		{"UnknownSort", "/sub/?sort=owner", []string{"dir", "<script>.txt", "a.txt", "mid.txt"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if names := listingNames(t, static, tt.path); !slices.Equal(names, tt.expected) {
+				t.Errorf("incorrect entries: expected=%q, got=%q", tt.expected, names)
+			}
+		})
+	}
+
+	t.Run("Modified", func(t *testing.T) {
+		names := listingNames(t, static, "/?sort=modified")
+		if len(names) == 0 || names[0] != "old.txt" {
+			t.Errorf("incorrect oldest entry: expected=%q, got=%q", "old.txt", names)
+		}
+	})
+}
+
+func TestListingNegotiation(t *testing.T) {
+	static, err := server.NewStatic(listingTree(t), server.StaticListings())
+	if err != nil {
+		t.Fatalf("could not create handler: %v", err)
+	}
+	defer static.Close()
+
+	for _, tt := range []struct {
+		accept   string
+		expected string
+	}{
+		{"", "text/html; charset=utf-8"},
+		{"*/*", "text/html; charset=utf-8"},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", "text/html; charset=utf-8"},
+		{"application/json", "application/json"},
+		{"application/json, text/html;q=0.5", "application/json"},
+		{"application/*", "application/json"},
+		{"text/html;q=0.5, application/json;q=0.4", "text/html; charset=utf-8"},
+		{"application/json;q=0", "text/html; charset=utf-8"},
+	} {
+		t.Run(tt.accept, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/sub/", nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			rec := httptest.NewRecorder()
+			static.ServeHTTP(rec, req)
+			if got := rec.Header().Get("Content-Type"); got != tt.expected {
+				t.Errorf("incorrect Content-Type: expected=%q, got=%q", tt.expected, got)
+			}
+			if got := rec.Header().Get("Vary"); got != "Accept" {
+				t.Errorf("incorrect Vary: expected=%q, got=%q", "Accept", got)
+			}
+		})
+	}
+}
+
+func TestListingHTML(t *testing.T) {
+	static, err := server.NewStatic(listingTree(t), server.StaticListings())
+	if err != nil {
+		t.Fatalf("could not create handler: %v", err)
+	}
+	defer static.Close()
+
+	rec := httptest.NewRecorder()
+	static.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/sub/?sort=size", nil))
+	body := rec.Body.String()
+	for _, expected := range []string{
+		`<link rel="stylesheet" href="/.listing.css">`,
+		`<a href="../">../</a>`,
+		`<a href="?order=desc&amp;sort=size">Size</a>`,
+		`<a href="?order=asc&amp;sort=name">Name</a>`,
+		"2.0 KiB",
+		"1 B",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("listing missing %s: got=%s", expected, body)
+		}
+	}
+	if strings.Contains(body, "style=") || strings.Contains(body, "<style") || strings.Contains(body, "<script") {
+		t.Errorf("listing contains inline styles or scripts: got=%s", body)
+	}
+
+	rec = httptest.NewRecorder()
+	static.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/.listing.css", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "text/css; charset=utf-8" {
+		t.Errorf("incorrect stylesheet response: status=%d, Content-Type=%q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+
+	rec = httptest.NewRecorder()
+	static.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if strings.Contains(rec.Body.String(), `href="../"`) {
+		t.Errorf("root listing links to parent: got=%s", rec.Body)
+	}
+}
+
+func TestListingCustom(t *testing.T) {
+	tmpl := template.Must(template.New("custom").Parse(`{{.Stylesheet}}{{range .Entries}} {{.Name}}={{.HumanSize}}{{end}}`))
+	static, err := server.NewStatic(listingTree(t),
+		server.StaticListings(),
+		server.StaticListingTemplate(tmpl),
+		server.StaticListingStylesheet("https://example.com/listing.css"),
+	)
+	if err != nil {
+		t.Fatalf("could not create handler: %v", err)
+	}
+	defer static.Close()
+
+	rec := httptest.NewRecorder()
+	static.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/sub/?sort=size", nil))
+	if expected := "https://example.com/listing.css dir=0 B a.txt=1 B &lt;script&gt;.txt=7 B mid.txt=2.0 KiB"; rec.Body.String() != expected {
+		t.Errorf("incorrect listing: expected=%q, got=%q", expected, rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	static.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/.listing.css", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("incorrect stylesheet status: expected=%d, got=%d", http.StatusNotFound, rec.Code)
+	}
+}
+
+func TestListingMarker(t *testing.T) {
+	root := listingTree(t)
+	if err := os.WriteFile(filepath.Join(root, "sub", server.ListingMarker), nil, 0o644); err != nil {
+		t.Fatalf("could not create marker: %v", err)
+	}
+	static, err := server.NewStatic(root)
+	if err != nil {
+		t.Fatalf("could not create handler: %v", err)
+	}
+	defer static.Close()
+
+	for _, tt := range []struct {
+		path   string
+		status int
+	}{
+		{"/sub/", http.StatusOK},
+		{"/link-sub/", http.StatusOK},
+		{"/sub/" + server.ListingMarker, http.StatusNotFound},
+		{"/.git/", http.StatusNotFound},
+	} {
+		t.Run(tt.path, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			static.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if rec.Code != tt.status {
+				t.Errorf("incorrect status: expected=%d, got=%d", tt.status, rec.Code)
+			}
+			if strings.Contains(rec.Body.String(), `href="`+server.ListingMarker+`"`) {
+				t.Errorf("listing contains marker: got=%s", rec.Body)
+			}
+		})
+	}
+	if names := listingNames(t, static, "/sub/"); slices.Contains(names, server.ListingMarker) {
+		t.Errorf("listing contains marker: got=%q", names)
+	}
+
+	rec := httptest.NewRecorder()
+	static.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "index" {
+		t.Errorf("incorrect root response: status=%d, body=%q", rec.Code, rec.Body)
+	}
+}
+
+func TestListingEntryHumanSize(t *testing.T) {
+	for _, tt := range []struct {
+		size     int64
+		expected string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{5 << 20, "5.0 MiB"},
+		{3 << 30, "3.0 GiB"},
+		{2 << 40, "2.0 TiB"},
+		{2048 << 40, "2048.0 TiB"},
+	} {
+		if got := (server.ListingEntry{Size: tt.size}).HumanSize(); got != tt.expected {
+			t.Errorf("incorrect size of %d: expected=%q, got=%q", tt.size, tt.expected, got)
+		}
+	}
+}
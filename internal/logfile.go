@@ -0,0 +1,309 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat is the layout of the timestamp appended to the name of rotated log files.
+// It sorts lexically in time order.
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// LogFile is an io.Writer that appends to a file on disk, rotating it once it grows too large
+// or too old and removing old rotated files.
+//
+// Rotated files are renamed with the UTC time of rotation appended, for example
+// access.log.2006-01-02T15-04-05.000, and are optionally compressed with gzip.
+//
+// Reopen may be used instead of, or as well as, rotation to work with external tools such as
+// logrotate that move the file aside and then signal the server.
+// A LogFile is safe for concurrent use and each call to Write is written to a single file.
+type LogFile struct {
+	path       string
+	maxSize    int64
+	every      time.Duration
+	maxBackups int
+	maxAge     time.Duration
+	compress   bool
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+
+	// mill serialises compression and removal of rotated files, which happens in the background.
+	mill sync.Mutex
+	wg   sync.WaitGroup
+}
+
+// LogFileOption is a function that will apply some option to a LogFile.
+type LogFileOption func(*LogFile)
+
+// RotateSize creates a LogFileOption that will rotate the file before a write would take it
+// over the passed number of bytes.
+func RotateSize(bytes int64) LogFileOption {
+	return func(f *LogFile) {
+		f.maxSize = bytes
+	}
+}
+
+// RotateEvery creates a LogFileOption that will rotate the file on the first write after it
+// has been open for the passed time.Duration.
+func RotateEvery(interval time.Duration) LogFileOption {
+	return func(f *LogFile) {
+		f.every = interval
+	}
+}
+
+// MaxBackups creates a LogFileOption that will keep at most the passed number of rotated files,
+// removing the oldest first.
+func MaxBackups(n int) LogFileOption {
+	return func(f *LogFile) {
+		f.maxBackups = n
+	}
+}
+
+// MaxBackupAge creates a LogFileOption that will remove rotated files once they are older than
+// the passed time.Duration.
+func MaxBackupAge(age time.Duration) LogFileOption {
+	return func(f *LogFile) {
+		f.maxAge = age
+	}
+}
+
+// CompressBackups creates a LogFileOption that will compress rotated files with gzip.
+func CompressBackups() LogFileOption {
+	return func(f *LogFile) {
+		f.compress = true
+	}
+}
+
+// OpenLogFile opens the file at path for appending, creating it if necessary, with the passed
+// LogFileOptions applied to it.
+// Without options the file is never rotated.
+func OpenLogFile(path string, opts ...LogFileOption) (*LogFile, error) {
+	f := &LogFile{path: path}
+	for _, o := range opts {
+		o(f)
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// open opens the file at the path of the LogFile, replacing any currently open file.
+// The current file is left in place if the new one cannot be opened.
+func (f *LogFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	var closeErr error
+	if f.file != nil {
+		closeErr = f.file.Close()
+	}
+	f.file = file
+	f.size = info.Size()
+	f.opened = time.Now()
+
+	return closeErr
+}
+
+// Write writes b to the file, rotating it first if required.
+func (f *LogFile) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	if f.dueRotation(len(b)) {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+
+	return n, err
+}
+
+// dueRotation reports whether the file should be rotated before writing n bytes.
+func (f *LogFile) dueRotation(n int) bool {
+	if f.size == 0 {
+		return false
+	}
+	if f.maxSize > 0 && f.size+int64(n) > f.maxSize {
+		return true
+	}
+
+	return f.every > 0 && time.Since(f.opened) >= f.every
+}
+
+// Rotate moves the current file aside and opens a new one in its place.
+func (f *LogFile) Rotate() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return os.ErrClosed
+	}
+
+	return f.rotate()
+}
+
+func (f *LogFile) rotate() error {
+	backup := f.backupName(time.Now().UTC())
+	if err := os.Rename(f.path, backup); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		f.mill.Lock()
+		defer f.mill.Unlock()
+		if f.compress {
+			// A failure leaves the uncompressed file in place, which is still usable.
+			_ = compressFile(backup)
+		}
+		f.removeBackups()
+	}()
+
+	return nil
+}
+
+// backupName returns an unused name for a file rotated at the passed time, moving the time on
+// if several files are rotated within the same millisecond.
+func (f *LogFile) backupName(t time.Time) string {
+	for {
+		name := f.path + "." + t.Format(backupTimeFormat)
+		if _, err := os.Stat(name); errors.Is(err, os.ErrNotExist) {
+			if _, err := os.Stat(name + ".gz"); errors.Is(err, os.ErrNotExist) {
+				return name
+			}
+		}
+		t = t.Add(time.Millisecond)
+	}
+}
+
+// Reopen closes and reopens the file at the original path, so that writes continue to a new
+// file after the current one has been moved aside.
+func (f *LogFile) Reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return os.ErrClosed
+	}
+
+	return f.open()
+}
+
+// Close closes the file, waiting for any rotated files to finish being compressed.
+func (f *LogFile) Close() error {
+	f.mu.Lock()
+	var err error
+	if f.file != nil {
+		err = f.file.Close()
+		f.file = nil
+	}
+	f.mu.Unlock()
+	f.wg.Wait()
+
+	return err
+}
+
+// backups returns the paths of the rotated files, oldest first.
+func (f *LogFile) backups() []string {
+	// The directory is listed rather than globbed so that characters such as [ or * in the
+	// path are not taken as patterns.
+	dir, base := filepath.Split(f.path)
+	entries, err := os.ReadDir(filepath.Clean(dir))
+	if err != nil {
+		return nil
+	}
+	prefix := base + "."
+	var backups []string
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), prefix) {
+			continue
+		}
+		stamp := strings.TrimSuffix(strings.TrimPrefix(e.Name(), prefix), ".gz")
+		if _, err := time.Parse(backupTimeFormat, stamp); err == nil {
+			backups = append(backups, f.path+strings.TrimPrefix(e.Name(), base))
+		}
+	}
+	slices.Sort(backups)
+
+	return backups
+}
+
+// removeBackups removes any rotated files beyond the MaxBackups and MaxBackupAge limits.
+func (f *LogFile) removeBackups() {
+	backups := f.backups()
+	prefix := f.path + "."
+	for i, b := range backups {
+		remove := f.maxBackups > 0 && len(backups)-i > f.maxBackups
+		if f.maxAge > 0 {
+			stamp := strings.TrimSuffix(strings.TrimPrefix(b, prefix), ".gz")
+			rotated, _ := time.Parse(backupTimeFormat, stamp)
+			remove = remove || time.Since(rotated) > f.maxAge
+		}
+		if remove {
+			os.Remove(b)
+		}
+	}
+}
+
+// compressFile compresses the file at path with gzip, replacing it with path.gz.
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	err = errors.Join(err, zw.Close(), dst.Close())
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+
+	return os.Remove(path)
+}
@@ -0,0 +1,245 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal_test
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	server "github.com/admacleod/aws/internal"
+)
+
+// readLogs returns the contents of the log file at path and of each of its rotated files, oldest first.
+func readLogs(t *testing.T, path string) (current string, backups []string) {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("could not read log file: %v", err)
+	}
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatalf("could not list rotated files: %v", err)
+	}
+	for _, m := range matches {
+		f, err := os.Open(m)
+		if err != nil {
+			t.Fatalf("could not open rotated file: %v", err)
+		}
+		var r io.Reader = f
+		if strings.HasSuffix(m, ".gz") {
+			if r, err = gzip.NewReader(f); err != nil {
+				t.Fatalf("could not decompress rotated file: %v", err)
+			}
+		}
+		contents, err := io.ReadAll(r)
+		f.Close()
+		if err != nil {
+			t.Fatalf("could not read rotated file: %v", err)
+		}
+		backups = append(backups, string(contents))
+	}
+
+	return string(b), backups
+}
+
+func writeLines(t *testing.T, f *server.LogFile, lines ...string) {
+	t.Helper()
+	for _, l := range lines {
+		if _, err := io.WriteString(f, l); err != nil {
+			t.Fatalf("could not write to log file: %v", err)
+		}
+	}
+}
+
+func TestLogFileRotateSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := server.OpenLogFile(path, server.RotateSize(10))
+	if err != nil {
+		t.Fatalf("could not open log file: %v", err)
+	}
+	writeLines(t, f, "line one\n", "line two\n", "three\n", "4\n")
+	if err := f.Close(); err != nil {
+		t.Fatalf("could not close log file: %v", err)
+	}
+
+	current, backups := readLogs(t, path)
+	if current != "three\n4\n" {
+		t.Errorf("incorrect log file: expected=%q, got=%q", "three\n4\n", current)
+	}
+	expected := []string{"line one\n", "line two\n"}
+	if strings.Join(backups, "|") != strings.Join(expected, "|") {
+		t.Errorf("incorrect rotated files: expected=%q, got=%q", expected, backups)
+	}
+}
+
+func TestLogFileRotateEvery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := server.OpenLogFile(path, server.RotateEvery(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("could not open log file: %v", err)
+	}
+	writeLines(t, f, "old\n")
+	time.Sleep(60 * time.Millisecond)
+	writeLines(t, f, "new\n")
+	f.Close()
+
+	current, backups := readLogs(t, path)
+	if current != "new\n" {
+		t.Errorf("incorrect log file: expected=%q, got=%q", "new\n", current)
+	}
+	if len(backups) != 1 || backups[0] != "old\n" {
+		t.Errorf("incorrect rotated files: expected=%q, got=%q", []string{"old\n"}, backups)
+	}
+}
+
+func TestLogFileRetention(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := server.OpenLogFile(path, server.MaxBackups(2), server.CompressBackups())
+	if err != nil {
+		t.Fatalf("could not open log file: %v", err)
+	}
+	for _, l := range []string{"1\n", "2\n", "3\n", "4\n"} {
+		writeLines(t, f, l)
+		if err := f.Rotate(); err != nil {
+			t.Fatalf("could not rotate log file: %v", err)
+		}
+	}
+	f.Close()
+
+	matches, _ := filepath.Glob(path + ".*.gz")
+	if len(matches) != 2 {
+		t.Errorf("incorrect compressed file count: expected=%d, got=%d", 2, len(matches))
+	}
+	current, backups := readLogs(t, path)
+	if current != "" {
+		t.Errorf("incorrect log file: expected=%q, got=%q", "", current)
+	}
+	expected := []string{"3\n", "4\n"}
+	if strings.Join(backups, "|") != strings.Join(expected, "|") {
+		t.Errorf("incorrect rotated files: expected=%q, got=%q", expected, backups)
+	}
+}
+
+func TestLogFileMaxBackupAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	stale := path + "." + time.Now().Add(-48*time.Hour).UTC().Format("2006-01-02T15-04-05.000")
+	unrelated := path + ".keep"
+	for _, p := range []string{stale, unrelated} {
+		if err := os.WriteFile(p, []byte("stale\n"), 0o644); err != nil {
+			t.Fatalf("could not create file: %v", err)
+		}
+	}
+	f, err := server.OpenLogFile(path, server.MaxBackupAge(24*time.Hour))
+	if err != nil {
+		t.Fatalf("could not open log file: %v", err)
+	}
+	writeLines(t, f, "fresh\n")
+	f.Rotate()
+	f.Close()
+
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("expected stale rotated file to be removed: %v", err)
+	}
+	if _, err := os.Stat(unrelated); err != nil {
+		t.Errorf("expected unrelated file to be kept: %v", err)
+	}
+	matches, _ := filepath.Glob(path + ".2*")
+	if len(matches) != 1 {
+		t.Errorf("incorrect rotated file count: expected=%d, got=%d", 1, len(matches))
+	}
+}
+
+func TestLogFileRetentionPatternPath(t *testing.T) {
+	dir := t.TempDir()
+	// A glob of this path would match the rotated files of access1.log rather than its own.
+	path := filepath.Join(dir, "access[1].log")
+	neighbour := filepath.Join(dir, "access1.log."+time.Now().Add(-48*time.Hour).UTC().Format("2006-01-02T15-04-05.000"))
+	if err := os.WriteFile(neighbour, []byte("neighbour\n"), 0o644); err != nil {
+		t.Fatalf("could not create file: %v", err)
+	}
+	f, err := server.OpenLogFile(path, server.MaxBackups(1), server.MaxBackupAge(24*time.Hour))
+	if err != nil {
+		t.Fatalf("could not open log file: %v", err)
+	}
+	for _, l := range []string{"1\n", "2\n", "3\n"} {
+		writeLines(t, f, l)
+		if err := f.Rotate(); err != nil {
+			t.Fatalf("could not rotate log file: %v", err)
+		}
+	}
+	f.Close()
+
+	if _, err := os.Stat(neighbour); err != nil {
+		t.Errorf("expected rotated file of another log to be kept: %v", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("could not list directory: %v", err)
+	}
+	var backups int
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), "access[1].log.") {
+			backups++
+		}
+	}
+	if backups != 1 {
+		t.Errorf("incorrect rotated file count: expected=%d, got=%d", 1, backups)
+	}
+}
+
+func TestLogFileReopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	f, err := server.OpenLogFile(path)
+	if err != nil {
+		t.Fatalf("could not open log file: %v", err)
+	}
+	defer f.Close()
+	writeLines(t, f, "before\n")
+	moved := filepath.Join(dir, "access.log.1")
+	if err := os.Rename(path, moved); err != nil {
+		t.Fatalf("could not move log file: %v", err)
+	}
+	writeLines(t, f, "moved\n")
+	if err := f.Reopen(); err != nil {
+		t.Fatalf("could not reopen log file: %v", err)
+	}
+	writeLines(t, f, "after\n")
+
+	for p, expected := range map[string]string{moved: "before\nmoved\n", path: "after\n"} {
+		got, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatalf("could not read log file: %v", err)
+		}
+		if string(got) != expected {
+			t.Errorf("incorrect contents of %s: expected=%q, got=%q", filepath.Base(p), expected, got)
+		}
+	}
+}
+
+func TestLogFileClosed(t *testing.T) {
+	f, err := server.OpenLogFile(filepath.Join(t.TempDir(), "access.log"))
+	if err != nil {
+		t.Fatalf("could not open log file: %v", err)
+	}
+	f.Close()
+	if _, err := f.Write([]byte("late\n")); err == nil {
+		t.Error("expected error writing to closed log file")
+	}
+}
@@ -0,0 +1,484 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// LogFormat encodes LogEntries for writing to an access log.
+type LogFormat interface {
+	// Format appends the encoded entry, terminated by a newline, to b and returns the extended buffer.
+	Format(b []byte, e *LogEntry) []byte
+}
+
+// LogFormatFunc is an adapter allowing ordinary functions to be used as a LogFormat.
+type LogFormatFunc func(b []byte, e *LogEntry) []byte
+
+// Format calls f(b, e).
+func (f LogFormatFunc) Format(b []byte, e *LogEntry) []byte {
+	return f(b, e)
+}
+
+// Templates for the standard Apache log formats, as understood by ParseLogFormat.
+//
+// The definitions of these formats can be found at: https://httpd.apache.org/docs/2.4/logs.html
+const (
+	CommonLogTemplate        = `%h %l %u %t "%r" %>s %b`
+	CombinedLogTemplate      = CommonLogTemplate + ` "%{Referer}i" "%{User-Agent}i"`
+	VhostCombinedLogTemplate = `%v:%p ` + CombinedLogTemplate
+)
+
+var (
+	// CommonLogFormat writes entries in the Apache Common Log Format.
+	CommonLogFormat = mustParseLogFormat(CommonLogTemplate)
+	// CombinedLogFormat writes entries in the Apache Combined Log Format.
+	CombinedLogFormat = mustParseLogFormat(CombinedLogTemplate)
+	// VhostCombinedLogFormat writes entries in the Apache Combined Log Format prefixed with the
+	// requested host and port, for when serving several sites to the same log.
+	VhostCombinedLogFormat = mustParseLogFormat(VhostCombinedLogTemplate)
+	// JSONLogFormat writes each entry as a JSON object on its own line.
+	JSONLogFormat LogFormat = LogFormatFunc(formatJSON)
+	// LogfmtLogFormat writes each entry as a line of logfmt key=value pairs.
+	LogfmtLogFormat LogFormat = LogFormatFunc(formatLogfmt)
+)
+
+// LookupLogFormat returns the built in LogFormat with the passed name, which is one of "common",
+// "combined", "vhost_combined", "json", or "logfmt". Any other name is parsed as a template
+// using ParseLogFormat.
+func LookupLogFormat(name string) (LogFormat, error) {
+	switch name {
+	case "common":
+		return CommonLogFormat, nil
+	case "combined":
+		return CombinedLogFormat, nil
+	case "vhost_combined":
+		return VhostCombinedLogFormat, nil
+	case "json":
+		return JSONLogFormat, nil
+	case "logfmt":
+		return LogfmtLogFormat, nil
+	}
+	if !strings.Contains(name, "%") {
+		return nil, fmt.Errorf("unknown log format %q", name)
+	}
+
+	return ParseLogFormat(name)
+}
+
+// logField appends a single field of a templated log entry.
+type logField func(b []byte, e *LogEntry) []byte
+
+type logTemplate []logField
+
+func (t logTemplate) Format(b []byte, e *LogEntry) []byte {
+	for _, f := range t {
+		b = f(b, e)
+	}
+
+	return append(b, '\n')
+}
+
+// ParseLogFormat parses a template in the style of the Apache LogFormat directive, described at
+// https://httpd.apache.org/docs/2.4/mod/mod_log_config.html#formats, into a LogFormat.
+//
+// The following directives are supported:
+//
+//	%%                       a literal percent sign
+//	%a                       client IP address, see ClientIP
+//	%A                       local IP address
+//	%b                       bytes in the response body, or "-" for none
+//	%B                       bytes in the response body
+//	%D                       time taken to serve the request in microseconds
+//	%h                       client IP address, see ClientIP
+//	%H                       request protocol
+//	%{Header}i               request header
+//	%l                       remote logname, always "-"
+//	%m                       request method
+//	%{Header}o               response header
+//	%O                       bytes in the response body, as %B
+//	%p                       server port
+//	%q                       query string, prefixed with "?" if it is not empty
+//	%r                       first line of the request
+//	%s                       response status, also %>s and %<s
+//	%t                       time the request was received, in [02/Jan/2006:15:04:05 -0700] form
+//	%{sec}t                  time the request was received, in seconds since the epoch; also msec and usec
+//	%T                       time taken to serve the request in seconds
+//	%{unit}T                 time taken to serve the request in the passed unit; one of s, ms, or us
+//	%u                       remote user, always "-"
+//	%U                       requested URL path
+//	%v                       requested host, without the port; also %V
+//	%^FB                     time taken until the first byte of the response in microseconds
+//	%{SSL_PROTOCOL}x         negotiated TLS version, for example TLSv1.3
+//	%{SSL_CIPHER}x           negotiated TLS cipher suite
+//	%{SSL_ALPN}x             negotiated application protocol, for example h2
+//	%{SSL_SESSION_RESUMED}x  "Resumed" if the TLS session was resumed, otherwise "Initial"
+//
+// Quotes, backslashes, and control characters in values taken from the request or response
+// are escaped. Missing values are logged as "-".
+func ParseLogFormat(template string) (LogFormat, error) {
+	var t logTemplate
+	for len(template) > 0 {
+		i := strings.IndexByte(template, '%')
+		if i < 0 {
+			i = len(template)
+		}
+		if i > 0 {
+			literal := template[:i]
+			t = append(t, func(b []byte, _ *LogEntry) []byte { return append(b, literal...) })
+			template = template[i:]
+			continue
+		}
+
+		// Skip the percent sign and any status modifiers.
+		template = strings.TrimLeft(template[1:], "<>")
+		var param string
+		if strings.HasPrefix(template, "{") {
+			end := strings.IndexByte(template, '}')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated parameter in log format at %q", template)
+			}
+			param, template = template[1:end], template[end+1:]
+		}
+		if template == "" {
+			return nil, fmt.Errorf("missing directive at end of log format")
+		}
+		if strings.HasPrefix(template, "^FB") {
+			t = append(t, func(b []byte, e *LogEntry) []byte {
+				return strconv.AppendInt(b, e.TimeToFirstByte.Microseconds(), 10)
+			})
+			template = template[3:]
+			continue
+		}
+		field, err := logDirective(template[0], param)
+		if err != nil {
+			return nil, err
+		}
+		t = append(t, field)
+		template = template[1:]
+	}
+
+	return t, nil
+}
+
+func mustParseLogFormat(template string) LogFormat {
+	f, err := ParseLogFormat(template)
+	if err != nil {
+		panic(err)
+	}
+
+	return f
+}
+
+// logDirective returns the field for a single directive of a log format template.
+func logDirective(directive byte, param string) (logField, error) {
+	withParam := map[byte]bool{'i': true, 'o': true, 't': true, 'T': true, 'x': true}
+	if param != "" && !withParam[directive] {
+		return nil, fmt.Errorf("log format directive %%%c does not take a parameter", directive)
+	}
+
+	switch directive {
+	case '%':
+		return func(b []byte, _ *LogEntry) []byte { return append(b, '%') }, nil
+	case 'a', 'h':
+		return func(b []byte, e *LogEntry) []byte { return appendLogValue(b, ClientIP(e.Request)) }, nil
+	case 'A':
+		return func(b []byte, e *LogEntry) []byte {
+			ip, _ := localAddr(e.Request)
+			return appendLogValue(b, ip)
+		}, nil
+	case 'b':
+		return func(b []byte, e *LogEntry) []byte {
+			if e.Bytes == 0 {
+				return append(b, '-')
+			}
+			return strconv.AppendInt(b, int64(e.Bytes), 10)
+		}, nil
+	case 'B', 'O':
+		return func(b []byte, e *LogEntry) []byte { return strconv.AppendInt(b, int64(e.Bytes), 10) }, nil
+	case 'D':
+		return func(b []byte, e *LogEntry) []byte { return strconv.AppendInt(b, e.Duration.Microseconds(), 10) }, nil
+	case 'H':
+		return func(b []byte, e *LogEntry) []byte { return appendLogValue(b, e.Request.Proto) }, nil
+	case 'i':
+		header := http.CanonicalHeaderKey(param)
+		return func(b []byte, e *LogEntry) []byte { return appendLogValue(b, e.Request.Header.Get(header)) }, nil
+	case 'l', 'u':
+		return func(b []byte, _ *LogEntry) []byte { return append(b, '-') }, nil
+	case 'm':
+		return func(b []byte, e *LogEntry) []byte { return appendLogValue(b, e.Request.Method) }, nil
+	case 'o':
+		header := http.CanonicalHeaderKey(param)
+		return func(b []byte, e *LogEntry) []byte { return appendLogValue(b, e.Header.Get(header)) }, nil
+	case 'p':
+		return func(b []byte, e *LogEntry) []byte {
+			_, port := localAddr(e.Request)
+			return appendLogValue(b, port)
+		}, nil
+	case 'q':
+		return func(b []byte, e *LogEntry) []byte {
+			if e.Request.URL.RawQuery == "" {
+				return b
+			}
+			return appendEscaped(append(b, '?'), e.Request.URL.RawQuery)
+		}, nil
+	case 'r':
+		return func(b []byte, e *LogEntry) []byte {
+			return appendEscaped(b, e.Request.Method+" "+e.Request.RequestURI+" "+e.Request.Proto)
+		}, nil
+	case 's':
+		return func(b []byte, e *LogEntry) []byte { return strconv.AppendInt(b, int64(e.Status), 10) }, nil
+	case 't':
+		return timeDirective(param)
+	case 'T':
+		return durationDirective(param)
+	case 'U':
+		return func(b []byte, e *LogEntry) []byte { return appendLogValue(b, e.Request.URL.Path) }, nil
+	case 'v', 'V':
+		return func(b []byte, e *LogEntry) []byte { return appendLogValue(b, e.Host) }, nil
+	case 'x':
+		return tlsDirective(param)
+	}
+
+	return nil, fmt.Errorf("unsupported log format directive %%%c", directive)
+}
+
+func timeDirective(param string) (logField, error) {
+	switch param {
+	case "":
+		return func(b []byte, e *LogEntry) []byte {
+			return append(e.Start.AppendFormat(append(b, '['), "02/Jan/2006:15:04:05 -0700"), ']')
+		}, nil
+	case "sec":
+		return func(b []byte, e *LogEntry) []byte { return strconv.AppendInt(b, e.Start.Unix(), 10) }, nil
+	case "msec":
+		return func(b []byte, e *LogEntry) []byte { return strconv.AppendInt(b, e.Start.UnixMilli(), 10) }, nil
+	case "usec":
+		return func(b []byte, e *LogEntry) []byte { return strconv.AppendInt(b, e.Start.UnixMicro(), 10) }, nil
+	}
+
+	return nil, fmt.Errorf("unsupported time format %q in log format", param)
+}
+
+func durationDirective(param string) (logField, error) {
+	unit := map[string]time.Duration{"": time.Second, "s": time.Second, "ms": time.Millisecond, "us": time.Microsecond}
+	u, ok := unit[param]
+	if !ok {
+		return nil, fmt.Errorf("unsupported duration unit %q in log format", param)
+	}
+
+	return func(b []byte, e *LogEntry) []byte { return strconv.AppendInt(b, int64(e.Duration/u), 10) }, nil
+}
+
+func tlsDirective(param string) (logField, error) {
+	switch param {
+	case "SSL_PROTOCOL":
+		return func(b []byte, e *LogEntry) []byte { return appendLogValue(b, e.TLSVersion) }, nil
+	case "SSL_CIPHER":
+		return func(b []byte, e *LogEntry) []byte { return appendLogValue(b, e.CipherSuite) }, nil
+	case "SSL_ALPN":
+		return func(b []byte, e *LogEntry) []byte { return appendLogValue(b, e.ALPN) }, nil
+	case "SSL_SESSION_RESUMED":
+		return func(b []byte, e *LogEntry) []byte {
+			switch {
+			case e.TLSVersion == "":
+				return append(b, '-')
+			case e.Resumed:
+				return append(b, "Resumed"...)
+			}
+			return append(b, "Initial"...)
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported variable %q in log format", param)
+}
+
+// tlsVersionName names TLS versions in the same style as the Apache SSL_PROTOCOL variable.
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLSv1"
+	case tls.VersionTLS11:
+		return "TLSv1.1"
+	case tls.VersionTLS12:
+		return "TLSv1.2"
+	case tls.VersionTLS13:
+		return "TLSv1.3"
+	}
+
+	return fmt.Sprintf("0x%04x", version)
+}
+
+// requestHost returns the host requested by the client, without any port.
+func requestHost(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.Host); err == nil {
+		return host
+	}
+
+	return r.Host
+}
+
+// localAddr returns the IP address and port that the request was received on.
+func localAddr(r *http.Request) (string, string) {
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if host, port, err := net.SplitHostPort(addr.String()); err == nil {
+			return host, port
+		}
+	}
+	if _, port, err := net.SplitHostPort(r.Host); err == nil {
+		return "", port
+	}
+	if r.TLS != nil {
+		return "", "443"
+	}
+
+	return "", "80"
+}
+
+// appendLogValue appends an escaped value, or "-" if the value is empty.
+func appendLogValue(b []byte, s string) []byte {
+	if s == "" {
+		return append(b, '-')
+	}
+
+	return appendEscaped(b, s)
+}
+
+// appendEscaped appends s with quotes and backslashes escaped, and control characters or invalid
+// UTF-8 written as \xhh, so that clients cannot forge or corrupt log lines.
+func appendEscaped(b []byte, s string) []byte {
+	const hex = "0123456789abcdef"
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b = append(b, '\\', c)
+		case c < 0x20 || c == 0x7f:
+			b = append(b, '\\', 'x', hex[c>>4], hex[c&0xf])
+		case c >= utf8.RuneSelf:
+			r, size := utf8.DecodeRuneInString(s[i:])
+			if r == utf8.RuneError && size == 1 {
+				b = append(b, '\\', 'x', hex[c>>4], hex[c&0xf])
+			} else {
+				b = append(b, s[i:i+size]...)
+			}
+			i += size
+			continue
+		default:
+			b = append(b, c)
+		}
+		i++
+	}
+
+	return b
+}
+
+// LogField is a single named field of a structured log entry.
+// Value is one of string, int, float64, or bool.
+type LogField struct {
+	Key   string
+	Value any
+}
+
+// Fields returns the fields of the entry written by the JSON and logfmt formats, in order.
+func (e *LogEntry) Fields() []LogField {
+	r := e.Request
+	pairs := []LogField{
+		{"time", e.Start.Format(time.RFC3339Nano)},
+		{"client", ClientIP(r)},
+		{"host", e.Host},
+		{"method", r.Method},
+		{"uri", r.RequestURI},
+		{"proto", r.Proto},
+		{"status", e.Status},
+		{"bytes", e.Bytes},
+		{"duration_ms", float64(e.Duration.Microseconds()) / 1000},
+		{"ttfb_ms", float64(e.TimeToFirstByte.Microseconds()) / 1000},
+		{"referer", r.Referer()},
+		{"user_agent", r.UserAgent()},
+	}
+	if e.TLSVersion != "" {
+		pairs = append(pairs,
+			LogField{"tls_version", e.TLSVersion},
+			LogField{"tls_cipher", e.CipherSuite},
+			LogField{"alpn", e.ALPN},
+			LogField{"tls_resumed", e.Resumed},
+		)
+	}
+
+	return pairs
+}
+
+func formatJSON(b []byte, e *LogEntry) []byte {
+	b = append(b, '{')
+	for i, p := range e.Fields() {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = strconv.AppendQuote(b, p.Key)
+		b = append(b, ':')
+		v, err := json.Marshal(p.Value)
+		if err != nil {
+			v = []byte("null")
+		}
+		b = append(b, v...)
+	}
+
+	return append(b, '}', '\n')
+}
+
+func formatLogfmt(b []byte, e *LogEntry) []byte {
+	for i, p := range e.Fields() {
+		if i > 0 {
+			b = append(b, ' ')
+		}
+		b = append(b, p.Key...)
+		b = append(b, '=')
+		if v, ok := p.Value.(string); ok {
+			if v == "" || strings.ContainsAny(v, " =\"\\") || strings.IndexFunc(v, func(r rune) bool { return r < 0x20 || r == 0x7f }) >= 0 {
+				b = strconv.AppendQuote(b, v)
+			} else {
+				b = append(b, v...)
+			}
+			continue
+		}
+		b = appendFieldValue(b, p.Value)
+	}
+
+	return append(b, '\n')
+}
+
+// appendFieldValue appends the unquoted text form of a LogField value.
+func appendFieldValue(b []byte, v any) []byte {
+	switch v := v.(type) {
+	case string:
+		return append(b, v...)
+	case int:
+		return strconv.AppendInt(b, int64(v), 10)
+	case float64:
+		return strconv.AppendFloat(b, v, 'f', -1, 64)
+	case bool:
+		return strconv.AppendBool(b, v)
+	}
+
+	return fmt.Append(b, v)
+}
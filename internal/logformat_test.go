@@ -0,0 +1,166 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal_test
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	server "github.com/admacleod/aws/internal"
+)
+
+func testLogEntry() *server.LogEntry {
+	req := httptest.NewRequest("GET", "https://test.example.com:8443/path/file.html?q=1", nil)
+	req.RemoteAddr = "[2001:db8::1]:50000"
+	req.Header.Set("Referer", "https://referer.example.com/")
+	req.Header.Set("User-Agent", `agent "quoted"`)
+	req.TLS = &tls.ConnectionState{Version: tls.VersionTLS13, CipherSuite: tls.TLS_AES_128_GCM_SHA256, NegotiatedProtocol: "h2", DidResume: true}
+	req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, &net.TCPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 8443}))
+
+	return &server.LogEntry{
+		Request:         req,
+		Header:          http.Header{"Content-Type": {"text/html"}},
+		Start:           time.Date(2020, time.July, 2, 13, 14, 15, 0, time.UTC),
+		Duration:        1500 * time.Microsecond,
+		TimeToFirstByte: 250 * time.Microsecond,
+		Status:          http.StatusOK,
+		Bytes:           1234,
+		Host:            "test.example.com",
+		TLSVersion:      "TLSv1.3",
+		CipherSuite:     "TLS_AES_128_GCM_SHA256",
+		ALPN:            "h2",
+		Resumed:         true,
+	}
+}
+
+func TestLogFormats(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		format   string
+		expected string
+	}{
+		{"Common", "common", `2001:db8::1 - - [02/Jul/2020:13:14:15 +0000] "GET https://test.example.com:8443/path/file.html?q=1 HTTP/1.1" 200 1234` + "\n"},
+		{"Combined", "combined", `2001:db8::1 - - [02/Jul/2020:13:14:15 +0000] "GET https://test.example.com:8443/path/file.html?q=1 HTTP/1.1" 200 1234 "https://referer.example.com/" "agent \"quoted\""` + "\n"},
+		{"VhostCombined", "vhost_combined", `test.example.com:8443 2001:db8::1 - - [02/Jul/2020:13:14:15 +0000] "GET https://test.example.com:8443/path/file.html?q=1 HTTP/1.1" 200 1234 "https://referer.example.com/" "agent \"quoted\""` + "\n"},
+		{"Logfmt", "logfmt", `time=2020-07-02T13:14:15Z client=2001:db8::1 host=test.example.com method=GET uri="https://test.example.com:8443/path/file.html?q=1" proto=HTTP/1.1 status=200 bytes=1234 duration_ms=1.5 ttfb_ms=0.25 referer=https://referer.example.com/ user_agent="agent \"quoted\"" tls_version=TLSv1.3 tls_cipher=TLS_AES_128_GCM_SHA256 alpn=h2 tls_resumed=true` + "\n"},
+		{"Template", `%a %A %p %m %U%q %H %>s %B %D %T %{ms}T %{Content-Type}o %{X-Missing}i %v %{SSL_PROTOCOL}x %{SSL_CIPHER}x %{sec}t 100%%`,
+			"2001:db8::1 198.51.100.1 8443 GET /path/file.html?q=1 HTTP/1.1 200 1234 1500 0 1 text/html - test.example.com TLSv1.3 TLS_AES_128_GCM_SHA256 1593695655 100%\n"},
+		{"TLSTemplate", `%^FB %{SSL_ALPN}x %{SSL_SESSION_RESUMED}x`, "250 h2 Resumed\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			format, err := server.LookupLogFormat(tt.format)
+			if err != nil {
+				t.Fatalf("could not look up log format: %v", err)
+			}
+			if got := string(format.Format(nil, testLogEntry())); got != tt.expected {
+				t.Errorf("incorrect log line:\nexpect=%q\nactual=%q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestJSONLogFormat(t *testing.T) {
+	line := server.JSONLogFormat.Format(nil, testLogEntry())
+
+	var got map[string]any
+	if err := json.Unmarshal(line, &got); err != nil {
+		t.Fatalf("could not decode log line %s: %v", line, err)
+	}
+	expected := map[string]any{
+		"time":        "2020-07-02T13:14:15Z",
+		"client":      "2001:db8::1",
+		"host":        "test.example.com",
+		"method":      "GET",
+		"uri":         "https://test.example.com:8443/path/file.html?q=1",
+		"proto":       "HTTP/1.1",
+		"status":      float64(200),
+		"bytes":       float64(1234),
+		"duration_ms": 1.5,
+		"ttfb_ms":     0.25,
+		"referer":     "https://referer.example.com/",
+		"user_agent":  `agent "quoted"`,
+		"tls_version": "TLSv1.3",
+		"tls_cipher":  "TLS_AES_128_GCM_SHA256",
+		"alpn":        "h2",
+		"tls_resumed": true,
+	}
+	if !reflect.DeepEqual(expected, got) {
+		t.Errorf("incorrect log entry:\nexpect=%v\nactual=%v", expected, got)
+	}
+}
+
+func TestLogFormatWithoutTLS(t *testing.T) {
+	e := testLogEntry()
+	e.TLSVersion, e.CipherSuite, e.ALPN, e.Resumed = "", "", "", false
+
+	format, err := server.ParseLogFormat(`%{SSL_PROTOCOL}x %{SSL_CIPHER}x %{SSL_ALPN}x %{SSL_SESSION_RESUMED}x`)
+	if err != nil {
+		t.Fatalf("could not parse log format: %v", err)
+	}
+	if got := string(format.Format(nil, e)); got != "- - - -\n" {
+		t.Errorf("incorrect log line: expected=%q, got=%q", "- - - -\n", got)
+	}
+
+	var got map[string]any
+	if err := json.Unmarshal(server.JSONLogFormat.Format(nil, e), &got); err != nil {
+		t.Fatalf("could not decode log line: %v", err)
+	}
+	for _, key := range []string{"tls_version", "tls_cipher", "alpn", "tls_resumed"} {
+		if _, ok := got[key]; ok {
+			t.Errorf("unexpected %s field in log entry without TLS", key)
+		}
+	}
+}
+
+func TestLogFormatEscaping(t *testing.T) {
+	e := testLogEntry()
+	e.Request.Header.Set("User-Agent", "evil\"\n\\agent\xff")
+	e.Bytes = 0
+
+	format, err := server.ParseLogFormat(`"%{User-Agent}i" %b %B`)
+	if err != nil {
+		t.Fatalf("could not parse log format: %v", err)
+	}
+	expected := `"evil\"\x0a\\agent\xff" - 0` + "\n"
+	if got := string(format.Format(nil, e)); got != expected {
+		t.Errorf("incorrect log line:\nexpect=%q\nactual=%q", expected, got)
+	}
+}
+
+func TestParseLogFormatErrors(t *testing.T) {
+	for _, template := range []string{
+		"%",
+		"%{Referer",
+		"%Z",
+		"%{param}m",
+		"%{fortnights}T",
+		"%{%Y}t",
+		"%{SSL_SESSION_ID}x",
+	} {
+		if _, err := server.ParseLogFormat(template); err == nil {
+			t.Errorf("expected error parsing %q", template)
+		}
+	}
+
+	if _, err := server.LookupLogFormat("apache"); err == nil {
+		t.Errorf("expected error looking up unknown log format")
+	}
+}
@@ -14,60 +14,162 @@
 package internal
 
 import (
+	"crypto/tls"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
-	"strings"
 	"time"
 )
 
-type loggerResponseWriter struct {
-	http.ResponseWriter
-	Status        int
-	ContentLength int
+// LogEntry describes a completed request for writing to an access log.
+type LogEntry struct {
+	// Request is the request as received by the logger.
+	Request *http.Request
+	// Header is the header of the response.
+	Header http.Header
+	// Start is the time that the request was received.
+	Start time.Time
+	// Duration is how long the request took to serve.
+	Duration time.Duration
+	// TimeToFirstByte is how long it took for the handler to begin the response.
+	TimeToFirstByte time.Duration
+	// Status is the status code of the response. It is 500 if the handler panicked before
+	// writing the header, and zero if the connection was hijacked before writing the header.
+	Status int
+	// Bytes is the number of bytes written in the response body.
+	Bytes int
+	// Host is the host requested by the client, without any port.
+	Host string
+
+	// TLSVersion is the negotiated TLS version, for example "TLSv1.3", or empty if TLS was not used.
+	TLSVersion string
+	// CipherSuite is the name of the negotiated TLS cipher suite.
+	CipherSuite string
+	// ALPN is the application protocol negotiated during the TLS handshake, such as "h2".
+	ALPN string
+	// Resumed reports whether the TLS session was resumed from a previous connection.
+	Resumed bool
 }
 
-func (lrw *loggerResponseWriter) WriteHeader(code int) {
-	lrw.ResponseWriter.WriteHeader(code)
-	lrw.Status = code
+// newLogEntry creates a LogEntry for the request from the details captured by the ResponseWriter.
+func newLogEntry(r *http.Request, rw *ResponseWriter, start, end time.Time) *LogEntry {
+	e := &LogEntry{
+		Request:         r,
+		Header:          rw.Header(),
+		Start:           start,
+		Duration:        end.Sub(start),
+		TimeToFirstByte: end.Sub(start),
+		Status:          rw.Status(),
+		Bytes:           int(rw.Bytes()),
+		Host:            requestHost(r),
+	}
+	if !rw.FirstByte().IsZero() {
+		e.TimeToFirstByte = rw.FirstByte().Sub(start)
+	}
+	if r.TLS != nil {
+		e.TLSVersion = tlsVersionName(r.TLS.Version)
+		e.CipherSuite = tls.CipherSuiteName(r.TLS.CipherSuite)
+		e.ALPN = r.TLS.NegotiatedProtocol
+		e.Resumed = r.TLS.DidResume
+	}
+
+	return e
 }
 
-func (lrw *loggerResponseWriter) Write(bb []byte) (int, error) {
-	length, err := lrw.ResponseWriter.Write(bb)
-	lrw.ContentLength += length
+// FieldWriter is implemented by access log outputs that can record the fields of each entry
+// natively alongside the formatted line, such as syslog structured data or journald fields.
+type FieldWriter interface {
+	io.Writer
+	// WriteFields writes a single formatted log line along with the fields of its entry.
+	WriteFields(line []byte, fields []LogField) error
+}
 
-	return length, err
+// fieldWriter returns output as a FieldWriter, reporting whether the fields passed to it are
+// recorded rather than only passed on to an io.Writer that drops them, as by an AsyncWriter
+// writing to a file.
+func fieldWriter(output io.Writer) (FieldWriter, bool) {
+	fw, ok := output.(FieldWriter)
+	if aw, async := output.(*AsyncWriter); async {
+		_, ok = fieldWriter(aw.out)
+	}
+
+	return fw, ok
 }
 
-// CombinedLogFormatLogger is a middleware generator function that will write an Apache Combined Log Format
+// AccessLogger is a middleware generator function that will write an entry in the passed LogFormat
 // to the passed output Writer for all requests to the wrapped handler.
 //
-// The definition of the Combined Log Format can be found at: https://httpd.apache.org/docs/2.4/logs.html#combined
-func CombinedLogFormatLogger(output io.Writer) func(http.Handler) http.Handler {
+// Each entry is written to the output with a single call to Write, or to WriteFields if the output
+// is a FieldWriter that records fields, including an AsyncWriter writing to one.
+//
+// The remote host is logged using ClientIP so the TrustedProxies middleware should wrap the logger
+// when serving behind a proxy.
+//
+// Requests whose handler panics are logged before the panic continues up to the server.
+func AccessLogger(output io.Writer, format LogFormat) func(http.Handler) http.Handler {
+	fw, fields := fieldWriter(output)
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			start := time.Now()
-			lrw := loggerResponseWriter{w, 200, 0}
-			next.ServeHTTP(&lrw, r)
-			fmt.Fprintf(output, "%s - - [%s] \"%s %s %s\" %d %d \"%s\" \"%s\"\n",
-				strings.Split(r.RemoteAddr, ":")[0], // Remove potential port number from remote address
-				start.Format("02/Jan/2006:15:04:05 -0700"),
-				r.Method,
-				r.RequestURI,
-				r.Proto,
-				lrw.Status,
-				lrw.ContentLength,
-				r.Referer(),
-				r.UserAgent(),
-			)
+			rw := NewResponseWriter(w)
+			defer func() {
+				p := recover()
+				e := newLogEntry(r, rw, start, time.Now())
+				switch {
+				case p != nil && !rw.Written():
+					// The server will abort the connection without a response.
+					e.Status = http.StatusInternalServerError
+				case !rw.Written() && !rw.Hijacked():
+					// The server sends an empty 200 response for handlers that write nothing.
+					e.Status = http.StatusOK
+				}
+				if fields {
+					fw.WriteFields(format.Format(nil, e), e.Fields())
+				} else {
+					output.Write(format.Format(nil, e))
+				}
+				if p != nil {
+					panic(p)
+				}
+			}()
+			next.ServeHTTP(rw, r)
 		})
 	}
 }
 
-// ErrorLog creates a server.Option function that will apply the passed log.Logger to the server as the ErrorLog.
-func ErrorLog(logger *log.Logger) Option {
+// CombinedLogFormatLogger is a middleware generator function that will write an Apache Combined Log Format
+// to the passed output Writer for all requests to the wrapped handler.
+//
+// Unlike AccessLogger using CombinedLogFormat, values are written as received rather than escaped,
+// and a missing referer, user agent, or response body is written as "" or 0 rather than "-".
+func CombinedLogFormatLogger(output io.Writer) func(http.Handler) http.Handler {
+	return AccessLogger(output, LogFormatFunc(formatCombined))
+}
+
+// formatCombined appends an entry in the Apache Combined Log Format as written by
+// CombinedLogFormatLogger.
+func formatCombined(b []byte, e *LogEntry) []byte {
+	return fmt.Appendf(b, "%s - - [%s] \"%s %s %s\" %d %d \"%s\" \"%s\"\n",
+		ClientIP(e.Request),
+		e.Start.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Request.Method,
+		e.Request.RequestURI,
+		e.Request.Proto,
+		e.Status,
+		e.Bytes,
+		e.Request.Referer(),
+		e.Request.UserAgent(),
+	)
+}
+
+// ErrorLog creates a server.Option function that will send errors from the server to the passed
+// slog.Handler, using NewErrorLogger to bridge the ErrorLog of the server.
+//
+// Errors from the HTTP/3 server, if enabled, are also sent to the handler.
+func ErrorLog(h slog.Handler) Option {
 	return func(srv *Server) {
-		srv.ErrorLog = logger
+		srv.ErrorLog = NewErrorLogger(h)
+		srv.logger = slog.New(h)
 	}
 }
@@ -15,14 +15,15 @@ package internal_test
 
 import (
 	"bytes"
+	"crypto/tls"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httptest"
-	"os"
-	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -63,7 +64,7 @@ func TestLogger(t *testing.T) {
 	}
 
 	expected := fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %d \"%s\" \"%s\"\n",
-		strings.Split(req.RemoteAddr, ":")[0],
+		"192.0.2.1",
 		start.Format("02/Jan/2006:15:04:05 -0700"),
 		req.Method,
 		req.RequestURI,
@@ -80,13 +81,186 @@ func TestLogger(t *testing.T) {
 	}
 }
 
+func TestLoggerRemoteAddr(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		remote   string
+		expected string
+	}{
+		{"IPv4", "192.0.2.1:1234", "192.0.2.1"},
+		{"IPv4WithoutPort", "192.0.2.1", "192.0.2.1"},
+		{"IPv6", "[2001:db8::1]:443", "2001:db8::1"},
+		{"IPv6WithoutPort", "2001:db8::1", "2001:db8::1"},
+		{"IPv6BracketedWithoutPort", "[2001:db8::1]", "2001:db8::1"},
+		{"IPv6Zone", "[fe80::1%eth0]:443", "fe80::1%eth0"},
+		{"IPv6ZoneWithoutPort", "fe80::1%eth0", "fe80::1%eth0"},
+		{"IPv4MappedIPv6", "[::ffff:192.0.2.1]:443", "::ffff:192.0.2.1"},
+		{"UnixSocket", "@", "@"},
+		{"Empty", "", ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://test.example.com", nil)
+			req.RemoteAddr = tt.remote
+
+			var output bytes.Buffer
+			server.CombinedLogFormatLogger(&output)(http.NotFoundHandler()).ServeHTTP(httptest.NewRecorder(), req)
+
+			if got, _, _ := strings.Cut(output.String(), " "); got != tt.expected {
+				t.Errorf("incorrect remote host logged: expected=%s, got=%s", tt.expected, got)
+			}
+			if got := server.ClientIP(req); got != tt.expected {
+				t.Errorf("incorrect client IP: expected=%s, got=%s", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestLoggerTrustedProxy(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	req := httptest.NewRequest("GET", "http://test.example.com", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "192.0.2.1")
+
+	var output bytes.Buffer
+	middleware := server.ChainMiddleware(
+		server.CombinedLogFormatLogger(&output),
+		server.TrustedProxies(proxies),
+	)
+	middleware(http.NotFoundHandler()).ServeHTTP(httptest.NewRecorder(), req)
+
+	if got := output.String(); !strings.HasPrefix(got, "192.0.2.1 - - ") {
+		t.Errorf("incorrect remote host logged: expected=%s, got=%s", "192.0.2.1", got)
+	}
+}
+
+func TestLoggerCapture(t *testing.T) {
+	delay := 20 * time.Millisecond
+	testHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		io.WriteString(w, "test")
+		time.Sleep(delay)
+	})
+
+	req := httptest.NewRequest("GET", "https://test.example.com:8443/", nil)
+	req.TLS = &tls.ConnectionState{
+		Version:            tls.VersionTLS12,
+		CipherSuite:        tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		NegotiatedProtocol: "http/1.1",
+	}
+
+	var entry *server.LogEntry
+	format := server.LogFormatFunc(func(b []byte, e *server.LogEntry) []byte {
+		entry = e
+		return b
+	})
+	server.AccessLogger(io.Discard, format)(testHandler).ServeHTTP(httptest.NewRecorder(), req)
+
+	if entry.TimeToFirstByte < delay || entry.TimeToFirstByte >= entry.Duration {
+		t.Errorf("incorrect time to first byte: expected between %v and %v, got=%v", delay, entry.Duration, entry.TimeToFirstByte)
+	}
+	if entry.Duration < 2*delay {
+		t.Errorf("incorrect duration: expected>=%v, got=%v", 2*delay, entry.Duration)
+	}
+	for _, tt := range []struct {
+		name     string
+		got      any
+		expected any
+	}{
+		{"Host", entry.Host, "test.example.com"},
+		{"TLSVersion", entry.TLSVersion, "TLSv1.2"},
+		{"CipherSuite", entry.CipherSuite, "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+		{"ALPN", entry.ALPN, "http/1.1"},
+		{"Resumed", entry.Resumed, false},
+		{"Bytes", entry.Bytes, 4},
+	} {
+		if tt.got != tt.expected {
+			t.Errorf("incorrect %s: expected=%v, got=%v", tt.name, tt.expected, tt.got)
+		}
+	}
+}
+
+func TestLoggerStatus(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		handler  http.HandlerFunc
+		expected string
+	}{
+		{"Empty", func(w http.ResponseWriter, r *http.Request) {}, `"GET / HTTP/1.1" 200 -`},
+		{"Panic", func(w http.ResponseWriter, r *http.Request) { panic("oops") }, `"GET / HTTP/1.1" 500 -`},
+		{"PanicAfterWrite", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusAccepted)
+			panic("oops")
+		}, `"GET / HTTP/1.1" 202 -`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			handler := server.AccessLogger(&out, server.CommonLogFormat)(tt.handler)
+			func() {
+				defer func() {
+					if p := recover(); p != nil && p != "oops" {
+						t.Errorf("incorrect panic: expected=oops, got=%v", p)
+					}
+				}()
+				handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+			}()
+			if !strings.Contains(out.String(), tt.expected) {
+				t.Errorf("incorrect log line: expected to contain %q, got=%q", tt.expected, out.String())
+			}
+		})
+	}
+}
+
+// fieldRecorder is a server.FieldWriter that records everything written to it.
+type fieldRecorder struct {
+	mu     sync.Mutex
+	lines  []string
+	fields [][]server.LogField
+}
+
+func (f *fieldRecorder) Write(b []byte) (int, error) {
+	return len(b), f.WriteFields(b, nil)
+}
+
+func (f *fieldRecorder) WriteFields(line []byte, fields []server.LogField) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lines = append(f.lines, string(line))
+	f.fields = append(f.fields, fields)
+
+	return nil
+}
+
+func TestLoggerFieldWriter(t *testing.T) {
+	testHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	req := httptest.NewRequest("GET", "/brew", nil)
+	out := &fieldRecorder{}
+	server.AccessLogger(out, server.CommonLogFormat)(testHandler).ServeHTTP(httptest.NewRecorder(), req)
+
+	if len(out.lines) != 1 || !strings.Contains(out.lines[0], `"GET /brew HTTP/1.1" 418`) {
+		t.Fatalf("incorrect log lines: got=%q", out.lines)
+	}
+	fields := map[string]any{}
+	for _, f := range out.fields[0] {
+		fields[f.Key] = f.Value
+	}
+	if fields["status"] != http.StatusTeapot || fields["uri"] != "/brew" {
+		t.Errorf("incorrect fields: got=%v", out.fields[0])
+	}
+}
+
 func TestServerLoggerOption(t *testing.T) {
-	testLogger := log.New(os.Stdout, "test: ", log.LUTC)
+	var buf bytes.Buffer
 	testSrv := server.New(
-		server.ErrorLog(testLogger),
+		server.ErrorLog(slog.NewTextHandler(&buf, nil)),
 	)
 
-	if !reflect.DeepEqual(testLogger, testSrv.ErrorLog) {
-		t.Errorf("incorrect server error log: expected=%v, got=%v", testLogger, testSrv.ErrorLog)
+	if testSrv.ErrorLog == nil {
+		t.Fatal("server error log not set")
+	}
+	testSrv.ErrorLog.Print("http: something went wrong")
+	if got := buf.String(); !strings.Contains(got, `level=ERROR msg="http: something went wrong"`) {
+		t.Errorf("incorrect server error log output: got=%q", got)
 	}
 }
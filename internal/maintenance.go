@@ -0,0 +1,282 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultMaintenancePage is the page served by MaintenanceMode unless MaintenancePage is applied.
+const DefaultMaintenancePage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Down for maintenance</title>
+</head>
+<body>
+<h1>Down for maintenance</h1>
+<p>This site is undergoing maintenance and will be back shortly.</p>
+</body>
+</html>
+`
+
+// sentinelInterval is how often the sentinel file is checked for changes.
+const sentinelInterval = time.Second
+
+// Maintenance records whether all hosts, or only specific hosts, are in maintenance,
+// during which the MaintenanceMode middleware answers requests in place of the site.
+//
+// Hosts are put into maintenance through Enable, or by creating the sentinel file set
+// by MaintenanceFile, and a host is in maintenance if either says it is.
+type Maintenance struct {
+	page       []byte
+	retryAfter time.Duration
+	allow      []*net.IPNet
+	sentinel   string
+
+	mu    sync.RWMutex
+	all   bool
+	hosts map[string]bool
+
+	sentinelState      atomic.Pointer[sentinelState]
+	sentinelRefreshing atomic.Bool
+}
+
+// sentinelState is a snapshot of the hosts put into maintenance by the sentinel file, which is
+// replaced rather than modified so that requests can read it without locking.
+type sentinelState struct {
+	checked time.Time
+	mod     time.Time
+	present bool
+	all     bool
+	hosts   map[string]bool
+}
+
+// MaintenanceOption is a function that will apply some option to a Maintenance.
+type MaintenanceOption func(*Maintenance)
+
+// MaintenancePage creates a MaintenanceOption that sets the HTML page served to requests for
+// hosts in maintenance.
+func MaintenancePage(page []byte) MaintenanceOption {
+	return func(m *Maintenance) {
+		m.page = page
+	}
+}
+
+// MaintenanceRetryAfter creates a MaintenanceOption that sets how long clients are told to wait
+// before retrying through the Retry-After header. The default is five minutes, and the header
+// is not sent if d is zero or less.
+func MaintenanceRetryAfter(d time.Duration) MaintenanceOption {
+	return func(m *Maintenance) {
+		m.retryAfter = d
+	}
+}
+
+// MaintenanceAllow creates a MaintenanceOption that lets clients from the passed networks through
+// to the site while it is in maintenance, for example to check it before it is reopened.
+//
+// Clients are identified using ClientIP so the TrustedProxies middleware should wrap the
+// MaintenanceMode middleware when serving behind a proxy.
+func MaintenanceAllow(nets ...*net.IPNet) MaintenanceOption {
+	return func(m *Maintenance) {
+		m.allow = append(m.allow, nets...)
+	}
+}
+
+// MaintenanceFile creates a MaintenanceOption that puts hosts into maintenance while a sentinel
+// file exists at path. The file lists the hosts in maintenance, one per line, or puts every host
+// into maintenance if it lists none. Lines beginning with "#" are ignored.
+//
+// The file is checked at most once a second, and hosts it lists can only be taken out of
+// maintenance by changing or removing it.
+func MaintenanceFile(path string) MaintenanceOption {
+	return func(m *Maintenance) {
+		m.sentinel = path
+	}
+}
+
+// NewMaintenance creates a Maintenance with no hosts in maintenance, with the passed
+// MaintenanceOptions applied to it.
+func NewMaintenance(opts ...MaintenanceOption) *Maintenance {
+	m := &Maintenance{
+		page:       []byte(DefaultMaintenancePage),
+		retryAfter: 5 * time.Minute,
+		hosts:      make(map[string]bool),
+	}
+	for _, o := range opts {
+		o(m)
+	}
+	if m.sentinel != "" {
+		m.sentinelState.Store(m.loadSentinel(nil))
+	}
+
+	return m
+}
+
+// Enable puts the passed hosts into maintenance, or every host if none are passed.
+func (m *Maintenance) Enable(hosts ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(hosts) == 0 {
+		m.all = true
+	}
+	for _, h := range hosts {
+		m.hosts[strings.ToLower(h)] = true
+	}
+}
+
+// Disable takes the passed hosts out of maintenance, or every host if none are passed.
+//
+// Hosts cannot be taken out of maintenance individually while every host is in maintenance.
+func (m *Maintenance) Disable(hosts ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(hosts) == 0 {
+		m.all = false
+		clear(m.hosts)
+	}
+	for _, h := range hosts {
+		delete(m.hosts, strings.ToLower(h))
+	}
+}
+
+// Toggle takes every host out of maintenance if every host is in maintenance, otherwise it puts
+// every host into maintenance. It reports whether every host is now in maintenance.
+func (m *Maintenance) Toggle() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.all = !m.all
+	if !m.all {
+		clear(m.hosts)
+	}
+
+	return m.all
+}
+
+// Enabled reports whether host is in maintenance. Hosts are compared case insensitively.
+func (m *Maintenance) Enabled(host string) bool {
+	host = strings.ToLower(host)
+	m.mu.RLock()
+	enabled := m.all || m.hosts[host]
+	m.mu.RUnlock()
+	if enabled || m.sentinel == "" {
+		return enabled
+	}
+
+	all, hosts := m.readSentinel()
+	return all || hosts[host]
+}
+
+// State reports whether every host is in maintenance, along with the hosts that have been
+// put into maintenance individually, including through the sentinel file.
+func (m *Maintenance) State() (all bool, hosts []string) {
+	m.mu.RLock()
+	all = m.all
+	set := maps.Clone(m.hosts)
+	m.mu.RUnlock()
+	if m.sentinel != "" {
+		sentinelAll, sentinelHosts := m.readSentinel()
+		all = all || sentinelAll
+		maps.Copy(set, sentinelHosts)
+	}
+
+	return all, slices.Sorted(maps.Keys(set))
+}
+
+// readSentinel returns the hosts put into maintenance by the sentinel file, reading it again
+// if it has not been checked within the sentinel interval.
+//
+// Only one caller checks the file at a time, while others carry on with the previous snapshot.
+func (m *Maintenance) readSentinel() (all bool, hosts map[string]bool) {
+	state := m.sentinelState.Load()
+	if time.Since(state.checked) >= sentinelInterval && m.sentinelRefreshing.CompareAndSwap(false, true) {
+		state = m.loadSentinel(state)
+		m.sentinelState.Store(state)
+		m.sentinelRefreshing.Store(false)
+	}
+
+	return state.all, state.hosts
+}
+
+// loadSentinel returns a new snapshot of the sentinel file, reusing the hosts of the previous
+// snapshot if the file has not been modified since.
+func (m *Maintenance) loadSentinel(prev *sentinelState) *sentinelState {
+	state := &sentinelState{checked: time.Now()}
+	fi, err := os.Stat(m.sentinel)
+	if err != nil {
+		return state
+	}
+	state.present, state.mod = true, fi.ModTime()
+	if prev != nil && prev.present && prev.mod.Equal(state.mod) {
+		state.all, state.hosts = prev.all, prev.hosts
+		return state
+	}
+	b, err := os.ReadFile(m.sentinel)
+	if err != nil {
+		// Treat an unreadable sentinel as present rather than reopening the site by mistake.
+		b = nil
+	}
+	state.hosts = make(map[string]bool)
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			state.hosts[strings.ToLower(line)] = true
+		}
+	}
+	state.all = len(state.hosts) == 0
+
+	return state
+}
+
+// MaintenanceMode is a middleware generator function that serves the maintenance page of the
+// passed Maintenance with a 503 Service Unavailable status and a Retry-After header to requests
+// for hosts that are in maintenance, rather than calling the wrapped handler.
+//
+// Headers set by outer middleware, such as SecureHeaders, are kept on the maintenance response.
+func MaintenanceMode(m *Maintenance) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !m.Enabled(requestHost(r)) || containsIP(m.allow, ClientIP(r)) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			h := w.Header()
+			h.Set("Content-Type", "text/html; charset=utf-8")
+			h.Set("Content-Length", strconv.Itoa(len(m.page)))
+			h.Set("Cache-Control", "no-store")
+			if m.retryAfter > 0 {
+				h.Set("Retry-After", strconv.Itoa(int(m.retryAfter.Round(time.Second).Seconds())))
+			}
+			w.WriteHeader(http.StatusServiceUnavailable)
+			if r.Method != http.MethodHead {
+				w.Write(m.page)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal_test
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	server "github.com/admacleod/aws/internal"
+)
+
+func TestMaintenance(t *testing.T) {
+	m := server.NewMaintenance()
+	check := func(host string, expected bool) {
+		t.Helper()
+		if got := m.Enabled(host); got != expected {
+			t.Errorf("incorrect maintenance for %s: expected=%t, got=%t", host, expected, got)
+		}
+	}
+
+	check("example.com", false)
+	m.Enable("Example.com")
+	check("example.com", true)
+	check("example.org", false)
+	m.Enable()
+	check("example.org", true)
+	all, hosts := m.State()
+	if !all || !slices.Equal(hosts, []string{"example.com"}) {
+		t.Errorf("incorrect state: expected=%t %v, got=%t %v", true, []string{"example.com"}, all, hosts)
+	}
+	m.Disable()
+	check("example.com", false)
+	check("example.org", false)
+}
+
+func TestMaintenanceToggle(t *testing.T) {
+	m := server.NewMaintenance()
+	m.Enable("example.com")
+	if !m.Toggle() || !m.Enabled("example.org") {
+		t.Error("every host not in maintenance after first toggle")
+	}
+	if m.Toggle() || m.Enabled("example.com") {
+		t.Error("hosts still in maintenance after second toggle")
+	}
+}
+
+func TestMaintenanceFile(t *testing.T) {
+	dir := t.TempDir()
+	for _, tt := range []struct {
+		name     string
+		present  bool
+		contents string
+		expected map[string]bool
+	}{
+		{"Missing", false, "", map[string]bool{"a.example.com": false, "b.example.com": false}},
+		{"Empty", true, "", map[string]bool{"a.example.com": true, "b.example.com": true}},
+		{"Hosts", true, "# migrating\nA.example.com\n\n", map[string]bool{"a.example.com": true, "b.example.com": false}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name)
+			if tt.present {
+				if err := os.WriteFile(path, []byte(tt.contents), 0o644); err != nil {
+					t.Fatalf("could not create sentinel: %v", err)
+				}
+			}
+			m := server.NewMaintenance(server.MaintenanceFile(path))
+			for host, expected := range tt.expected {
+				if got := m.Enabled(host); got != expected {
+					t.Errorf("incorrect maintenance for %s: expected=%t, got=%t", host, expected, got)
+				}
+			}
+		})
+	}
+}
+
+func TestMaintenanceFileRefresh(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "maintenance")
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatalf("could not create sentinel: %v", err)
+	}
+	m := server.NewMaintenance(server.MaintenanceFile(path))
+	if !m.Enabled("example.com") {
+		t.Fatal("sentinel not read")
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("could not remove sentinel: %v", err)
+	}
+
+	// Requests racing the refresh see either snapshot, and the removal once it has been checked.
+	var wg sync.WaitGroup
+	deadline := time.Now().Add(1500 * time.Millisecond)
+	for range 4 {
+		wg.Go(func() {
+			for m.Enabled("example.com") && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+		})
+	}
+	wg.Wait()
+	if m.Enabled("example.com") {
+		t.Error("maintenance not ended after removing the sentinel")
+	}
+}
+
+func TestMaintenanceMode(t *testing.T) {
+	_, allowed, _ := net.ParseCIDR("192.0.2.0/24")
+	m := server.NewMaintenance(
+		server.MaintenancePage([]byte("<p>back soon</p>")),
+		server.MaintenanceRetryAfter(90*time.Second),
+		server.MaintenanceAllow(allowed),
+	)
+	m.Enable("down.example.com")
+	handler := server.SecureHeaders(server.MaintenanceMode(m)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})))
+
+	for _, tt := range []struct {
+		name     string
+		method   string
+		host     string
+		remote   string
+		expected int
+		body     string
+	}{
+		{"Up", http.MethodGet, "up.example.com", "198.51.100.1:1234", http.StatusNoContent, ""},
+		{"Down", http.MethodGet, "down.example.com", "198.51.100.1:1234", http.StatusServiceUnavailable, "<p>back soon</p>"},
+		{"DownWithPort", http.MethodGet, "down.example.com:443", "198.51.100.1:1234", http.StatusServiceUnavailable, "<p>back soon</p>"},
+		{"DownHead", http.MethodHead, "down.example.com", "198.51.100.1:1234", http.StatusServiceUnavailable, ""},
+		{"Allowed", http.MethodGet, "down.example.com", "192.0.2.1:1234", http.StatusNoContent, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(tt.method, "/", nil)
+			req.Host = tt.host
+			req.RemoteAddr = tt.remote
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.expected {
+				t.Errorf("incorrect status: expected=%d, got=%d", tt.expected, rec.Code)
+			}
+			if rec.Body.String() != tt.body {
+				t.Errorf("incorrect body: expected=%q, got=%q", tt.body, rec.Body)
+			}
+			if rec.Header().Get("X-Frame-Options") != "DENY" {
+				t.Error("secure headers missing from response")
+			}
+			if tt.expected != http.StatusServiceUnavailable {
+				return
+			}
+			if got := rec.Header().Get("Retry-After"); got != "90" {
+				t.Errorf("incorrect Retry-After: expected=%q, got=%q", "90", got)
+			}
+			if got := rec.Header().Get("Content-Type"); got != "text/html; charset=utf-8" {
+				t.Errorf("incorrect Content-Type: expected=%q, got=%q", "text/html; charset=utf-8", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,446 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// DefaultBuckets are the upper bounds, in seconds, of the request duration histogram buckets
+// used unless MetricsBuckets is applied.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Metrics collects counters, gauges, and histograms describing the server and serves them in
+// the Prometheus text exposition format, described at
+// https://prometheus.io/docs/instrumenting/exposition_formats/.
+//
+// Metrics is a http.Handler serving the current values, which should normally be served on a
+// separate listener from the site itself. A Metrics is safe for concurrent use.
+type Metrics struct {
+	hosts   map[string]bool
+	buckets []float64
+
+	mu       sync.Mutex
+	families map[string]*metricFamily
+	certs    map[string]*tls.Certificate
+}
+
+// metricFamily is a named metric and every labelled series of it.
+type metricFamily struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+	series map[string]*metricSeries
+	fn     func() float64
+}
+
+// metricSeries is the value of a metric for a single set of label values.
+type metricSeries struct {
+	labels  []string
+	value   float64
+	buckets []uint64
+	sum     float64
+}
+
+// MetricsOption is a function that will apply some option to a Metrics.
+type MetricsOption func(*Metrics)
+
+// MetricsHosts creates a MetricsOption that will limit the host label of request metrics to the
+// passed hosts, recording requests for any other host as "other".
+// Without this option any host requested by a client is recorded, which allows clients to
+// create unlimited series.
+func MetricsHosts(hosts ...string) MetricsOption {
+	return func(m *Metrics) {
+		m.hosts = make(map[string]bool, len(hosts))
+		for _, h := range hosts {
+			m.hosts[strings.ToLower(h)] = true
+		}
+	}
+}
+
+// MetricsBuckets creates a MetricsOption that will set the upper bounds, in seconds, of the
+// request duration histogram buckets.
+func MetricsBuckets(buckets ...float64) MetricsOption {
+	return func(m *Metrics) {
+		m.buckets = slices.Sorted(slices.Values(buckets))
+	}
+}
+
+// NewMetrics creates a Metrics with the passed MetricsOptions applied to it.
+func NewMetrics(opts ...MetricsOption) *Metrics {
+	m := &Metrics{
+		buckets:  DefaultBuckets,
+		families: make(map[string]*metricFamily),
+		certs:    make(map[string]*tls.Certificate),
+	}
+	for _, o := range opts {
+		o(m)
+	}
+	m.register("aws_http_requests_total", "Total HTTP requests served.", "counter", "host", "method", "status")
+	m.register("aws_http_response_bytes_total", "Total bytes written in HTTP response bodies.", "counter", "host", "method", "status")
+	m.register("aws_http_request_duration_seconds", "Time taken to serve HTTP requests.", "histogram", "host", "method", "status")
+	m.register("aws_http_requests_in_flight", "HTTP requests currently being served.", "gauge")
+	m.register("aws_tls_handshakes_total", "Completed TLS handshakes.", "counter", "version", "cipher", "resumed")
+	m.register("aws_tls_certificate_errors_total", "Failures to find a certificate for a TLS handshake.", "counter")
+	m.register("aws_tls_certificate_expiry_timestamp_seconds", "Expiry time of the certificate last served for each host.", "gauge", "host")
+	m.register("aws_server_errors_total", "Errors logged by the server, by kind.", "counter", "kind")
+
+	return m
+}
+
+// register adds a metric family, panicking if the name has already been registered.
+func (m *Metrics) register(name, help, kind string, labels ...string) *metricFamily {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.families[name]; ok {
+		panic(fmt.Sprintf("metric %s registered more than once", name))
+	}
+	f := &metricFamily{name: name, help: help, kind: kind, labels: labels, series: make(map[string]*metricSeries)}
+	m.families[name] = f
+
+	return f
+}
+
+// GaugeFunc registers a gauge whose value is read by calling f whenever the metrics are served.
+// It panics if a metric with the same name has already been registered.
+func (m *Metrics) GaugeFunc(name, help string, f func() float64) {
+	m.register(name, help, "gauge").fn = f
+}
+
+// CounterFunc registers a counter whose value is read by calling f whenever the metrics are served.
+// It panics if a metric with the same name has already been registered.
+func (m *Metrics) CounterFunc(name, help string, f func() float64) {
+	m.register(name, help, "counter").fn = f
+}
+
+// series returns the series of the named family with the passed label values, creating it if required.
+// The caller must hold m.mu.
+func (m *Metrics) series(name string, labels ...string) *metricSeries {
+	f := m.families[name]
+	key := strings.Join(labels, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &metricSeries{labels: labels}
+		if f.kind == "histogram" {
+			s.buckets = make([]uint64, len(m.buckets))
+		}
+		f.series[key] = s
+	}
+
+	return s
+}
+
+func (m *Metrics) add(name string, v float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.series(name, labels...).value += v
+}
+
+func (m *Metrics) set(name string, v float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.series(name, labels...).value = v
+}
+
+func (m *Metrics) observe(name string, v float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := m.series(name, labels...)
+	s.value++
+	s.sum += v
+	for i, upper := range m.buckets {
+		if v <= upper {
+			s.buckets[i]++
+		}
+	}
+}
+
+// host returns the host label for the request.
+func (m *Metrics) host(r *http.Request) string {
+	host := strings.ToLower(requestHost(r))
+	if m.hosts != nil && !m.hosts[host] {
+		return "other"
+	}
+
+	return host
+}
+
+// metricMethod limits the method label to the standard methods.
+func metricMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	}
+
+	return "OTHER"
+}
+
+// Instrument is a middleware generator function that will record the number, size, and duration
+// of responses from the wrapped handler, labelled by host, method, and status, in the passed Metrics.
+func Instrument(m *Metrics) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			m.add("aws_http_requests_in_flight", 1)
+			rw := NewResponseWriter(w)
+			defer func() {
+				p := recover()
+				m.add("aws_http_requests_in_flight", -1)
+				status := rw.Status()
+				switch {
+				case p != nil && !rw.Written():
+					status = http.StatusInternalServerError
+				case !rw.Written() && !rw.Hijacked():
+					status = http.StatusOK
+				}
+				labels := []string{m.host(r), metricMethod(r.Method), strconv.Itoa(status)}
+				m.add("aws_http_requests_total", 1, labels...)
+				m.add("aws_http_response_bytes_total", float64(rw.Bytes()), labels...)
+				m.observe("aws_http_request_duration_seconds", time.Since(start).Seconds(), labels...)
+				if p != nil {
+					panic(p)
+				}
+			}()
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// InstrumentTLS modifies a tls.Config to record completed handshakes, certificate errors, and the
+// expiry of served certificates in the passed Metrics.
+// Any existing GetCertificate and VerifyConnection callbacks are still called.
+//
+// The passed tls.Config is both modified and returned so that the function may
+// optionally be used in a functional chain.
+func InstrumentTLS(m *Metrics, t *tls.Config) *tls.Config {
+	getCertificate := t.GetCertificate
+	if getCertificate != nil {
+		t.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, err := getCertificate(hello)
+			if err != nil || cert == nil {
+				m.add("aws_tls_certificate_errors_total", 1)
+				return cert, err
+			}
+			if !slices.Contains(hello.SupportedProtos, acme.ALPNProto) {
+				// Challenge certificates are only served to the CA while validating a host.
+				m.recordCertificate(hello.ServerName, cert)
+			}
+			return cert, nil
+		}
+	}
+	verifyConnection := t.VerifyConnection
+	t.VerifyConnection = func(cs tls.ConnectionState) error {
+		if verifyConnection != nil {
+			if err := verifyConnection(cs); err != nil {
+				return err
+			}
+		}
+		m.add("aws_tls_handshakes_total", 1, tlsVersionName(cs.Version), tls.CipherSuiteName(cs.CipherSuite), strconv.FormatBool(cs.DidResume))
+		return nil
+	}
+
+	return t
+}
+
+// recordCertificate records the expiry of the certificate served for host, parsing it only when it
+// changes. Certificates for hosts other than those passed to MetricsHosts are not recorded.
+func (m *Metrics) recordCertificate(host string, cert *tls.Certificate) {
+	host = strings.ToLower(host)
+	if m.hosts != nil && !m.hosts[host] {
+		return
+	}
+	m.mu.Lock()
+	seen := m.certs[host] == cert
+	m.certs[host] = cert
+	m.mu.Unlock()
+	if seen || len(cert.Certificate) == 0 {
+		return
+	}
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return
+		}
+	}
+	m.set("aws_tls_certificate_expiry_timestamp_seconds", float64(leaf.NotAfter.Unix()), host)
+}
+
+// InstrumentErrors wraps the passed slog.Handler, as passed to ErrorLog, so that records are
+// counted in the passed Metrics by their kind attribute, such as tls_handshake for failed handshakes.
+// Records without a kind are counted as "other".
+func InstrumentErrors(m *Metrics, h slog.Handler) slog.Handler {
+	return &errorCounter{h, m}
+}
+
+type errorCounter struct {
+	slog.Handler
+	metrics *Metrics
+}
+
+func (c *errorCounter) Enabled(ctx context.Context, level slog.Level) bool {
+	// Every record is counted even if it is not written.
+	return true
+}
+
+func (c *errorCounter) Handle(ctx context.Context, r slog.Record) error {
+	kind := "other"
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == "kind" {
+			kind = a.Value.String()
+			return false
+		}
+		return true
+	})
+	c.metrics.add("aws_server_errors_total", 1, kind)
+	if !c.Handler.Enabled(ctx, r.Level) {
+		return nil
+	}
+
+	return c.Handler.Handle(ctx, r)
+}
+
+func (c *errorCounter) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &errorCounter{c.Handler.WithAttrs(attrs), c.metrics}
+}
+
+func (c *errorCounter) WithGroup(name string) slog.Handler {
+	return &errorCounter{c.Handler.WithGroup(name), c.metrics}
+}
+
+// ServeHTTP writes the current value of every metric in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(m.appendText(nil))
+}
+
+// appendText appends every metric, in name order, in the text exposition format.
+func (m *Metrics) appendText(b []byte) []byte {
+	m.mu.Lock()
+	families := make([]*metricFamily, 0, len(m.families))
+	for _, f := range m.families {
+		families = append(families, f)
+	}
+	m.mu.Unlock()
+	slices.SortFunc(families, func(a, b *metricFamily) int { return strings.Compare(a.name, b.name) })
+
+	for _, f := range families {
+		b = append(b, "# HELP "+f.name+" "...)
+		b = append(b, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(f.help)...)
+		b = append(b, "\n# TYPE "+f.name+" "+f.kind+"\n"...)
+		if f.fn != nil {
+			b = appendSample(b, f.name, nil, nil, f.fn())
+			continue
+		}
+
+		m.mu.Lock()
+		keys := make([]string, 0, len(f.series))
+		for k := range f.series {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		for _, k := range keys {
+			s := f.series[k]
+			if f.kind != "histogram" {
+				b = appendSample(b, f.name, f.labels, s.labels, s.value)
+				continue
+			}
+			labels := append(slices.Clone(f.labels), "le")
+			for i, upper := range m.buckets {
+				le := strconv.FormatFloat(upper, 'g', -1, 64)
+				b = appendSample(b, f.name+"_bucket", labels, append(slices.Clone(s.labels), le), float64(s.buckets[i]))
+			}
+			b = appendSample(b, f.name+"_bucket", labels, append(slices.Clone(s.labels), "+Inf"), s.value)
+			b = appendSample(b, f.name+"_sum", f.labels, s.labels, s.sum)
+			b = appendSample(b, f.name+"_count", f.labels, s.labels, s.value)
+		}
+		if len(f.series) == 0 && len(f.labels) == 0 && f.kind != "histogram" {
+			b = appendSample(b, f.name, nil, nil, 0)
+		}
+		m.mu.Unlock()
+	}
+
+	return b
+}
+
+// appendSample appends a single sample line.
+func appendSample(b []byte, name string, names, values []string, v float64) []byte {
+	b = append(b, name...)
+	if len(names) > 0 {
+		b = append(b, '{')
+		for i, n := range names {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			b = append(b, n...)
+			b = append(b, `="`...)
+			b = appendLabelValue(b, values[i])
+			b = append(b, '"')
+		}
+		b = append(b, '}')
+	}
+	b = append(b, ' ')
+	switch {
+	case math.IsInf(v, 1):
+		b = append(b, "+Inf"...)
+	case math.IsInf(v, -1):
+		b = append(b, "-Inf"...)
+	case math.IsNaN(v):
+		b = append(b, "NaN"...)
+	case v == math.Trunc(v) && math.Abs(v) < 1e15:
+		// Write whole numbers, such as timestamps, without an exponent.
+		b = strconv.AppendFloat(b, v, 'f', -1, 64)
+	default:
+		b = strconv.AppendFloat(b, v, 'g', -1, 64)
+	}
+
+	return append(b, '\n')
+}
+
+// appendLabelValue appends a label value with backslashes, quotes, and newlines escaped.
+func appendLabelValue(b []byte, v string) []byte {
+	for _, c := range []byte(v) {
+		switch c {
+		case '\\':
+			b = append(b, `\\`...)
+		case '"':
+			b = append(b, `\"`...)
+		case '\n':
+			b = append(b, `\n`...)
+		default:
+			b = append(b, c)
+		}
+	}
+
+	return b
+}
@@ -0,0 +1,191 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal_test
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	server "github.com/admacleod/aws/internal"
+)
+
+// scrape returns the text served by the Metrics.
+func scrape(t *testing.T, m *server.Metrics) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("incorrect content type: got=%q", ct)
+	}
+
+	return rec.Body.String()
+}
+
+// expectMetrics checks that every expected sample line appears in the scraped text.
+func expectMetrics(t *testing.T, text string, expected ...string) {
+	t.Helper()
+	lines := strings.Split(text, "\n")
+	for _, e := range expected {
+		found := false
+		for _, l := range lines {
+			if l == e {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("missing metric line %q in:\n%s", e, text)
+		}
+	}
+}
+
+func TestInstrument(t *testing.T) {
+	m := server.NewMetrics(server.MetricsHosts("example.com"), server.MetricsBuckets(0.1, 1))
+	handler := server.Instrument(m)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, "hello")
+	}))
+
+	for _, target := range []string{"http://example.com/", "http://example.com/", "http://example.com/missing", "http://other.example.com/"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", target, nil))
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("BREW", "http://EXAMPLE.com:8080/", nil))
+
+	expectMetrics(t, scrape(t, m),
+		"# TYPE aws_http_requests_total counter",
+		`aws_http_requests_total{host="example.com",method="GET",status="200"} 2`,
+		`aws_http_requests_total{host="example.com",method="GET",status="404"} 1`,
+		`aws_http_requests_total{host="other",method="GET",status="200"} 1`,
+		`aws_http_requests_total{host="example.com",method="OTHER",status="200"} 1`,
+		`aws_http_response_bytes_total{host="example.com",method="GET",status="200"} 10`,
+		"# TYPE aws_http_request_duration_seconds histogram",
+		`aws_http_request_duration_seconds_bucket{host="example.com",method="GET",status="200",le="0.1"} 2`,
+		`aws_http_request_duration_seconds_bucket{host="example.com",method="GET",status="200",le="1"} 2`,
+		`aws_http_request_duration_seconds_bucket{host="example.com",method="GET",status="200",le="+Inf"} 2`,
+		`aws_http_request_duration_seconds_count{host="example.com",method="GET",status="200"} 2`,
+		"aws_http_requests_in_flight 0",
+	)
+}
+
+func TestMetricsFuncs(t *testing.T) {
+	m := server.NewMetrics()
+	m.GaugeFunc("test_gauge", "A test gauge.", func() float64 { return 1.5 })
+	m.CounterFunc("test_counter", "A test counter.", func() float64 { return 42 })
+
+	expectMetrics(t, scrape(t, m),
+		"# HELP test_gauge A test gauge.",
+		"# TYPE test_gauge gauge",
+		"test_gauge 1.5",
+		"# TYPE test_counter counter",
+		"test_counter 42",
+	)
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic registering a metric twice")
+		}
+	}()
+	m.CounterFunc("test_gauge", "A duplicate metric.", func() float64 { return 0 })
+}
+
+func TestInstrumentTLS(t *testing.T) {
+	cert, pool := testCertificate(t)
+	m := server.NewMetrics()
+	cfg := server.InstrumentTLS(m, &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if hello.ServerName != "localhost" {
+				return nil, errors.New("unknown host")
+			}
+			return &cert, nil
+		},
+	})
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.TLS = cfg
+	ts.Config.ErrorLog = server.NewErrorLogger(slog.DiscardHandler)
+	ts.StartTLS()
+	defer ts.Close()
+	port := ts.Listener.Addr().(*net.TCPAddr).Port
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, MaxVersion: tls.VersionTLS13}}}
+	res, err := client.Get(fmt.Sprintf("https://localhost:%d/", port))
+	if err != nil {
+		t.Fatalf("could not get response: %v", err)
+	}
+	res.Body.Close()
+	client.CloseIdleConnections()
+
+	unknown := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{ServerName: "unknown.example.com", InsecureSkipVerify: true}}}
+	if _, err := unknown.Get(ts.URL); err == nil {
+		t.Error("expected handshake for unknown host to fail")
+	}
+
+	expectMetrics(t, scrape(t, m),
+		`aws_tls_handshakes_total{version="TLSv1.3",cipher="TLS_AES_128_GCM_SHA256",resumed="false"} 1`,
+		"aws_tls_certificate_errors_total 1",
+		fmt.Sprintf(`aws_tls_certificate_expiry_timestamp_seconds{host="localhost"} %d`, cert.Leaf.NotAfter.Unix()),
+	)
+}
+
+func TestInstrumentErrors(t *testing.T) {
+	m := server.NewMetrics()
+	logger := server.NewErrorLogger(server.InstrumentErrors(m, slog.DiscardHandler))
+	logger.Print("http: TLS handshake error from 192.0.2.1:1234: remote error: tls: bad certificate")
+	logger.Print("http: TLS handshake error from 192.0.2.1:1234: EOF")
+	logger.Print("http: something else")
+
+	expectMetrics(t, scrape(t, m),
+		`aws_server_errors_total{kind="tls_handshake"} 1`,
+		`aws_server_errors_total{kind="client_disconnect"} 1`,
+		`aws_server_errors_total{kind="other"} 1`,
+	)
+}
+
+func TestInstrumentTLSHosts(t *testing.T) {
+	cert, _ := testCertificate(t)
+	m := server.NewMetrics(server.MetricsHosts("localhost"))
+	cfg := server.InstrumentTLS(m, &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &cert, nil
+		},
+	})
+	for _, hello := range []*tls.ClientHelloInfo{
+		{ServerName: "other.example.com"},
+		{ServerName: "LOCALHOST", SupportedProtos: []string{"acme-tls/1"}},
+	} {
+		if _, err := cfg.GetCertificate(hello); err != nil {
+			t.Fatalf("could not get certificate: %v", err)
+		}
+	}
+	if text := scrape(t, m); strings.Contains(text, "aws_tls_certificate_expiry_timestamp_seconds{") {
+		t.Errorf("unexpected certificate expiry recorded:\n%s", text)
+	}
+
+	if _, err := cfg.GetCertificate(&tls.ClientHelloInfo{ServerName: "LOCALHOST", SupportedProtos: []string{"h2"}}); err != nil {
+		t.Fatalf("could not get certificate: %v", err)
+	}
+	expectMetrics(t, scrape(t, m),
+		fmt.Sprintf(`aws_tls_certificate_expiry_timestamp_seconds{host="localhost"} %d`, cert.Leaf.NotAfter.Unix()),
+	)
+}
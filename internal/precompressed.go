@@ -0,0 +1,176 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// precompressedEncodings are the content codings of precompressed files along with the suffix of
+// their file names, in order of preference.
+var precompressedEncodings = []struct {
+	coding string
+	suffix string
+}{
+	{"br", ".br"},
+	{"zstd", ".zst"},
+	{"gzip", ".gz"},
+}
+
+// PrecompressedFileServer returns a http.Handler that serves files from root as http.FileServer,
+// except that where a file has precompressed siblings, such as style.css.br, style.css.zst, or
+// style.css.gz for style.css, the one most preferred by the Accept-Encoding header of the request
+// is served in its place.
+//
+// Compressed files are served with the Content-Type of the original file, the Content-Encoding of
+// the compression, and Vary: Accept-Encoding. Range and conditional requests are answered from the
+// compressed file, as they apply to the encoded content. The original file must exist for its
+// compressed siblings to be served.
+func PrecompressedFileServer(root http.FileSystem) http.Handler {
+	fileServer := http.FileServer(root)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upath := r.URL.Path
+		if !strings.HasPrefix(upath, "/") {
+			upath = "/" + upath
+		}
+		if (r.Method != http.MethodGet && r.Method != http.MethodHead) || strings.HasSuffix(upath, "/index.html") {
+			// Leave other methods, and redirects from index pages, to the file server.
+			fileServer.ServeHTTP(w, r)
+			return
+		}
+		name := path.Clean(upath)
+		if strings.HasSuffix(upath, "/") {
+			name = path.Join(name, "index.html")
+		}
+		if !serveCompressed(w, r, root, name) {
+			fileServer.ServeHTTP(w, r)
+		}
+	})
+}
+
+// serveCompressed serves the preferred compressed sibling of the file at name, reporting false
+// without writing a response if the file should be served as normal.
+func serveCompressed(w http.ResponseWriter, r *http.Request, root http.FileSystem, name string) bool {
+	f, err := root.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err != nil || fi.IsDir() {
+		return false
+	}
+
+	var available []string
+	for _, enc := range precompressedEncodings {
+		if sibling, err := root.Open(name + enc.suffix); err == nil {
+			fi, err := sibling.Stat()
+			sibling.Close()
+			if err == nil && !fi.IsDir() {
+				available = append(available, enc.coding)
+			}
+		}
+	}
+	if len(available) == 0 {
+		return false
+	}
+	w.Header().Add("Vary", "Accept-Encoding")
+	coding := negotiateEncoding(r.Header, available)
+	if coding == "" {
+		return false
+	}
+
+	var suffix string
+	for _, enc := range precompressedEncodings {
+		if enc.coding == coding {
+			suffix = enc.suffix
+		}
+	}
+	cf, err := root.Open(name + suffix)
+	if err != nil {
+		return false
+	}
+	defer cf.Close()
+	cfi, err := cf.Stat()
+	if err != nil {
+		return false
+	}
+
+	h := w.Header()
+	if h.Get("Content-Type") == "" {
+		h.Set("Content-Type", contentType(name, f))
+	}
+	h.Set("Content-Encoding", coding)
+	http.ServeContent(w, r, name, cfi.ModTime(), cf)
+
+	return true
+}
+
+// contentType returns the media type of the file at name, from its extension or else by sniffing
+// its first 512 bytes.
+func contentType(name string, f io.Reader) string {
+	if ctype := mime.TypeByExtension(path.Ext(name)); ctype != "" {
+		return ctype
+	}
+	var buf [512]byte
+	n, _ := io.ReadFull(f, buf[:])
+
+	return http.DetectContentType(buf[:n])
+}
+
+// negotiateEncoding returns the content coding from available, listed in order of preference,
+// that the Accept-Encoding header most prefers, or an empty string if none are acceptable.
+func negotiateEncoding(h http.Header, available []string) string {
+	accepted := make(map[string]float64)
+	for _, value := range h.Values("Accept-Encoding") {
+		for _, element := range strings.Split(value, ",") {
+			coding, params, _ := strings.Cut(element, ";")
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			if coding == "" {
+				continue
+			}
+			q := 1.0
+			for _, param := range strings.Split(params, ";") {
+				key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if strings.EqualFold(key, "q") {
+					if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+						q = parsed
+					}
+				}
+			}
+			accepted[coding] = q
+		}
+	}
+
+	best, bestQ := "", 0.0
+	for _, coding := range available {
+		q, ok := accepted[coding]
+		if !ok {
+			q, ok = accepted["*"]
+		}
+		if !ok && coding == "gzip" {
+			q, ok = accepted["x-gzip"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+
+	return best
+}
@@ -0,0 +1,137 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	server "github.com/admacleod/aws/internal"
+)
+
+func TestPrecompressedFileServer(t *testing.T) {
+	dir := t.TempDir()
+	for name, contents := range map[string]string{
+		"style.css":     "body{}",
+		"style.css.br":  "brotli",
+		"style.css.zst": "zstandard",
+		"style.css.gz":  "gzipped",
+		"app.js":        "plain",
+		"data":          "<html></html>",
+		"data.gz":       "gzipped data",
+		"index.html":    "index",
+		"index.html.gz": "gzipped index",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0o644); err != nil {
+			t.Fatalf("could not create %s: %v", name, err)
+		}
+	}
+	handler := server.PrecompressedFileServer(http.Dir(dir))
+
+	for _, tt := range []struct {
+		name     string
+		path     string
+		accept   string
+		encoding string
+		ctype    string
+		vary     bool
+		body     string
+	}{
+		{"NoAcceptEncoding", "/style.css", "", "", "text/css; charset=utf-8", true, "body{}"},
+		{"Brotli", "/style.css", "gzip, deflate, br, zstd", "br", "text/css; charset=utf-8", true, "brotli"},
+		{"QualityPreference", "/style.css", "br;q=0.5, zstd;q=0.8, gzip", "gzip", "text/css; charset=utf-8", true, "gzipped"},
+		{"Zstandard", "/style.css", "zstd", "zstd", "text/css; charset=utf-8", true, "zstandard"},
+		{"Refused", "/style.css", "br;q=0, gzip;q=0", "", "text/css; charset=utf-8", true, "body{}"},
+		{"Wildcard", "/style.css", "*", "br", "text/css; charset=utf-8", true, "brotli"},
+		{"NoSiblings", "/app.js", "br, gzip", "", "text/javascript; charset=utf-8", false, "plain"},
+		{"SniffedType", "/data", "gzip", "gzip", "text/html; charset=utf-8", true, "gzipped data"},
+		{"Index", "/", "gzip", "gzip", "text/html; charset=utf-8", true, "gzipped index"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept-Encoding", tt.accept)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusOK {
+				t.Errorf("incorrect status: expected=%d, got=%d", http.StatusOK, rec.Code)
+			}
+			if got := rec.Header().Get("Content-Encoding"); got != tt.encoding {
+				t.Errorf("incorrect Content-Encoding: expected=%q, got=%q", tt.encoding, got)
+			}
+			if got := rec.Header().Get("Content-Type"); got != tt.ctype {
+				t.Errorf("incorrect Content-Type: expected=%q, got=%q", tt.ctype, got)
+			}
+			if got := rec.Header().Get("Vary") == "Accept-Encoding"; got != tt.vary {
+				t.Errorf("incorrect Vary: expected=%t, got=%t", tt.vary, got)
+			}
+			if rec.Body.String() != tt.body {
+				t.Errorf("incorrect body: expected=%q, got=%q", tt.body, rec.Body)
+			}
+		})
+	}
+}
+
+func TestPrecompressedFileServerRange(t *testing.T) {
+	dir := t.TempDir()
+	for name, contents := range map[string]string{
+		"file.txt":    "uncompressed",
+		"file.txt.gz": "0123456789",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0o644); err != nil {
+			t.Fatalf("could not create %s: %v", name, err)
+		}
+	}
+	modified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(dir, "file.txt.gz"), modified, modified); err != nil {
+		t.Fatalf("could not set modification time: %v", err)
+	}
+	handler := server.PrecompressedFileServer(http.Dir(dir))
+
+	for _, tt := range []struct {
+		name   string
+		header http.Header
+		status int
+		body   string
+	}{
+		{"Range", http.Header{"Range": {"bytes=2-5"}}, http.StatusPartialContent, "2345"},
+		{"UnsatisfiableRange", http.Header{"Range": {"bytes=20-"}}, http.StatusRequestedRangeNotSatisfiable, ""},
+		{"NotModified", http.Header{"If-Modified-Since": {modified.Format(http.TimeFormat)}}, http.StatusNotModified, ""},
+		{"Modified", http.Header{"If-Modified-Since": {modified.Add(-time.Hour).Format(http.TimeFormat)}}, http.StatusOK, "0123456789"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/file.txt", nil)
+			req.Header = tt.header
+			req.Header.Set("Accept-Encoding", "gzip")
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Errorf("incorrect status: expected=%d, got=%d", tt.status, rec.Code)
+			}
+			if tt.body != "" && rec.Body.String() != tt.body {
+				t.Errorf("incorrect body: expected=%q, got=%q", tt.body, rec.Body)
+			}
+			if got := rec.Header().Get("Content-Encoding"); tt.status < 300 && got != "gzip" {
+				t.Errorf("incorrect Content-Encoding: expected=%q, got=%q", "gzip", got)
+			}
+		})
+	}
+}
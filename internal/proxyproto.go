@@ -0,0 +1,370 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyV2Signature begins every PROXY protocol version 2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ErrProxyHeader is returned when reading from a connection from a trusted proxy that did not
+// begin with a valid PROXY protocol header.
+var ErrProxyHeader = errors.New("invalid PROXY protocol header")
+
+// ProxyProtocol creates a server.Option function that will read a PROXY protocol version 1 or 2
+// header from every connection accepted from one of the passed trusted networks, so that the
+// connection reports the original client and server addresses as its RemoteAddr and LocalAddr.
+//
+// The header is read before anything else on the connection, including any TLS handshake.
+// Connections from trusted networks must send a header within the passed timeout, or the server
+// ReadHeaderTimeout if the timeout is zero, otherwise they fail. Connections from anywhere else
+// are left untouched and any header they send is not interpreted.
+//
+// Headers are read concurrently as connections arrive, and connections are only returned from
+// Accept once their header has been read or has failed, so a slow proxy connection does not hold
+// up any other. At most MaxProxyHeaderReads headers are read at once, after which no more
+// connections are accepted until one of them finishes. Listener options applied after
+// ProxyProtocol, such as LimitConnections, therefore see the original client addresses.
+func ProxyProtocol(timeout time.Duration, nets ...*net.IPNet) Option {
+	return func(srv *Server) {
+		srv.listeners = append(srv.listeners, func(ln net.Listener) net.Listener {
+			headerTimeout := timeout
+			if headerTimeout == 0 {
+				headerTimeout = srv.ReadHeaderTimeout
+			}
+			return newProxyListener(ln, headerTimeout, nets)
+		})
+	}
+}
+
+// MaxProxyHeaderReads is the most PROXY protocol headers read concurrently by a listener.
+const MaxProxyHeaderReads = 1024
+
+// proxyAccept is the result of accepting a connection from the listener wrapped by a proxyListener.
+type proxyAccept struct {
+	conn net.Conn
+	err  error
+}
+
+type proxyListener struct {
+	net.Listener
+	trusted []*net.IPNet
+	timeout time.Duration
+
+	accepted  chan proxyAccept
+	reading   chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newProxyListener(ln net.Listener, timeout time.Duration, trusted []*net.IPNet) *proxyListener {
+	pl := &proxyListener{
+		Listener: ln,
+		trusted:  trusted,
+		timeout:  timeout,
+		accepted: make(chan proxyAccept),
+		reading:  make(chan struct{}, MaxProxyHeaderReads),
+		done:     make(chan struct{}),
+	}
+	go pl.acceptLoop()
+
+	return pl
+}
+
+// acceptLoop accepts connections from the wrapped listener, reading the header of each connection
+// from a trusted network in its own goroutine before passing it on to Accept.
+//
+// A slot in reading is taken before each connection is accepted, and given back once it is known
+// not to need a header or its header has been read, bounding the goroutines reading headers.
+func (pl *proxyListener) acceptLoop() {
+	for {
+		select {
+		case pl.reading <- struct{}{}:
+		case <-pl.done:
+			return
+		}
+		conn, err := pl.Listener.Accept()
+		if err != nil {
+			<-pl.reading
+			if !pl.deliver(proxyAccept{err: err}) {
+				return
+			}
+			// The server retries after temporary errors, so keep accepting as it would.
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		if !containsIP(pl.trusted, remoteIP(conn.RemoteAddr().String())) {
+			<-pl.reading
+			if !pl.deliver(proxyAccept{conn: conn}) {
+				conn.Close()
+				return
+			}
+			continue
+		}
+		go func() {
+			pc := &proxyConn{Conn: conn, timeout: pl.timeout}
+			// A connection whose header fails is still returned so that the failure is reported
+			// by the server when it first reads from the connection.
+			pc.init()
+			<-pl.reading
+			if !pl.deliver(proxyAccept{conn: pc}) {
+				conn.Close()
+			}
+		}()
+	}
+}
+
+// deliver passes the result of an accept to Accept, reporting false if the listener was closed first.
+func (pl *proxyListener) deliver(a proxyAccept) bool {
+	select {
+	case pl.accepted <- a:
+		return true
+	case <-pl.done:
+		return false
+	}
+}
+
+func (pl *proxyListener) Accept() (net.Conn, error) {
+	select {
+	case a := <-pl.accepted:
+		return a.conn, a.err
+	case <-pl.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (pl *proxyListener) Close() error {
+	pl.closeOnce.Do(func() { close(pl.done) })
+
+	return pl.Listener.Close()
+}
+
+// proxyConn lazily reads the PROXY protocol header on first use.
+type proxyConn struct {
+	net.Conn
+	timeout time.Duration
+
+	once   sync.Once
+	r      *bufio.Reader
+	remote net.Addr
+	local  net.Addr
+	err    error
+}
+
+func (pc *proxyConn) init() {
+	pc.once.Do(func() {
+		if pc.timeout > 0 {
+			pc.Conn.SetReadDeadline(time.Now().Add(pc.timeout))
+			defer pc.Conn.SetReadDeadline(time.Time{})
+		}
+		pc.r = bufio.NewReader(pc.Conn)
+		pc.remote, pc.local, pc.err = readProxyHeader(pc.r)
+		if pc.err != nil {
+			// Nothing should be sent back to a connection we cannot attribute to a client.
+			pc.Conn.Close()
+			pc.err = fmt.Errorf("%w from %s: %v", ErrProxyHeader, pc.Conn.RemoteAddr(), pc.err)
+		}
+	})
+}
+
+func (pc *proxyConn) Read(b []byte) (int, error) {
+	pc.init()
+	if pc.err != nil {
+		return 0, pc.err
+	}
+	// Only go through the buffer for whatever was read along with the header.
+	if pc.r.Buffered() > 0 {
+		return pc.r.Read(b)
+	}
+
+	return pc.Conn.Read(b)
+}
+
+// RemoteAddr returns the client address given in the PROXY protocol header, or the address
+// of the proxy if the header did not include one.
+func (pc *proxyConn) RemoteAddr() net.Addr {
+	pc.init()
+	if pc.remote != nil {
+		return pc.remote
+	}
+
+	return pc.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the destination address given in the PROXY protocol header, or the address
+// of the connection if the header did not include one.
+func (pc *proxyConn) LocalAddr() net.Addr {
+	pc.init()
+	if pc.local != nil {
+		return pc.local
+	}
+
+	return pc.Conn.LocalAddr()
+}
+
+// ReadFrom allows the underlying connection to use sendfile where it is able to.
+func (pc *proxyConn) ReadFrom(r io.Reader) (int64, error) {
+	if rf, ok := pc.Conn.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+
+	return io.Copy(struct{ io.Writer }{pc.Conn}, r)
+}
+
+// CloseWrite shuts down the writing side of the underlying connection where it is able to, as
+// the server does before closing a connection so that the client receives the whole response.
+func (pc *proxyConn) CloseWrite() error {
+	if cw, ok := pc.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+
+	return errors.ErrUnsupported
+}
+
+// readProxyHeader reads a version 1 or version 2 PROXY protocol header, returning the source and
+// destination addresses. The addresses are nil if the header describes an unknown or local connection.
+func readProxyHeader(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	// Every valid header is longer than the version 2 signature.
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, nil, err
+	}
+	if bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+
+	return readProxyV1(r)
+}
+
+// readProxyV1 reads the human-readable header, for example:
+//
+//	PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n
+func readProxyV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	// The longest possible header is 107 bytes including the CRLF.
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("version 1 header is not terminated")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return nil, nil, errors.New("missing signature")
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, nil, fmt.Errorf("unsupported protocol %q", fields[1])
+	}
+	if len(fields) != 6 {
+		return nil, nil, errors.New("incorrect number of fields")
+	}
+
+	src, err := parseProxyV1Addr(fields[1], fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseProxyV1Addr(fields[1], fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return src, dst, nil
+}
+
+func parseProxyV1Addr(proto, ip, port string) (*net.TCPAddr, error) {
+	addr := &net.TCPAddr{IP: net.ParseIP(ip)}
+	if addr.IP == nil || (proto == "TCP4") != (addr.IP.To4() != nil) {
+		return nil, fmt.Errorf("invalid %s address %q", proto, ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", port)
+	}
+	addr.Port = int(p)
+
+	return addr, nil
+}
+
+// readProxyV2 reads the binary header.
+func readProxyV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("unsupported version %d", hdr[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+
+	switch hdr[12] & 0x0f {
+	case 0x0: // LOCAL, such as health checks from the proxy itself
+		return nil, nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, nil, fmt.Errorf("unsupported command %d", hdr[12]&0x0f)
+	}
+
+	var size int
+	switch hdr[13] {
+	case 0x11, 0x12: // TCP or UDP over IPv4
+		size = net.IPv4len
+	case 0x21, 0x22: // TCP or UDP over IPv6
+		size = net.IPv6len
+	default:
+		// Unix sockets and unspecified families carry no usable addresses.
+		return nil, nil, nil
+	}
+	if len(body) < 2*size+4 {
+		return nil, nil, errors.New("version 2 header is too short for its address family")
+	}
+	src := &net.TCPAddr{
+		IP:   net.IP(bytes.Clone(body[:size])),
+		Port: int(binary.BigEndian.Uint16(body[2*size:])),
+	}
+	dst := &net.TCPAddr{
+		IP:   net.IP(bytes.Clone(body[size : 2*size])),
+		Port: int(binary.BigEndian.Uint16(body[2*size+2:])),
+	}
+
+	return src, dst, nil
+}
@@ -0,0 +1,228 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	server "github.com/admacleod/aws/internal"
+)
+
+// proxyV2 builds a version 2 PROXY protocol header.
+func proxyV2(cmd, family byte, src, dst net.IP, sport, dport uint16) []byte {
+	var addrs []byte
+	addrs = append(addrs, src...)
+	addrs = append(addrs, dst...)
+	addrs = binary.BigEndian.AppendUint16(addrs, sport)
+	addrs = binary.BigEndian.AppendUint16(addrs, dport)
+	// Include a TLV that should be skipped.
+	addrs = append(addrs, 0x04, 0x00, 0x01, 0xff)
+
+	hdr := []byte("\r\n\r\n\x00\r\nQUIT\n")
+	hdr = append(hdr, 0x20|cmd, family)
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(len(addrs)))
+
+	return append(hdr, addrs...)
+}
+
+func TestProxyProtocol(t *testing.T) {
+	_, trusted, _ := net.ParseCIDR("127.0.0.1/32")
+	addr := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	testSrv := server.New(
+		server.ProxyProtocol(100*time.Millisecond, trusted),
+		server.ErrorLog(slog.DiscardHandler),
+		server.Handle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s %s", r.RemoteAddr, r.Context().Value(http.LocalAddrContextKey))
+		})),
+	)
+	testSrv.Addr = addr
+	startServer(t, testSrv, addr, testSrv.ListenAndServe)
+
+	v4src, v4dst := net.IPv4(192, 0, 2, 1).To4(), net.IPv4(198, 51, 100, 1).To4()
+	v6src, v6dst := net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")
+	for _, tt := range []struct {
+		name     string
+		source   string
+		header   []byte
+		expected string
+		status   int
+	}{
+		{"V1TCP4", "127.0.0.1", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"), "192.0.2.1:56324 198.51.100.1:443", 200},
+		{"V1TCP6", "127.0.0.1", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"), "[2001:db8::1]:56324 [2001:db8::2]:443", 200},
+		{"V1Unknown", "127.0.0.1", []byte("PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n"), "127.0.0.1:", 200},
+		{"V1Mismatched", "127.0.0.1", []byte("PROXY TCP4 2001:db8::1 2001:db8::2 56324 443\r\n"), "", 0},
+		{"V1BadPort", "127.0.0.1", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 99999 443\r\n"), "", 0},
+		{"V1Unterminated", "127.0.0.1", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n"), "", 0},
+		{"V2TCP4", "127.0.0.1", proxyV2(0x1, 0x11, v4src, v4dst, 56324, 443), "192.0.2.1:56324 198.51.100.1:443", 200},
+		{"V2TCP6", "127.0.0.1", proxyV2(0x1, 0x21, v6src, v6dst, 56324, 443), "[2001:db8::1]:56324 [2001:db8::2]:443", 200},
+		{"V2Local", "127.0.0.1", proxyV2(0x0, 0x11, v4src, v4dst, 56324, 443), "127.0.0.1:", 200},
+		{"V2BadCommand", "127.0.0.1", proxyV2(0x5, 0x11, v4src, v4dst, 56324, 443), "", 0},
+		{"V2Truncated", "127.0.0.1", proxyV2(0x1, 0x21, v4src, v4dst, 56324, 443), "", 0},
+		{"MissingHeader", "127.0.0.1", nil, "", 0},
+		{"Timeout", "127.0.0.1", []byte("PROXY TCP4"), "", 0},
+		{"Untrusted", "127.0.0.2", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"), "", 400},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := dialFrom(t, tt.source, addr)
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(time.Second))
+
+			if _, err := conn.Write(tt.header); err != nil {
+				t.Fatalf("could not write header: %v", err)
+			}
+			if tt.name != "Timeout" {
+				io.WriteString(conn, "GET / HTTP/1.1\r\nHost: test.example.com\r\n\r\n")
+			}
+			res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if tt.status == 0 {
+				if err == nil {
+					t.Errorf("connection was not closed: got status=%d", res.StatusCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("could not read response: %v", err)
+			}
+			body, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+
+			if res.StatusCode != tt.status {
+				t.Errorf("incorrect status: expected=%d, got=%d", tt.status, res.StatusCode)
+			}
+			if !strings.HasPrefix(string(body), tt.expected) {
+				t.Errorf("incorrect addresses: expected=%s, got=%s", tt.expected, body)
+			}
+		})
+	}
+}
+
+func TestProxyProtocolBeforeTLS(t *testing.T) {
+	_, trusted, _ := net.ParseCIDR("127.0.0.1/32")
+	cert, pool := testCertificate(t)
+	addr := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	testSrv := server.New(
+		server.ProxyProtocol(time.Second, trusted),
+		server.ErrorLog(slog.DiscardHandler),
+		server.TLS(&tls.Config{Certificates: []tls.Certificate{cert}}),
+		server.Handle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, r.RemoteAddr)
+		})),
+	)
+	testSrv.Addr = addr
+	startServer(t, testSrv, addr, func() error { return testSrv.ListenAndServeTLS("", "") })
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: pool},
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			_, err = io.WriteString(conn, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n")
+			return conn, err
+		},
+	}}
+	res, err := client.Get(fmt.Sprintf("https://%s/", addr))
+	if err != nil {
+		t.Fatalf("could not make request: %v", err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+
+	if string(body) != "192.0.2.1:56324" {
+		t.Errorf("incorrect remote address: expected=%s, got=%s", "192.0.2.1:56324", body)
+	}
+}
+
+func TestProxyProtocolIdleConnection(t *testing.T) {
+	_, trusted, _ := net.ParseCIDR("127.0.0.1/32")
+	addr := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	testSrv := server.New(
+		server.ProxyProtocol(2*time.Second, trusted),
+		server.LimitConnections(server.NewConnLimiter(0, 0)),
+		server.ErrorLog(slog.DiscardHandler),
+		server.Handle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, r.RemoteAddr)
+		})),
+	)
+	testSrv.Addr = addr
+	startServer(t, testSrv, addr, testSrv.ListenAndServe)
+
+	// A connection that never sends its header must not hold up the next one.
+	idle := dialFrom(t, "127.0.0.1", addr)
+	defer idle.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	conn := dialFrom(t, "127.0.0.1", addr)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(500 * time.Millisecond))
+	io.WriteString(conn, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nGET / HTTP/1.1\r\nHost: test.example.com\r\n\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("could not read response: %v", err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+
+	if string(body) != "192.0.2.1:56324" {
+		t.Errorf("incorrect remote address: expected=%s, got=%s", "192.0.2.1:56324", body)
+	}
+}
+
+func TestProxyProtocolCloseWrite(t *testing.T) {
+	_, trusted, _ := net.ParseCIDR("127.0.0.1/32")
+	addr := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	testSrv := server.New(
+		server.ProxyProtocol(time.Second, trusted),
+		server.ErrorLog(slog.DiscardHandler),
+		server.Handle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})),
+	)
+	testSrv.Addr = addr
+	conns := make(chan net.Conn, 1)
+	testSrv.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		// Every connection from the trusted network, including the readiness probe, is wrapped.
+		select {
+		case conns <- c:
+		default:
+		}
+		return ctx
+	}
+	startServer(t, testSrv, addr, testSrv.ListenAndServe)
+
+	conn := dialFrom(t, "127.0.0.1", addr)
+	defer conn.Close()
+	io.WriteString(conn, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n")
+	select {
+	case c := <-conns:
+		if _, ok := c.(interface{ CloseWrite() error }); !ok {
+			t.Error("connection does not implement CloseWrite")
+		}
+		if _, ok := c.(io.ReaderFrom); !ok {
+			t.Error("connection does not implement ReadFrom")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("connection not accepted")
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rate defines a token bucket: clients may make Burst requests at once, after which
+// they are limited to PerSecond requests each second.
+//
+// A PerSecond of zero or less means requests are not limited.
+type Rate struct {
+	PerSecond float64
+	Burst     int
+}
+
+// ParseRate parses a Rate from a string of the form "PERSECOND[:BURST]", for example "10:20".
+// If no burst is given then it defaults to the per second rate, rounded up.
+func ParseRate(s string) (Rate, error) {
+	perSecond, burst, hasBurst := strings.Cut(s, ":")
+	rate := Rate{}
+	var err error
+	if rate.PerSecond, err = strconv.ParseFloat(perSecond, 64); err != nil {
+		return Rate{}, fmt.Errorf("invalid rate %q: %w", s, err)
+	}
+	if !hasBurst {
+		rate.Burst = int(math.Ceil(rate.PerSecond))
+		return rate, nil
+	}
+	if rate.Burst, err = strconv.Atoi(burst); err != nil {
+		return Rate{}, fmt.Errorf("invalid burst %q: %w", s, err)
+	}
+	if rate.Burst < 1 {
+		return Rate{}, errors.New("invalid burst " + strconv.Quote(s) + ": must be at least 1")
+	}
+
+	return rate, nil
+}
+
+// RateLimiter keeps a token bucket for every client IP address, and for every pattern
+// that the client has made requests to, limiting how quickly each client may make requests.
+//
+// Clients are identified using ClientIP so the TrustedProxies middleware should wrap the
+// RateLimit middleware when serving behind a proxy.
+type RateLimiter struct {
+	rate     Rate
+	patterns []ratePattern
+	sweep    time.Duration
+
+	mu        sync.Mutex
+	buckets   map[bucketKey]*bucket
+	lastSweep time.Time
+}
+
+// RateLimiterOption is a function that will apply some option to a RateLimiter.
+type RateLimiterOption func(*RateLimiter)
+
+// NewRateLimiter creates a RateLimiter applying the passed default Rate to all requests,
+// with the passed RateLimiterOptions applied to it.
+func NewRateLimiter(rate Rate, opts ...RateLimiterOption) *RateLimiter {
+	l := &RateLimiter{
+		rate:    rate,
+		sweep:   time.Minute,
+		buckets: make(map[bucketKey]*bucket),
+	}
+	for _, o := range opts {
+		o(l)
+	}
+
+	return l
+}
+
+// RateFor creates a RateLimiterOption that will apply a different Rate to requests matching
+// the passed pattern, with buckets kept separate from those of the default rate.
+//
+// Patterns take the form "HOST", "/PATH", or "HOST/PATH", where PATH is matched as a prefix.
+// The most specific pattern is used, with host and path patterns preferred to path only patterns,
+// and path only patterns preferred to host only patterns.
+func RateFor(pattern string, rate Rate) RateLimiterOption {
+	return func(l *RateLimiter) {
+		p := ratePattern{pattern: pattern, rate: rate}
+		if i := strings.Index(pattern, "/"); i >= 0 {
+			p.host, p.path = pattern[:i], pattern[i:]
+		} else {
+			p.host = pattern
+		}
+		p.host = strings.ToLower(p.host)
+		l.patterns = append(l.patterns, p)
+	}
+}
+
+// RateLimitSweep creates a RateLimiterOption that will set how often buckets are checked for eviction.
+// Buckets that have completely refilled since they were last used are evicted as they hold no state.
+func RateLimitSweep(interval time.Duration) RateLimiterOption {
+	return func(l *RateLimiter) {
+		l.sweep = interval
+	}
+}
+
+// Buckets returns the number of token buckets currently held by the RateLimiter.
+func (l *RateLimiter) Buckets() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return len(l.buckets)
+}
+
+// RateLimit is a middleware generator function that will limit the rate of requests made by each client
+// to the wrapped handler using the passed RateLimiter.
+//
+// Requests over the limit are responded to with 429 Too Many Requests and a Retry-After header indicating
+// how many seconds the client should wait before trying again.
+func RateLimit(l *RateLimiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if wait, ok := l.allow(r, time.Now()); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+type ratePattern struct {
+	pattern string
+	host    string
+	path    string
+	rate    Rate
+}
+
+type bucketKey struct {
+	client  string
+	pattern string
+}
+
+type bucket struct {
+	rate   Rate
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens accrued since the bucket was last used.
+func (b *bucket) refill(now time.Time) {
+	b.tokens = math.Min(float64(b.rate.Burst), b.tokens+now.Sub(b.last).Seconds()*b.rate.PerSecond)
+	b.last = now
+}
+
+// allow reports whether the request may proceed, and if not how long the client should wait.
+func (l *RateLimiter) allow(r *http.Request, now time.Time) (time.Duration, bool) {
+	p := l.match(r)
+	if p.rate.PerSecond <= 0 {
+		return 0, true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.evict(now)
+	key := bucketKey{ClientIP(r), p.pattern}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{rate: p.rate, tokens: float64(p.rate.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.refill(now)
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / b.rate.PerSecond * float64(time.Second)), false
+	}
+	b.tokens--
+
+	return 0, true
+}
+
+// evict removes any buckets that have refilled completely, at most once per sweep interval.
+// It must be called with the mutex held.
+func (l *RateLimiter) evict(now time.Time) {
+	if now.Sub(l.lastSweep) < l.sweep {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		b.refill(now)
+		if b.tokens >= float64(b.rate.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// match finds the most specific pattern for the request, or the default rate.
+func (l *RateLimiter) match(r *http.Request) ratePattern {
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	best, bestScore := ratePattern{rate: l.rate}, 0
+	for _, p := range l.patterns {
+		if p.host != "" && p.host != host {
+			continue
+		}
+		if !strings.HasPrefix(r.URL.Path, p.path) {
+			continue
+		}
+		score := 1
+		if p.path != "" {
+			score = 2 + len(p.path)
+			if p.host != "" {
+				score += 1 << 16
+			}
+		}
+		if score > bestScore {
+			best, bestScore = p, score
+		}
+	}
+
+	return best
+}
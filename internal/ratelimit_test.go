@@ -0,0 +1,123 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal_test
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	server "github.com/admacleod/aws/internal"
+)
+
+func TestParseRate(t *testing.T) {
+	for _, tt := range []struct {
+		in       string
+		expected server.Rate
+		err      bool
+	}{
+		{"10:20", server.Rate{PerSecond: 10, Burst: 20}, false},
+		{"0.5", server.Rate{PerSecond: 0.5, Burst: 1}, false},
+		{"5", server.Rate{PerSecond: 5, Burst: 5}, false},
+		{"1:0", server.Rate{}, true},
+		{"fast", server.Rate{}, true},
+		{"1:lots", server.Rate{}, true},
+	} {
+		got, err := server.ParseRate(tt.in)
+		if (err != nil) != tt.err {
+			t.Errorf("incorrect error for %q: expected error=%t, got=%v", tt.in, tt.err, err)
+		}
+		if got != tt.expected {
+			t.Errorf("incorrect rate for %q: expected=%+v, got=%+v", tt.in, tt.expected, got)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	limiter := server.NewRateLimiter(
+		server.Rate{PerSecond: 1.0 / 3600, Burst: 2},
+		server.RateFor("/unlimited/", server.Rate{}),
+		server.RateFor("/strict/", server.Rate{PerSecond: 1.0 / 3600, Burst: 1}),
+		server.RateFor("example.com", server.Rate{PerSecond: 1.0 / 3600, Burst: 3}),
+	)
+	handler := server.ChainMiddleware(
+		server.RateLimit(limiter),
+		server.TrustedProxies(proxies),
+	)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	request := func(remote, host, path, forwarded string) *http.Response {
+		req := httptest.NewRequest("GET", "http://"+host+path, nil)
+		req.RemoteAddr = remote
+		if forwarded != "" {
+			req.Header.Set("X-Forwarded-For", forwarded)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	for _, tt := range []struct {
+		name      string
+		remote    string
+		host      string
+		path      string
+		forwarded string
+		expected  []int
+	}{
+		{"Default", "192.0.2.1:1234", "test.example.org", "/", "", []int{200, 200, 429}},
+		{"SeparateClient", "192.0.2.2:1234", "test.example.org", "/", "", []int{200, 200, 429}},
+		{"Unlimited", "192.0.2.1:1234", "test.example.org", "/unlimited/file", "", []int{200, 200, 200, 200}},
+		{"Path", "192.0.2.1:1234", "test.example.org", "/strict/file", "", []int{200, 429}},
+		{"Host", "192.0.2.1:1234", "example.com:443", "/", "", []int{200, 200, 200, 429}},
+		{"PathOverHost", "192.0.2.3:1234", "example.com", "/strict/", "", []int{200, 429}},
+		{"TrustedProxy", "10.0.0.1:1234", "test.example.org", "/", "192.0.2.4, 10.1.1.1", []int{200, 200, 429}},
+		{"OtherBehindTrustedProxy", "10.0.0.1:1234", "test.example.org", "/", "192.0.2.5", []int{200, 200, 429}},
+		{"UntrustedProxy", "192.0.2.6:1234", "test.example.org", "/", "192.0.2.7", []int{200, 200, 429}},
+		{"SpoofedForUntrustedProxy", "192.0.2.6:1234", "test.example.org", "/", "192.0.2.8", []int{429}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for i, expected := range tt.expected {
+				res := request(tt.remote, tt.host, tt.path, tt.forwarded)
+				if res.StatusCode != expected {
+					t.Errorf("incorrect status for request %d: expected=%d, got=%d", i+1, expected, res.StatusCode)
+				}
+				if res.StatusCode == http.StatusTooManyRequests && res.Header.Get("Retry-After") != "3600" {
+					t.Errorf("incorrect Retry-After: expected=3600, got=%s", res.Header.Get("Retry-After"))
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimitEviction(t *testing.T) {
+	limiter := server.NewRateLimiter(
+		server.Rate{PerSecond: 1000, Burst: 1},
+		server.RateLimitSweep(10*time.Millisecond),
+	)
+	handler := server.RateLimit(limiter)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, remote := range []string{"192.0.2.1:1234", "192.0.2.2:1234"} {
+		req := httptest.NewRequest("GET", "http://test.example.com", nil)
+		req.RemoteAddr = remote
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if got := limiter.Buckets(); got != 1 {
+		t.Errorf("incorrect number of buckets: expected=1, got=%d", got)
+	}
+}
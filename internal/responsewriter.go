@@ -0,0 +1,148 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// ResponseWriter wraps a http.ResponseWriter, recording the status, size, and timing of the response
+// for use by middleware.
+//
+// The optional http.Flusher, http.Hijacker, http.Pusher, and io.ReaderFrom interfaces are always
+// implemented and passed through to the wrapped http.ResponseWriter, returning http.ErrNotSupported
+// where it does not support them, so that streaming responses, connection upgrades, and sendfile
+// keep working when wrapped. Unwrap allows http.ResponseController to reach the wrapped writer.
+type ResponseWriter struct {
+	http.ResponseWriter
+
+	status    int
+	bytes     int64
+	firstByte time.Time
+	hijacked  bool
+}
+
+// NewResponseWriter wraps the passed http.ResponseWriter.
+func NewResponseWriter(w http.ResponseWriter) *ResponseWriter {
+	return &ResponseWriter{ResponseWriter: w}
+}
+
+// Status returns the status code of the response, or zero if the header has not been written.
+// Informational 1xx responses other than 101 Switching Protocols are not recorded.
+func (w *ResponseWriter) Status() int {
+	return w.status
+}
+
+// Written reports whether the header of the response has been written.
+func (w *ResponseWriter) Written() bool {
+	return w.status != 0
+}
+
+// Bytes returns the number of bytes written in the response body.
+func (w *ResponseWriter) Bytes() int64 {
+	return w.bytes
+}
+
+// FirstByte returns the time that the header of the response was written, or the zero time if
+// it has not been.
+func (w *ResponseWriter) FirstByte() time.Time {
+	return w.firstByte
+}
+
+// Hijacked reports whether the connection has been taken over by the handler.
+func (w *ResponseWriter) Hijacked() bool {
+	return w.hijacked
+}
+
+// record records the status of the response the first time a final header is written.
+func (w *ResponseWriter) record(code int) {
+	if w.status != 0 || (code >= 100 && code < 200 && code != http.StatusSwitchingProtocols) {
+		return
+	}
+	w.status = code
+	w.firstByte = time.Now()
+}
+
+func (w *ResponseWriter) WriteHeader(code int) {
+	w.record(code)
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *ResponseWriter) Write(b []byte) (int, error) {
+	w.record(http.StatusOK)
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+
+	return n, err
+}
+
+// ReadFrom copies the response body from src, using the io.ReaderFrom of the wrapped writer where
+// possible so that files may be sent without copying them through user space.
+func (w *ResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	w.record(http.StatusOK)
+	var n int64
+	var err error
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(src)
+	} else {
+		// Hide any ReadFrom on the wrapped writer so that io.Copy does not recurse.
+		n, err = io.Copy(struct{ io.Writer }{w.ResponseWriter}, src)
+	}
+	w.bytes += n
+
+	return n, err
+}
+
+// Flush sends any buffered data to the client, doing nothing if the wrapped writer does not support flushing.
+func (w *ResponseWriter) Flush() {
+	_ = w.FlushError()
+}
+
+// FlushError sends any buffered data to the client, returning http.ErrNotSupported if the wrapped
+// writer does not support flushing.
+func (w *ResponseWriter) FlushError() error {
+	w.record(http.StatusOK)
+
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Hijack lets the handler take over the connection, returning http.ErrNotSupported if the wrapped
+// writer does not support hijacking.
+func (w *ResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil {
+		w.hijacked = true
+	}
+
+	return conn, rw, err
+}
+
+// Push initiates an HTTP/2 server push, returning http.ErrNotSupported if the wrapped writer does
+// not support pushing.
+func (w *ResponseWriter) Push(target string, opts *http.PushOptions) error {
+	if p, ok := w.ResponseWriter.(http.Pusher); ok {
+		return p.Push(target, opts)
+	}
+
+	return http.ErrNotSupported
+}
+
+// Unwrap allows http.ResponseController to reach the wrapped http.ResponseWriter.
+func (w *ResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
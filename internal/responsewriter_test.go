@@ -0,0 +1,152 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal_test
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	server "github.com/admacleod/aws/internal"
+)
+
+// readerFromRecorder is a httptest.ResponseRecorder that records calls to ReadFrom.
+type readerFromRecorder struct {
+	*httptest.ResponseRecorder
+	readFrom bool
+}
+
+func (r *readerFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	r.readFrom = true
+	return io.Copy(r.ResponseRecorder, src)
+}
+
+func TestResponseWriterStatus(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := server.NewResponseWriter(w)
+		if rw.Written() || rw.Status() != 0 || !rw.FirstByte().IsZero() {
+			t.Errorf("incorrect initial state: status=%d, first byte=%v", rw.Status(), rw.FirstByte())
+		}
+
+		rw.WriteHeader(http.StatusEarlyHints)
+		if rw.Written() {
+			t.Errorf("informational response recorded as status: %d", rw.Status())
+		}
+		rw.WriteHeader(http.StatusNotFound)
+		io.WriteString(rw, "not found")
+		if rw.Status() != http.StatusNotFound {
+			t.Errorf("incorrect status: expected=%d, got=%d", http.StatusNotFound, rw.Status())
+		}
+		if rw.Bytes() != int64(len("not found")) {
+			t.Errorf("incorrect bytes: expected=%d, got=%d", len("not found"), rw.Bytes())
+		}
+		if rw.FirstByte().IsZero() {
+			t.Error("first byte time not recorded")
+		}
+	}))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("could not get response: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("incorrect response status: expected=%d, got=%d", http.StatusNotFound, res.StatusCode)
+	}
+}
+
+func TestResponseWriterImplicitStatus(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		write func(w *server.ResponseWriter)
+	}{
+		{"Write", func(w *server.ResponseWriter) { io.WriteString(w, "body") }},
+		{"ReadFrom", func(w *server.ResponseWriter) { w.ReadFrom(strings.NewReader("body")) }},
+		{"Flush", func(w *server.ResponseWriter) { w.Flush() }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := server.NewResponseWriter(httptest.NewRecorder())
+			tt.write(rw)
+			if rw.Status() != http.StatusOK {
+				t.Errorf("incorrect status: expected=%d, got=%d", http.StatusOK, rw.Status())
+			}
+		})
+	}
+}
+
+func TestResponseWriterReadFrom(t *testing.T) {
+	rec := &readerFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+	rw := server.NewResponseWriter(rec)
+	// Hide the WriteTo of the strings.Reader so that io.Copy uses ReadFrom.
+	n, err := io.Copy(rw, struct{ io.Reader }{strings.NewReader("body")})
+	if err != nil || n != 4 {
+		t.Fatalf("could not copy body: n=%d, err=%v", n, err)
+	}
+	if !rec.readFrom {
+		t.Error("wrapped io.ReaderFrom not used")
+	}
+	if rw.Bytes() != 4 || rec.Body.String() != "body" {
+		t.Errorf("incorrect body: bytes=%d, body=%q", rw.Bytes(), rec.Body.String())
+	}
+}
+
+func TestResponseWriterOptionalInterfaces(t *testing.T) {
+	rec := httptest.NewRecorder()
+	rw := server.NewResponseWriter(rec)
+
+	var w http.ResponseWriter = rw
+	if _, ok := w.(http.Flusher); !ok {
+		t.Error("http.Flusher not implemented")
+	}
+	rw.Flush()
+	if !rec.Flushed {
+		t.Error("flush not passed to wrapped writer")
+	}
+	if _, _, err := rw.Hijack(); !errors.Is(err, http.ErrNotSupported) {
+		t.Errorf("incorrect hijack error: expected=%v, got=%v", http.ErrNotSupported, err)
+	}
+	if err := rw.Push("/style.css", nil); !errors.Is(err, http.ErrNotSupported) {
+		t.Errorf("incorrect push error: expected=%v, got=%v", http.ErrNotSupported, err)
+	}
+}
+
+func TestResponseWriterHijack(t *testing.T) {
+	hijacked := make(chan bool, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := server.NewResponseWriter(w)
+		conn, _, err := http.NewResponseController(rw).Hijack()
+		if err != nil {
+			t.Errorf("could not hijack: %v", err)
+			hijacked <- false
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 204 No Content\r\n\r\n"))
+		conn.Close()
+		hijacked <- rw.Hijacked()
+	}))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("could not get response: %v", err)
+	}
+	res.Body.Close()
+	if !<-hijacked {
+		t.Error("hijack not recorded")
+	}
+}
@@ -22,6 +22,7 @@
 // Creating a safe, modern, web server with this package is as easy as:
 //
 //	srv := server.New(
+//		server.ReadHeaderTimeout(5 * time.Second),
 //		server.Timeout(120 * time.Second),
 //		server.TLS(server.ModerniseTLS(&tls.Config{})),
 //		server.Handle(server.SecureHeaders(handler)),
@@ -31,13 +32,35 @@
 package internal
 
 import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
 )
 
 // Server defines a http server that allows for extension of the standard http.Server struct.
 type Server struct {
 	http.Server
+
+	http2     *http2.Server
+	http2Once sync.Once
+	http2Err  error
+	http3     *http3.Server
+	shutdown  atomic.Bool
+	listening atomic.Bool
+	listeners []func(net.Listener) net.Listener
+	logger    *slog.Logger
 }
 
 // Option is a function that will apply some option to a Server object.
@@ -58,6 +81,9 @@ func New(opts ...Option) *Server {
 
 // Timeout creates a server.Option function that will set the passed time.Duration as the
 // ReadTimeout, WriteTimeout, and IdleTimeout for the server.
+//
+// The individual timeout options should be preferred where the timeouts need to differ,
+// for example to allow large responses to be written to slow clients.
 func Timeout(timeout time.Duration) Option {
 	return func(srv *Server) {
 		srv.ReadTimeout = timeout
@@ -66,9 +92,191 @@ func Timeout(timeout time.Duration) Option {
 	}
 }
 
+// ReadHeaderTimeout creates a server.Option function that will set the passed time.Duration as the
+// ReadHeaderTimeout for the server, limiting how long clients may take to send request headers.
+func ReadHeaderTimeout(timeout time.Duration) Option {
+	return func(srv *Server) {
+		srv.ReadHeaderTimeout = timeout
+	}
+}
+
+// ReadTimeout creates a server.Option function that will set the passed time.Duration as the
+// ReadTimeout for the server, limiting how long clients may take to send an entire request.
+func ReadTimeout(timeout time.Duration) Option {
+	return func(srv *Server) {
+		srv.ReadTimeout = timeout
+	}
+}
+
+// WriteTimeout creates a server.Option function that will set the passed time.Duration as the
+// WriteTimeout for the server, limiting how long a response may take to write.
+//
+// See ExtendWriteDeadline for allowing large responses to take longer.
+func WriteTimeout(timeout time.Duration) Option {
+	return func(srv *Server) {
+		srv.WriteTimeout = timeout
+	}
+}
+
+// IdleTimeout creates a server.Option function that will set the passed time.Duration as the
+// IdleTimeout for the server, limiting how long keep-alive connections wait for the next request.
+func IdleTimeout(timeout time.Duration) Option {
+	return func(srv *Server) {
+		srv.IdleTimeout = timeout
+	}
+}
+
+// MaxHeaderBytes creates a server.Option function that will set the maximum size of request headers
+// that the server will read.
+func MaxHeaderBytes(n int) Option {
+	return func(srv *Server) {
+		srv.MaxHeaderBytes = n
+	}
+}
+
 // Handle creates a server.Option function that will set the passed http.Handler to the server as the Handler.
 func Handle(handler http.Handler) Option {
 	return func(srv *Server) {
 		srv.Handler = handler
 	}
 }
+
+// ListenAndServe behaves as http.Server.ListenAndServe, applying any HTTP/2 options first.
+func (srv *Server) ListenAndServe() error {
+	if err := srv.configureHTTP2(); err != nil {
+		return err
+	}
+
+	ln, err := srv.listen(":http")
+	if err != nil {
+		return err
+	}
+	defer srv.listening.Store(false)
+
+	return srv.Server.Serve(ln)
+}
+
+// ListenAndServeTLS behaves as http.Server.ListenAndServeTLS, applying any HTTP/2 options first.
+//
+// If the HTTP3 option has been applied then HTTP/3 is additionally served over QUIC
+// and the first error from either listener is returned.
+func (srv *Server) ListenAndServeTLS(certFile, keyFile string) error {
+	if err := srv.configureHTTP2(); err != nil {
+		return err
+	}
+	ln, err := srv.listen(":https")
+	if err != nil {
+		return err
+	}
+	defer srv.listening.Store(false)
+	if srv.http3 != nil {
+		return srv.serveHTTP3(ln, certFile, keyFile)
+	}
+
+	return srv.Server.ServeTLS(ln, certFile, keyFile)
+}
+
+// listen announces on the TCP address of the server, or addr if the server has no Addr set,
+// wrapping the listener with any listener options in the order they were applied.
+//
+// An address of the form "unix:PATH" announces on a unix socket at PATH instead, which is made
+// accessible only to the user and group of the process. A socket left behind by a previous
+// process is replaced if nothing is accepting connections on it.
+func (srv *Server) listen(addr string) (net.Listener, error) {
+	if srv.Addr != "" {
+		addr = srv.Addr
+	}
+	var ln net.Listener
+	var err error
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		ln, err = listenUnix(path)
+	} else {
+		ln, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, wrap := range srv.listeners {
+		ln = wrap(ln)
+	}
+	srv.listening.Store(true)
+
+	return ln, nil
+}
+
+// listenUnix announces on a unix socket at path, replacing any stale socket.
+//
+// The socket is created inside a private directory next to path and only moved into place once
+// its permissions have been restricted, so it is never reachable with the default permissions.
+func listenUnix(path string) (net.Listener, error) {
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, &net.OpError{Op: "listen", Net: "unix", Addr: &net.UnixAddr{Name: path, Net: "unix"}, Err: syscall.EADDRINUSE}
+	}
+	dir, err := os.MkdirTemp(filepath.Dir(path), "."+filepath.Base(path)+"-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "sock")
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	ln.SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, 0o660); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	return &unixListener{UnixListener: ln, path: path}, nil
+}
+
+// unixListener removes the socket it was moved to when it is closed.
+type unixListener struct {
+	*net.UnixListener
+	path string
+	once sync.Once
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	l.once.Do(func() {
+		os.Remove(l.path)
+	})
+	return err
+}
+
+// Listening reports whether the server has started listening through ListenAndServe or
+// ListenAndServeTLS and has not since been shut down or closed.
+func (srv *Server) Listening() bool {
+	return srv.listening.Load() && !srv.shutdown.Load()
+}
+
+// Shutdown behaves as http.Server.Shutdown, additionally gracefully shutting down
+// the HTTP/3 server if the HTTP3 option has been applied.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.shutdown.Store(true)
+	var err error
+	if srv.http3 != nil {
+		err = srv.http3.Shutdown(ctx)
+	}
+
+	return errors.Join(err, srv.Server.Shutdown(ctx))
+}
+
+// Close behaves as http.Server.Close, additionally closing the HTTP/3 server
+// if the HTTP3 option has been applied.
+func (srv *Server) Close() error {
+	srv.shutdown.Store(true)
+	var err error
+	if srv.http3 != nil {
+		err = srv.http3.Close()
+	}
+
+	return errors.Join(err, srv.Server.Close())
+}
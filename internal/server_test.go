@@ -14,7 +14,13 @@
 package internal_test
 
 import (
+	"context"
+	"io"
+	"log"
+	"net"
 	"net/http"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 	"time"
@@ -42,6 +48,35 @@ func TestServerInstantiation(t *testing.T) {
 	}
 }
 
+func TestServerTimeoutOptions(t *testing.T) {
+	testSrv := server.New(
+		server.ReadHeaderTimeout(1*time.Second),
+		server.ReadTimeout(2*time.Second),
+		server.WriteTimeout(3*time.Second),
+		server.IdleTimeout(4*time.Second),
+		server.MaxHeaderBytes(1024),
+	)
+
+	for _, tt := range []struct {
+		name     string
+		got      time.Duration
+		expected time.Duration
+	}{
+		{"ReadHeaderTimeout", testSrv.ReadHeaderTimeout, 1 * time.Second},
+		{"ReadTimeout", testSrv.ReadTimeout, 2 * time.Second},
+		{"WriteTimeout", testSrv.WriteTimeout, 3 * time.Second},
+		{"IdleTimeout", testSrv.IdleTimeout, 4 * time.Second},
+	} {
+		if tt.got != tt.expected {
+			t.Errorf("incorrect %s: expected=%v, got=%v", tt.name, tt.expected, tt.got)
+		}
+	}
+
+	if testSrv.MaxHeaderBytes != 1024 {
+		t.Errorf("incorrect MaxHeaderBytes: expected=%d, got=%d", 1024, testSrv.MaxHeaderBytes)
+	}
+}
+
 func TestServerHandlerOption(t *testing.T) {
 	testHandler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNotImplemented)
@@ -54,3 +89,66 @@ func TestServerHandlerOption(t *testing.T) {
 		t.Errorf("incorrect server handler: expected=%v, got=%v", testHandler, testSrv.Handler)
 	}
 }
+
+func TestServerUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "aws.sock")
+	// A socket left behind by a previous process should be replaced.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("could not create stale socket: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	testSrv := server.New(server.Handle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})))
+	testSrv.Addr = "unix:" + path
+	testSrv.ErrorLog = log.New(io.Discard, "", 0)
+	e := make(chan error, 1)
+	go func() {
+		e <- testSrv.ListenAndServe()
+	}()
+	t.Cleanup(func() {
+		testSrv.Close()
+		if err := <-e; err != http.ErrServerClosed {
+			t.Errorf("unexpected server error: %v", err)
+		}
+	})
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	var res *http.Response
+	for i := 0; i < 50; i++ {
+		if res, err = client.Get("http://aws/"); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("could not get response: %v", err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "ok" {
+		t.Errorf("incorrect body: expected=%q, got=%q", "ok", body)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("could not stat socket: %v", err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0o660 {
+		t.Errorf("incorrect socket permissions: expected=%v, got=%v", os.FileMode(0o660), perm)
+	}
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatalf("could not read socket directory: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("incorrect socket directory entries: expected=%d, got=%d", 1, len(entries))
+	}
+}
@@ -0,0 +1,332 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal
+
+import (
+	"errors"
+	"html/template"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Static is a http.Handler serving the files of a directory, in place of http.FileServer, that
+// never serves anything outside of the directory, including through symbolic links.
+//
+// Unless configured otherwise it also refuses to serve hidden files, whose names begin with a
+// ".", such as .git or .env, and only lists the contents of directories containing a
+// ListingMarker file.
+type Static struct {
+	root            *os.Root
+	allowHidden     bool
+	denySymlinks    bool
+	listings        bool
+	indexes         []string
+	listingTemplate *template.Template
+	stylesheet      string
+	notFound        string
+	precompressed   bool
+}
+
+// StaticOption is a function that will apply some option to a Static handler.
+type StaticOption func(*Static)
+
+// StaticAllowHidden creates a StaticOption that serves hidden files and directories.
+// The .well-known directory is always served.
+func StaticAllowHidden() StaticOption {
+	return func(s *Static) {
+		s.allowHidden = true
+	}
+}
+
+// StaticDenySymlinks creates a StaticOption that refuses to serve any path that passes through a
+// symbolic link, rather than only those whose links lead out of the directory.
+func StaticDenySymlinks() StaticOption {
+	return func(s *Static) {
+		s.denySymlinks = true
+	}
+}
+
+// StaticListings creates a StaticOption that lists the contents of every directory that has no
+// index file. Otherwise only directories containing a ListingMarker file are listed.
+//
+// Listings are rendered as HTML, or as JSON for clients that prefer application/json, and may be
+// sorted by name, size, or modification time with the sort and order query parameters, such as
+// ?sort=size&order=desc.
+func StaticListings() StaticOption {
+	return func(s *Static) {
+		s.listings = true
+	}
+}
+
+// StaticListingTemplate creates a StaticOption that renders HTML directory listings with the
+// passed template, which is executed with a Listing, in place of DefaultListingTemplate.
+func StaticListingTemplate(t *template.Template) StaticOption {
+	return func(s *Static) {
+		s.listingTemplate = t
+	}
+}
+
+// StaticListingStylesheet creates a StaticOption that sets the URL of the stylesheet linked from
+// directory listings, in place of the stylesheet of DefaultListingTemplate, or links none if href
+// is empty.
+func StaticListingStylesheet(href string) StaticOption {
+	return func(s *Static) {
+		s.stylesheet = href
+	}
+}
+
+// StaticIndex creates a StaticOption that sets the names of the files, in order of preference,
+// served in place of a directory. The default is index.html.
+func StaticIndex(names ...string) StaticOption {
+	return func(s *Static) {
+		s.indexes = names
+	}
+}
+
+// StaticNotFound creates a StaticOption that serves the file at name, relative to the directory,
+// as the body of 404 Not Found responses.
+func StaticNotFound(name string) StaticOption {
+	return func(s *Static) {
+		s.notFound = strings.TrimPrefix(path.Clean("/"+name), "/")
+	}
+}
+
+// StaticPrecompressed creates a StaticOption that serves precompressed siblings of files as
+// PrecompressedFileServer does.
+func StaticPrecompressed() StaticOption {
+	return func(s *Static) {
+		s.precompressed = true
+	}
+}
+
+// NewStatic creates a Static handler serving the files in dir with the passed StaticOptions
+// applied to it. Close must be called once it is no longer needed.
+func NewStatic(dir string, opts ...StaticOption) (*Static, error) {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	s := &Static{
+		root:            root,
+		indexes:         []string{"index.html"},
+		listingTemplate: DefaultListingTemplate,
+		stylesheet:      DefaultListingStylesheet,
+	}
+	for _, o := range opts {
+		o(s)
+	}
+
+	return s, nil
+}
+
+// Close closes the directory being served.
+func (s *Static) Close() error {
+	return s.root.Close()
+}
+
+func (s *Static) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	upath := r.URL.Path
+	if !strings.HasPrefix(upath, "/") {
+		upath = "/" + upath
+	}
+	if strings.ContainsRune(upath, 0) {
+		s.serveError(w, r, http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimPrefix(path.Clean(upath), "/")
+	if name == "" {
+		name = "."
+	}
+	fi, err := s.stat(name)
+	if err != nil {
+		if upath == DefaultListingStylesheet && s.stylesheet == DefaultListingStylesheet && errors.Is(err, fs.ErrNotExist) {
+			// A stylesheet of the site's own at the same path takes precedence.
+			serveListingStylesheet(w, r)
+			return
+		}
+		s.serveError(w, r, errorStatus(err))
+		return
+	}
+	if !fi.IsDir() {
+		switch {
+		case strings.HasSuffix(upath, "/"):
+			localRedirect(w, r, "../"+path.Base(upath[:len(upath)-1]))
+		case slices.Contains(s.indexes, path.Base(name)):
+			// Index files are only served at the path of their directory.
+			localRedirect(w, r, "./")
+		default:
+			s.serveFile(w, r, name)
+		}
+		return
+	}
+	if !strings.HasSuffix(upath, "/") {
+		localRedirect(w, r, path.Base(upath)+"/")
+		return
+	}
+	for _, index := range s.indexes {
+		if fi, err := s.stat(path.Join(name, index)); err == nil && fi.Mode().IsRegular() {
+			s.serveFile(w, r, path.Join(name, index))
+			return
+		}
+	}
+	if !s.listings && !s.listable(name) {
+		s.serveError(w, r, http.StatusNotFound)
+		return
+	}
+	s.serveListing(w, r, name)
+}
+
+// stat returns information about the file at name, failing as though it does not exist if it is
+// hidden or, if symbolic links are denied, passes through a symbolic link.
+func (s *Static) stat(name string) (fs.FileInfo, error) {
+	if !s.allowHidden && hiddenPath(name) {
+		return nil, fs.ErrNotExist
+	}
+	if s.denySymlinks && name != "." {
+		elems := strings.Split(name, "/")
+		for i := range elems {
+			fi, err := s.root.Lstat(path.Join(elems[:i+1]...))
+			if err != nil {
+				return nil, err
+			}
+			if fi.Mode()&fs.ModeSymlink != 0 {
+				return nil, fs.ErrNotExist
+			}
+		}
+	}
+
+	return s.root.Stat(name)
+}
+
+// hiddenPath reports whether any element of the slash separated name is hidden, other than
+// the .well-known directory.
+func hiddenPath(name string) bool {
+	for elem := range strings.SplitSeq(name, "/") {
+		if strings.HasPrefix(elem, ".") && elem != "." && elem != ".well-known" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// errorStatus returns the status code of the response for an error opening a file.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, fs.ErrPermission):
+		return http.StatusForbidden
+	case errors.Is(err, fs.ErrNotExist), errors.Is(err, fs.ErrInvalid), escapesRoot(err):
+		// Paths leaving the directory are reported as missing rather than revealing anything about them.
+		return http.StatusNotFound
+	}
+
+	return http.StatusInternalServerError
+}
+
+// escapesRoot reports whether err is the error given by os.Root for a path leaving the root,
+// which unlike the errors it passes on from the operating system is not a syscall.Errno.
+func escapesRoot(err error) bool {
+	var pathErr *fs.PathError
+	var errno syscall.Errno
+
+	return errors.As(err, &pathErr) && !errors.As(pathErr.Err, &errno)
+}
+
+// listable reports whether the directory at name contains a ListingMarker file.
+func (s *Static) listable(name string) bool {
+	fi, err := s.root.Stat(path.Join(name, ListingMarker))
+
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// serveFile serves the regular file at name, or its preferred precompressed sibling.
+func (s *Static) serveFile(w http.ResponseWriter, r *http.Request, name string) {
+	if s.precompressed && serveCompressed(w, r, staticFileSystem{s}, name) {
+		return
+	}
+	f, err := s.root.Open(name)
+	if err != nil {
+		s.serveError(w, r, errorStatus(err))
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		s.serveError(w, r, http.StatusNotFound)
+		return
+	}
+	http.ServeContent(w, r, name, fi.ModTime(), f)
+}
+
+// staticFileSystem is a http.FileSystem opening files from the root of a Static handler subject to
+// the same checks on hidden files and symbolic links as the files it serves directly.
+type staticFileSystem struct {
+	s *Static
+}
+
+// Open opens the file at name if the Static handler would serve it.
+func (fsys staticFileSystem) Open(name string) (http.File, error) {
+	name = strings.TrimPrefix(name, "/")
+	if _, err := fsys.s.stat(name); err != nil {
+		return nil, err
+	}
+
+	return fsys.s.root.Open(name)
+}
+
+// serveError responds with the passed error status, using the not found page for 404 responses
+// if there is one.
+func (s *Static) serveError(w http.ResponseWriter, r *http.Request, status int) {
+	if status == http.StatusNotFound && s.notFound != "" {
+		if f, err := (staticFileSystem{s}).Open(s.notFound); err == nil {
+			defer f.Close()
+			if fi, err := f.Stat(); err == nil && fi.Mode().IsRegular() {
+				ctype := mime.TypeByExtension(path.Ext(s.notFound))
+				if ctype == "" {
+					ctype = "text/html; charset=utf-8"
+				}
+				w.Header().Set("Content-Type", ctype)
+				w.Header().Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+				w.WriteHeader(status)
+				if r.Method != http.MethodHead {
+					io.Copy(w, f)
+				}
+				return
+			}
+		}
+	}
+	http.Error(w, http.StatusText(status), status)
+}
+
+// localRedirect redirects the request to the relative path target, keeping its query.
+func localRedirect(w http.ResponseWriter, r *http.Request, target string) {
+	if q := r.URL.RawQuery; q != "" {
+		target += "?" + q
+	}
+	w.Header().Set("Location", target)
+	w.WriteHeader(http.StatusMovedPermanently)
+}
@@ -0,0 +1,244 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	server "github.com/admacleod/aws/internal"
+)
+
+// staticTree creates a directory to serve, alongside a directory outside of it holding a secret,
+// and returns the path of the directory to serve.
+func staticTree(t *testing.T) string {
+	t.Helper()
+
+	base := t.TempDir()
+	root := filepath.Join(base, "root")
+	for name, contents := range map[string]string{
+		"outside/secret.txt":             "secret",
+		"root/index.html":                "index",
+		"root/home.htm":                  "home",
+		"root/file.txt":                  "file",
+		"root/404.html":                  "not here",
+		"root/.env":                      "PASSWORD=secret",
+		"root/.listing.css":              "body{}",
+		"root/.git/config":               "[core]",
+		"root/.well-known/security.txt":  "Contact: mailto:security@example.com",
+		"root/sub/a.txt":                 "a",
+		"root/sub/.secret":               "secret",
+		"root/sub/<script>.txt":          "escaped",
+		"root/sub/dir/index.html":        "nested",
+		"root/sub/dir/.hidden/index.htm": "hidden",
+	} {
+		path := filepath.Join(base, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("could not create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+			t.Fatalf("could not create %s: %v", name, err)
+		}
+	}
+	for link, target := range map[string]string{
+		"link-out":    "../outside",
+		"link-secret": "../outside/secret.txt",
+		"link-abs":    filepath.Join(base, "outside", "secret.txt"),
+		"link-in":     "file.txt",
+		"link-sub":    "sub",
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatalf("could not create symlink: %v", err)
+		}
+	}
+
+	return root
+}
+
+func TestStatic(t *testing.T) {
+	root := staticTree(t)
+
+	for _, tt := range []struct {
+		name     string
+		opts     []server.StaticOption
+		method   string
+		path     string
+		status   int
+		body     string
+		location string
+	}{
+		{"Index", nil, http.MethodGet, "/", http.StatusOK, "index", ""},
+		{"IndexRedirect", nil, http.MethodGet, "/index.html", http.StatusMovedPermanently, "", "./"},
+		{"File", nil, http.MethodGet, "/file.txt", http.StatusOK, "file", ""},
+		{"FileTrailingSlash", nil, http.MethodGet, "/file.txt/", http.StatusMovedPermanently, "", "../file.txt"},
+		{"DirectoryRedirect", nil, http.MethodGet, "/sub?a=b", http.StatusMovedPermanently, "", "sub/?a=b"},
+		{"NestedIndex", nil, http.MethodGet, "/sub/dir/", http.StatusOK, "nested", ""},
+		{"NoListing", nil, http.MethodGet, "/sub/", http.StatusNotFound, "", ""},
+		{"Missing", nil, http.MethodGet, "/missing", http.StatusNotFound, "", ""},
+		{"MethodNotAllowed", nil, http.MethodPost, "/file.txt", http.StatusMethodNotAllowed, "", ""},
+		{"NullByte", nil, http.MethodGet, "/file.txt%00.png", http.StatusBadRequest, "", ""},
+
+		{"DotEnv", nil, http.MethodGet, "/.env", http.StatusNotFound, "", ""},
+		{"DotGit", nil, http.MethodGet, "/.git/config", http.StatusNotFound, "", ""},
+		{"DotGitDirectory", nil, http.MethodGet, "/.git/", http.StatusNotFound, "", ""},
+		{"HiddenInSubdirectory", nil, http.MethodGet, "/sub/.secret", http.StatusNotFound, "", ""},
+		{"HiddenDirectoryIndex", nil, http.MethodGet, "/sub/dir/.hidden/", http.StatusNotFound, "", ""},
+		{"EncodedHidden", nil, http.MethodGet, "/%2eenv", http.StatusNotFound, "", ""},
+		{"WellKnown", nil, http.MethodGet, "/.well-known/security.txt", http.StatusOK, "Contact: mailto:security@example.com", ""},
+		{"AllowHidden", []server.StaticOption{server.StaticAllowHidden()}, http.MethodGet, "/.env", http.StatusOK, "PASSWORD=secret", ""},
+
+		{"DotDot", nil, http.MethodGet, "/../outside/secret.txt", http.StatusNotFound, "", ""},
+		{"EncodedDotDot", nil, http.MethodGet, "/%2e%2e/outside/secret.txt", http.StatusNotFound, "", ""},
+		{"EncodedSlashDotDot", nil, http.MethodGet, "/sub/..%2f..%2foutside/secret.txt", http.StatusNotFound, "", ""},
+		{"Backslash", nil, http.MethodGet, "/..%5coutside%5csecret.txt", http.StatusNotFound, "", ""},
+		{"SymlinkOut", nil, http.MethodGet, "/link-out/secret.txt", http.StatusNotFound, "", ""},
+		{"SymlinkOutDirectory", []server.StaticOption{server.StaticListings()}, http.MethodGet, "/link-out/", http.StatusNotFound, "", ""},
+		{"SymlinkSecret", nil, http.MethodGet, "/link-secret", http.StatusNotFound, "", ""},
+		{"SymlinkAbsolute", nil, http.MethodGet, "/link-abs", http.StatusNotFound, "", ""},
+		{"SymlinkIn", nil, http.MethodGet, "/link-in", http.StatusOK, "file", ""},
+		{"SymlinkInDirectory", nil, http.MethodGet, "/link-sub/a.txt", http.StatusOK, "a", ""},
+		{"DenySymlinks", []server.StaticOption{server.StaticDenySymlinks()}, http.MethodGet, "/link-in", http.StatusNotFound, "", ""},
+		{"DenySymlinksDirectory", []server.StaticOption{server.StaticDenySymlinks()}, http.MethodGet, "/link-sub/a.txt", http.StatusNotFound, "", ""},
+		{"DenySymlinksFile", []server.StaticOption{server.StaticDenySymlinks()}, http.MethodGet, "/sub/a.txt", http.StatusOK, "a", ""},
+
+		{"CustomIndex", []server.StaticOption{server.StaticIndex("home.htm", "index.html")}, http.MethodGet, "/", http.StatusOK, "home", ""},
+		{"CustomIndexFallback", []server.StaticOption{server.StaticIndex("home.htm", "index.html")}, http.MethodGet, "/sub/dir/", http.StatusOK, "nested", ""},
+		{"NotFoundPage", []server.StaticOption{server.StaticNotFound("404.html")}, http.MethodGet, "/missing", http.StatusNotFound, "not here", ""},
+		{"NotFoundPageHidden", []server.StaticOption{server.StaticNotFound("404.html")}, http.MethodGet, "/.env", http.StatusNotFound, "not here", ""},
+		{"NotFoundPageHead", []server.StaticOption{server.StaticNotFound("404.html")}, http.MethodHead, "/missing", http.StatusNotFound, "", ""},
+		{"NotFoundPageHiddenFile", []server.StaticOption{server.StaticNotFound(".env")}, http.MethodGet, "/missing", http.StatusNotFound, "", ""},
+
+		{"ListingStylesheet", nil, http.MethodGet, "/.listing.css", http.StatusOK, "", ""},
+		{"ListingStylesheetOwn", []server.StaticOption{server.StaticAllowHidden()}, http.MethodGet, "/.listing.css", http.StatusOK, "body{}", ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			static, err := server.NewStatic(root, tt.opts...)
+			if err != nil {
+				t.Fatalf("could not create handler: %v", err)
+			}
+			defer static.Close()
+
+			rec := httptest.NewRecorder()
+			static.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, nil))
+			if rec.Code != tt.status {
+				t.Errorf("incorrect status: expected=%d, got=%d", tt.status, rec.Code)
+			}
+			if tt.body != "" && rec.Body.String() != tt.body {
+				t.Errorf("incorrect body: expected=%q, got=%q", tt.body, rec.Body)
+			}
+			if strings.Contains(rec.Body.String(), "secret") && tt.body == "" {
+				t.Errorf("secret leaked: %q", rec.Body)
+			}
+			if got := rec.Header().Get("Location"); got != tt.location {
+				t.Errorf("incorrect Location: expected=%q, got=%q", tt.location, got)
+			}
+		})
+	}
+}
+
+func TestStaticListing(t *testing.T) {
+	static, err := server.NewStatic(staticTree(t), server.StaticListings())
+	if err != nil {
+		t.Fatalf("could not create handler: %v", err)
+	}
+	defer static.Close()
+
+	rec := httptest.NewRecorder()
+	static.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/sub/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("incorrect status: expected=%d, got=%d", http.StatusOK, rec.Code)
+	}
+	body := rec.Body.String()
+	for _, expected := range []string{`<a href="a.txt">a.txt</a>`, `<a href="dir/">dir/</a>`, "&lt;script&gt;.txt"} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("listing missing %s: got=%s", expected, body)
+		}
+	}
+	if strings.Contains(body, ".secret") || strings.Contains(body, "<script>") {
+		t.Errorf("listing contains hidden or unescaped entries: got=%s", body)
+	}
+}
+
+func TestStaticPrecompressed(t *testing.T) {
+	root := staticTree(t)
+	if err := os.WriteFile(filepath.Join(root, "file.txt.gz"), []byte("gzipped"), 0o644); err != nil {
+		t.Fatalf("could not create file: %v", err)
+	}
+	static, err := server.NewStatic(root, server.StaticPrecompressed())
+	if err != nil {
+		t.Fatalf("could not create handler: %v", err)
+	}
+	defer static.Close()
+
+	req := httptest.NewRequest(http.MethodGet, "/file.txt", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	static.ServeHTTP(rec, req)
+	if rec.Header().Get("Content-Encoding") != "gzip" || rec.Body.String() != "gzipped" {
+		t.Errorf("incorrect response: expected=%q, got=%q (Content-Encoding=%q)", "gzipped", rec.Body, rec.Header().Get("Content-Encoding"))
+	}
+}
+
+func TestStaticPrecompressedSiblings(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		opts   []server.StaticOption
+		path   string
+		status int
+		body   string
+	}{
+		{"SymlinkedSibling", []server.StaticOption{server.StaticDenySymlinks()}, "/file.txt", http.StatusOK, "file"},
+		{"HiddenOriginal", nil, "/.env", http.StatusNotFound, ""},
+		{"HiddenSibling", []server.StaticOption{server.StaticDenySymlinks()}, "/sub/a.txt", http.StatusOK, "a"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			root := staticTree(t)
+			if err := os.Symlink(".env", filepath.Join(root, "file.txt.gz")); err != nil {
+				t.Fatalf("could not create symlink: %v", err)
+			}
+			if err := os.WriteFile(filepath.Join(root, ".env.gz"), []byte("PASSWORD=secret"), 0o644); err != nil {
+				t.Fatalf("could not create file: %v", err)
+			}
+			if err := os.Symlink(".secret", filepath.Join(root, "sub", "a.txt.gz")); err != nil {
+				t.Fatalf("could not create symlink: %v", err)
+			}
+			static, err := server.NewStatic(root, append(tt.opts, server.StaticPrecompressed())...)
+			if err != nil {
+				t.Fatalf("could not create handler: %v", err)
+			}
+			defer static.Close()
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			rec := httptest.NewRecorder()
+			static.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Errorf("incorrect status: expected=%d, got=%d", tt.status, rec.Code)
+			}
+			if got := rec.Header().Get("Content-Encoding"); got != "" {
+				t.Errorf("incorrect Content-Encoding: expected=%q, got=%q", "", got)
+			}
+			if strings.Contains(rec.Body.String(), "secret") {
+				t.Errorf("secret leaked: %q", rec.Body)
+			}
+			if tt.body != "" && rec.Body.String() != tt.body {
+				t.Errorf("incorrect body: expected=%q, got=%q", tt.body, rec.Body)
+			}
+		})
+	}
+}
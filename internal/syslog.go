@@ -0,0 +1,242 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Syslog severities, as defined in RFC 5424 and used for both syslog and journald.
+const (
+	SeverityEmergency = iota
+	SeverityAlert
+	SeverityCritical
+	SeverityError
+	SeverityWarning
+	SeverityNotice
+	SeverityInfo
+	SeverityDebug
+)
+
+// FacilityDaemon is the syslog facility for system daemons, used by default.
+const FacilityDaemon = 3
+
+// syslogSDID identifies the structured data element holding access log fields.
+// It uses the enterprise number reserved for documentation by RFC 5612 as aws has none of its own.
+const syslogSDID = "access@32473"
+
+// SyslogWriter is an io.Writer that sends each write as an RFC 5424 syslog message.
+//
+// Messages are sent as datagrams over unix sockets and UDP, and with octet counting framing
+// as described in RFC 6587 over TCP. Connections are redialled once if a write fails, such as
+// when the syslog daemon has restarted.
+// A SyslogWriter is a FieldWriter, sending the fields of access log entries as structured data,
+// and a SeverityWriter.
+type SyslogWriter struct {
+	network  string
+	addr     string
+	facility int
+	severity int
+	appName  string
+	hostname string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// SyslogOption is a function that will apply some option to a SyslogWriter.
+type SyslogOption func(*SyslogWriter)
+
+// SyslogFacility creates a SyslogOption that will set the numeric facility of messages,
+// for example 16 for local0. The default is FacilityDaemon.
+func SyslogFacility(facility int) SyslogOption {
+	return func(w *SyslogWriter) {
+		w.facility = facility
+	}
+}
+
+// SyslogSeverity creates a SyslogOption that will set the severity of messages.
+// The default is SeverityInfo.
+func SyslogSeverity(severity int) SyslogOption {
+	return func(w *SyslogWriter) {
+		w.severity = severity
+	}
+}
+
+// SyslogAppName creates a SyslogOption that will set the APP-NAME of messages.
+// The default is the name of the running program.
+func SyslogAppName(name string) SyslogOption {
+	return func(w *SyslogWriter) {
+		w.appName = name
+	}
+}
+
+// DialSyslog connects to the syslog server at addr on the passed network, which is one of
+// "unix", "udp", or "tcp", with the passed SyslogOptions applied to it.
+// An empty network and addr connect to the local syslog socket, /dev/log.
+func DialSyslog(network, addr string, opts ...SyslogOption) (*SyslogWriter, error) {
+	if network == "" && addr == "" {
+		network, addr = "unix", "/dev/log"
+	}
+	w := &SyslogWriter{
+		network:  network,
+		addr:     addr,
+		facility: FacilityDaemon,
+		severity: SeverityInfo,
+		appName:  filepath.Base(os.Args[0]),
+		hostname: "-",
+	}
+	if h, err := os.Hostname(); err == nil && h != "" {
+		w.hostname = h
+	}
+	for _, o := range opts {
+		o(w)
+	}
+	switch network {
+	case "unix":
+		w.network = "unixgram"
+	case "udp", "udp4", "udp6", "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("unsupported syslog network %q", network)
+	}
+	if err := w.dial(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (w *SyslogWriter) dial() error {
+	conn, err := net.Dial(w.network, w.addr)
+	if err != nil {
+		return err
+	}
+	w.conn = conn
+
+	return nil
+}
+
+// Write sends b as the message of a single syslog message, without any trailing newline.
+func (w *SyslogWriter) Write(b []byte) (int, error) {
+	return w.WriteSeverity(w.severity, b)
+}
+
+// WriteSeverity is as Write, sending the message with the passed severity.
+func (w *SyslogWriter) WriteSeverity(severity int, b []byte) (int, error) {
+	if err := w.send(w.message(severity, b, nil)); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// WriteFields sends line as the message of a single syslog message, with fields as its structured data.
+func (w *SyslogWriter) WriteFields(line []byte, fields []LogField) error {
+	return w.send(w.message(w.severity, line, fields))
+}
+
+// Close closes the connection to the syslog server.
+func (w *SyslogWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.conn.Close()
+}
+
+// message formats an RFC 5424 message.
+func (w *SyslogWriter) message(severity int, msg []byte, fields []LogField) []byte {
+	b := make([]byte, 0, 128+len(msg))
+	b = append(b, '<')
+	b = strconv.AppendInt(b, int64(w.facility*8+severity), 10)
+	b = append(b, ">1 "...)
+	b = time.Now().AppendFormat(b, "2006-01-02T15:04:05.000000Z07:00")
+	b = append(b, ' ')
+	b = appendSyslogHeader(b, w.hostname, 255)
+	b = append(b, ' ')
+	b = appendSyslogHeader(b, w.appName, 48)
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, int64(os.Getpid()), 10)
+	if len(fields) == 0 {
+		b = append(b, " - -"...)
+	} else {
+		b = append(b, " access ["+syslogSDID...)
+		for _, f := range fields {
+			b = append(b, ' ')
+			b = append(b, f.Key...)
+			b = append(b, `="`...)
+			for _, c := range appendFieldValue(nil, f.Value) {
+				if c == '"' || c == '\\' || c == ']' {
+					b = append(b, '\\')
+				}
+				b = append(b, c)
+			}
+			b = append(b, '"')
+		}
+		b = append(b, ']')
+	}
+	if msg = bytes.TrimRight(msg, "\n"); len(msg) > 0 {
+		b = append(b, ' ')
+		b = append(b, msg...)
+	}
+
+	return b
+}
+
+// appendSyslogHeader appends a header field of at most limit printable ASCII characters, or "-" if it is empty.
+func appendSyslogHeader(b []byte, s string, limit int) []byte {
+	s = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return -1
+		}
+		return r
+	}, s)
+	if s == "" {
+		return append(b, '-')
+	}
+
+	return append(b, s[:min(len(s), limit)]...)
+}
+
+// send writes the message to the connection, framing it for stream connections and redialling
+// once on failure.
+func (w *SyslogWriter) send(msg []byte) error {
+	if strings.HasPrefix(w.network, "tcp") {
+		framed := strconv.AppendInt(nil, int64(len(msg)), 10)
+		framed = append(framed, ' ')
+		msg = append(framed, msg...)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	_, err := w.conn.Write(msg)
+	if err == nil {
+		return nil
+	}
+	w.conn.Close()
+	if err := w.dial(); err != nil {
+		return err
+	}
+	_, err = w.conn.Write(msg)
+
+	return err
+}
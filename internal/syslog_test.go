@@ -0,0 +1,130 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	server "github.com/admacleod/aws/internal"
+)
+
+func TestSyslogWriter(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer pc.Close()
+
+	w, err := server.DialSyslog("udp", pc.LocalAddr().String(),
+		server.SyslogAppName("aws-test"),
+		server.SyslogFacility(16),
+		server.SyslogSeverity(server.SeverityError),
+	)
+	if err != nil {
+		t.Fatalf("could not dial syslog: %v", err)
+	}
+	defer w.Close()
+
+	read := func() string {
+		t.Helper()
+		buf := make([]byte, 2048)
+		pc.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("could not read message: %v", err)
+		}
+		return string(buf[:n])
+	}
+	header := `^<131>1 \d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{6}(Z|[+-]\d\d:\d\d) \S+ aws-test ` + strconv.Itoa(os.Getpid()) + ` `
+
+	io.WriteString(w, "something failed\n")
+	if got, expected := read(), header+`- - something failed$`; !regexp.MustCompile(expected).MatchString(got) {
+		t.Errorf("incorrect message: expected=%s, got=%q", expected, got)
+	}
+
+	err = w.WriteFields([]byte("GET / 200\n"), []server.LogField{
+		{Key: "uri", Value: `/a"b]\c`},
+		{Key: "status", Value: 200},
+		{Key: "tls_resumed", Value: true},
+	})
+	if err != nil {
+		t.Fatalf("could not write fields: %v", err)
+	}
+	expected := header + regexp.QuoteMeta(`access [access@32473 uri="/a\"b\]\\c" status="200" tls_resumed="true"] GET / 200`) + `$`
+	if got := read(); !regexp.MustCompile(expected).MatchString(got) {
+		t.Errorf("incorrect message: expected=%s, got=%q", expected, got)
+	}
+}
+
+func TestSyslogWriterTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer ln.Close()
+	received := make(chan []string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		var msgs []string
+		for range 2 {
+			var n int
+			if _, err := fmt.Fscanf(r, "%d ", &n); err != nil {
+				break
+			}
+			msg := make([]byte, n)
+			if _, err := io.ReadFull(r, msg); err != nil {
+				break
+			}
+			msgs = append(msgs, string(msg))
+		}
+		received <- msgs
+	}()
+
+	w, err := server.DialSyslog("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("could not dial syslog: %v", err)
+	}
+	defer w.Close()
+	io.WriteString(w, "first\n")
+	io.WriteString(w, "second\n")
+
+	select {
+	case msgs := <-received:
+		if len(msgs) != 2 || !strings.HasSuffix(msgs[0], " - - first") || !strings.HasSuffix(msgs[1], " - - second") {
+			t.Errorf("incorrect messages: got=%q", msgs)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for messages")
+	}
+}
+
+func TestSyslogUnsupportedNetwork(t *testing.T) {
+	if _, err := server.DialSyslog("ip", "127.0.0.1"); err == nil {
+		t.Error("expected error for unsupported network")
+	}
+}
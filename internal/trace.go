@@ -0,0 +1,444 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Tracer records a span for every request passed through the Trace middleware and exports them in
+// batches to an OpenTelemetry collector using OTLP/HTTP with JSON encoding, described at
+// https://opentelemetry.io/docs/specs/otlp/.
+//
+// Spans follow the OpenTelemetry semantic conventions for HTTP servers. Incoming W3C traceparent
+// headers, described at https://www.w3.org/TR/trace-context/, are honoured so that spans join the
+// trace of the caller, and requests that the caller did not sample are not recorded.
+//
+// Spans are queued and dropped, rather than delaying requests, if the collector cannot keep up.
+// Failed exports are not retried.
+type Tracer struct {
+	endpoint  string
+	service   string
+	client    *http.Client
+	header    http.Header
+	batchSize int
+	interval  time.Duration
+	queueSize int
+	logger    *slog.Logger
+
+	queue   chan *span
+	done    chan struct{}
+	dropped atomic.Uint64
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// TracerOption is a function that will apply some option to a Tracer.
+type TracerOption func(*Tracer)
+
+// TraceServiceName creates a TracerOption that will set the service.name resource attribute of
+// exported spans. The default is "aws".
+func TraceServiceName(name string) TracerOption {
+	return func(t *Tracer) {
+		t.service = name
+	}
+}
+
+// TraceHeader creates a TracerOption that will add a header to every export request, for
+// example to authenticate with the collector.
+func TraceHeader(key, value string) TracerOption {
+	return func(t *Tracer) {
+		t.header.Add(key, value)
+	}
+}
+
+// TraceHTTPClient creates a TracerOption that will set the http.Client used to export spans.
+// The default client times out after ten seconds.
+func TraceHTTPClient(client *http.Client) TracerOption {
+	return func(t *Tracer) {
+		t.client = client
+	}
+}
+
+// TraceBatch creates a TracerOption that will export spans once size have been queued, or interval
+// has passed since the last export. The defaults are 512 spans and five seconds.
+func TraceBatch(size int, interval time.Duration) TracerOption {
+	return func(t *Tracer) {
+		t.batchSize = size
+		t.interval = interval
+	}
+}
+
+// TraceQueueSize creates a TracerOption that will set how many spans may wait to be exported
+// before further spans are dropped. The default is 2048.
+func TraceQueueSize(n int) TracerOption {
+	return func(t *Tracer) {
+		t.queueSize = n
+	}
+}
+
+// TraceErrorLog creates a TracerOption that will send failures to export spans to the passed slog.Handler.
+func TraceErrorLog(h slog.Handler) TracerOption {
+	return func(t *Tracer) {
+		t.logger = slog.New(h)
+	}
+}
+
+// NewTracer creates a Tracer exporting to the OTLP/HTTP traces endpoint of a collector, such as
+// http://localhost:4318/v1/traces, with the passed TracerOptions applied to it, and starts its
+// background exporter. Close must be called to export any remaining spans.
+func NewTracer(endpoint string, opts ...TracerOption) *Tracer {
+	t := &Tracer{
+		endpoint:  endpoint,
+		service:   "aws",
+		client:    &http.Client{Timeout: 10 * time.Second},
+		header:    make(http.Header),
+		batchSize: 512,
+		interval:  5 * time.Second,
+		queueSize: 2048,
+		logger:    slog.New(slog.DiscardHandler),
+		done:      make(chan struct{}),
+	}
+	for _, o := range opts {
+		o(t)
+	}
+	t.queue = make(chan *span, t.queueSize)
+	go t.run()
+
+	return t
+}
+
+// Dropped returns the number of spans dropped because the queue was full.
+func (t *Tracer) Dropped() uint64 {
+	return t.dropped.Load()
+}
+
+// Close stops recording spans and exports any that are queued, waiting until they have been sent
+// or the context is done.
+func (t *Tracer) Close(ctx context.Context) error {
+	t.mu.Lock()
+	if !t.closed {
+		t.closed = true
+		close(t.queue)
+	}
+	t.mu.Unlock()
+
+	select {
+	case <-t.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// record queues a finished span for export.
+func (t *Tracer) record(s *span) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if t.closed {
+		return
+	}
+	select {
+	case t.queue <- s:
+	default:
+		t.dropped.Add(1)
+	}
+}
+
+// run exports queued spans in batches until the queue is closed.
+func (t *Tracer) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	var batch []*span
+	for {
+		select {
+		case s, ok := <-t.queue:
+			if !ok {
+				t.export(batch)
+				return
+			}
+			if batch = append(batch, s); len(batch) >= t.batchSize {
+				t.export(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			t.export(batch)
+			batch = nil
+		}
+	}
+}
+
+// export sends a batch of spans to the collector.
+func (t *Tracer) export(batch []*span) {
+	if len(batch) == 0 {
+		return
+	}
+	body, err := json.Marshal(t.request(batch))
+	if err != nil {
+		t.logger.Error("encoding spans", "error", err)
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		t.logger.Error("exporting spans", "error", err)
+		return
+	}
+	for k, v := range t.header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := t.client.Do(req)
+	if err != nil {
+		t.logger.Error("exporting spans", "error", err, "spans", len(batch))
+		return
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		t.logger.Error("exporting spans", "error", fmt.Sprintf("collector responded %s", res.Status), "spans", len(batch))
+	}
+}
+
+// span is a single finished request span.
+type span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	start    time.Time
+	end      time.Time
+	attrs    []otlpKeyValue
+	isError  bool
+}
+
+// Trace is a middleware generator function that will record a span in the passed Tracer for every
+// request to the wrapped handler, with the method, host, path, status, and response size as attributes.
+//
+// The client address is found using ClientIP so the TrustedProxies middleware should wrap the
+// tracer when serving behind a proxy.
+func Trace(t *Tracer) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			traceID, parentID, sampled, ok := parseTraceparent(r.Header.Get("traceparent"))
+			if ok && !sampled {
+				next.ServeHTTP(w, r)
+				return
+			}
+			s := &span{traceID: traceID, parentID: parentID, name: metricMethod(r.Method), start: time.Now()}
+			if !ok {
+				rand.Read(s.traceID[:])
+			}
+			rand.Read(s.spanID[:])
+
+			rw := NewResponseWriter(w)
+			defer func() {
+				p := recover()
+				s.end = time.Now()
+				status := rw.Status()
+				switch {
+				case p != nil && !rw.Written():
+					status = http.StatusInternalServerError
+				case !rw.Written() && !rw.Hijacked():
+					status = http.StatusOK
+				}
+				s.isError = p != nil || status >= 500
+				s.attrs = spanAttributes(r, status, rw.Bytes())
+				t.record(s)
+				if p != nil {
+					panic(p)
+				}
+			}()
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// spanAttributes returns the semantic convention attributes of a HTTP server span.
+func spanAttributes(r *http.Request, status int, bytes int64) []otlpKeyValue {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	version := fmt.Sprintf("%d.%d", r.ProtoMajor, r.ProtoMinor)
+	if r.ProtoMajor >= 2 {
+		version = strconv.Itoa(r.ProtoMajor)
+	}
+	attrs := []otlpKeyValue{
+		stringAttr("http.request.method", r.Method),
+		stringAttr("url.scheme", scheme),
+		stringAttr("url.path", r.URL.Path),
+		stringAttr("server.address", requestHost(r)),
+		stringAttr("client.address", ClientIP(r)),
+		stringAttr("network.protocol.version", version),
+		intAttr("http.response.status_code", int64(status)),
+		intAttr("http.response.body.size", bytes),
+	}
+	if r.URL.RawQuery != "" {
+		attrs = append(attrs, stringAttr("url.query", r.URL.RawQuery))
+	}
+	if ua := r.UserAgent(); ua != "" {
+		attrs = append(attrs, stringAttr("user_agent.original", ua))
+	}
+
+	return attrs
+}
+
+// parseTraceparent parses a W3C traceparent header, reporting whether it was valid.
+func parseTraceparent(h string) (traceID [16]byte, parentID [8]byte, sampled, ok bool) {
+	if !validTraceparent(h) {
+		return traceID, parentID, false, false
+	}
+	hex.Decode(traceID[:], []byte(h[3:35]))
+	hex.Decode(parentID[:], []byte(h[36:52]))
+	flags, _ := hex.DecodeString(h[53:55])
+	if traceID == [16]byte{} || parentID == [8]byte{} {
+		return traceID, parentID, false, false
+	}
+
+	return traceID, parentID, flags[0]&1 == 1, true
+}
+
+// validTraceparent checks the layout of a traceparent header, VERSION-TRACEID-PARENTID-FLAGS in
+// lower case hex, where versions after 00 may append further fields.
+func validTraceparent(h string) bool {
+	switch {
+	case len(h) < 55 || h[2] != '-' || h[35] != '-' || h[52] != '-':
+		return false
+	case h[:2] == "ff":
+		return false
+	case h[:2] == "00" && len(h) != 55:
+		return false
+	case len(h) > 55 && h[55] != '-':
+		return false
+	}
+	for i, c := range []byte(h[:55]) {
+		if i == 2 || i == 35 || i == 52 {
+			continue
+		}
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// The following types encode an OTLP ExportTraceServiceRequest using the JSON mapping of its
+// protocol buffer definition, in which 64 bit integers are strings and ids are hex.
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	Code int `json:"code,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+func stringAttr(key, value string) otlpKeyValue {
+	return otlpKeyValue{key, otlpAnyValue{StringValue: &value}}
+}
+
+func intAttr(key string, value int64) otlpKeyValue {
+	v := strconv.FormatInt(value, 10)
+	return otlpKeyValue{key, otlpAnyValue{IntValue: &v}}
+}
+
+const (
+	otlpSpanKindServer  = 2
+	otlpStatusCodeError = 2
+)
+
+// request builds the export request for a batch of spans.
+func (t *Tracer) request(batch []*span) otlpRequest {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		out := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              otlpSpanKindServer,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        s.attrs,
+		}
+		if s.parentID != [8]byte{} {
+			out.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		if s.isError {
+			out.Status.Code = otlpStatusCodeError
+		}
+		spans = append(spans, out)
+	}
+
+	return otlpRequest{[]otlpResourceSpans{{
+		Resource:   otlpResource{[]otlpKeyValue{stringAttr("service.name", t.service)}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{"github.com/admacleod/aws/internal"}, Spans: spans}},
+	}}}
+}
@@ -0,0 +1,250 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package internal_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	server "github.com/admacleod/aws/internal"
+)
+
+// exportedSpan is the part of an exported OTLP span checked by the tests.
+type exportedSpan struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+	Kind         int    `json:"kind"`
+	Start        string `json:"startTimeUnixNano"`
+	End          string `json:"endTimeUnixNano"`
+	Attributes   []struct {
+		Key   string `json:"key"`
+		Value struct {
+			StringValue string `json:"stringValue"`
+			IntValue    string `json:"intValue"`
+		} `json:"value"`
+	} `json:"attributes"`
+	Status struct {
+		Code int `json:"code"`
+	} `json:"status"`
+}
+
+func (s exportedSpan) attr(key string) string {
+	for _, a := range s.Attributes {
+		if a.Key == key {
+			return a.Value.StringValue + a.Value.IntValue
+		}
+	}
+
+	return ""
+}
+
+// collector is a stand-in OTLP/HTTP collector recording exported spans.
+type collector struct {
+	*httptest.Server
+	status int
+
+	mu       sync.Mutex
+	services []string
+	spans    []exportedSpan
+}
+
+func newCollector(t *testing.T, status int) *collector {
+	c := &collector{status: status}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("incorrect export request: %s %s %s", r.Method, r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		var req struct {
+			ResourceSpans []struct {
+				Resource struct {
+					Attributes []struct {
+						Value struct {
+							StringValue string `json:"stringValue"`
+						} `json:"value"`
+					} `json:"attributes"`
+				} `json:"resource"`
+				ScopeSpans []struct {
+					Spans []exportedSpan `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("could not decode export request: %v", err)
+		}
+		c.mu.Lock()
+		for _, rs := range req.ResourceSpans {
+			c.services = append(c.services, rs.Resource.Attributes[0].Value.StringValue)
+			for _, ss := range rs.ScopeSpans {
+				c.spans = append(c.spans, ss.Spans...)
+			}
+		}
+		c.mu.Unlock()
+		w.WriteHeader(c.status)
+	}))
+	t.Cleanup(c.Close)
+
+	return c
+}
+
+func TestTrace(t *testing.T) {
+	c := newCollector(t, http.StatusOK)
+	tracer := server.NewTracer(c.URL+"/v1/traces", server.TraceServiceName("test"))
+	handler := server.Trace(tracer)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/error" {
+			http.Error(w, "failed", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("hello"))
+	}))
+
+	root := httptest.NewRequest("GET", "https://example.com/page?q=1", nil)
+	root.Header.Set("User-Agent", "test-agent")
+	handler.ServeHTTP(httptest.NewRecorder(), root)
+	child := httptest.NewRequest("GET", "/error", nil)
+	child.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), child)
+	unsampled := httptest.NewRequest("GET", "/", nil)
+	unsampled.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	handler.ServeHTTP(httptest.NewRecorder(), unsampled)
+
+	if err := tracer.Close(context.Background()); err != nil {
+		t.Fatalf("could not close tracer: %v", err)
+	}
+	if len(c.spans) != 2 {
+		t.Fatalf("incorrect span count: expected=%d, got=%d", 2, len(c.spans))
+	}
+	if c.services[0] != "test" {
+		t.Errorf("incorrect service name: expected=%s, got=%s", "test", c.services[0])
+	}
+
+	s := c.spans[0]
+	for _, tt := range []struct {
+		name     string
+		got      any
+		expected any
+	}{
+		{"Name", s.Name, "GET"},
+		{"Kind", s.Kind, 2},
+		{"ParentSpanID", s.ParentSpanID, ""},
+		{"http.request.method", s.attr("http.request.method"), "GET"},
+		{"url.scheme", s.attr("url.scheme"), "https"},
+		{"url.path", s.attr("url.path"), "/page"},
+		{"url.query", s.attr("url.query"), "q=1"},
+		{"server.address", s.attr("server.address"), "example.com"},
+		{"client.address", s.attr("client.address"), "192.0.2.1"},
+		{"user_agent.original", s.attr("user_agent.original"), "test-agent"},
+		{"http.response.status_code", s.attr("http.response.status_code"), "200"},
+		{"http.response.body.size", s.attr("http.response.body.size"), "5"},
+		{"Status", s.Status.Code, 0},
+	} {
+		if tt.got != tt.expected {
+			t.Errorf("incorrect %s: expected=%v, got=%v", tt.name, tt.expected, tt.got)
+		}
+	}
+	if len(s.TraceID) != 32 || len(s.SpanID) != 16 || s.TraceID == "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("incorrect root span ids: trace=%s, span=%s", s.TraceID, s.SpanID)
+	}
+	if s.Start == "" || s.End < s.Start {
+		t.Errorf("incorrect span times: start=%s, end=%s", s.Start, s.End)
+	}
+
+	s = c.spans[1]
+	if s.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || s.ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("incorrect child span ids: trace=%s, parent=%s", s.TraceID, s.ParentSpanID)
+	}
+	if s.Status.Code != 2 || s.attr("http.response.status_code") != "500" {
+		t.Errorf("incorrect error span status: code=%d, status=%s", s.Status.Code, s.attr("http.response.status_code"))
+	}
+}
+
+func TestTraceparent(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		header string
+		joined bool
+	}{
+		{"Valid", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true},
+		{"FutureVersion", "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true},
+		{"TrailingData", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false},
+		{"InvalidVersion", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false},
+		{"UpperCase", "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false},
+		{"ZeroTraceID", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", false},
+		{"ZeroParentID", "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false},
+		{"Short", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newCollector(t, http.StatusOK)
+			tracer := server.NewTracer(c.URL + "/v1/traces")
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("traceparent", tt.header)
+			server.Trace(tracer)(http.NotFoundHandler()).ServeHTTP(httptest.NewRecorder(), req)
+			tracer.Close(context.Background())
+
+			if len(c.spans) != 1 {
+				t.Fatalf("incorrect span count: expected=%d, got=%d", 1, len(c.spans))
+			}
+			joined := c.spans[0].TraceID == "4bf92f3577b34da6a3ce929d0e0e4736"
+			if joined != tt.joined {
+				t.Errorf("incorrect trace joining: expected=%t, got=%t", tt.joined, joined)
+			}
+		})
+	}
+}
+
+func TestTraceExportError(t *testing.T) {
+	c := newCollector(t, http.StatusServiceUnavailable)
+	var buf bytes.Buffer
+	tracer := server.NewTracer(c.URL+"/v1/traces", server.TraceErrorLog(slog.NewTextHandler(&buf, nil)))
+	server.Trace(tracer)(http.NotFoundHandler()).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	tracer.Close(context.Background())
+
+	if got := buf.String(); !strings.Contains(got, "exporting spans") || !strings.Contains(got, "503") {
+		t.Errorf("incorrect error log: got=%q", got)
+	}
+}
+
+func TestTraceQueueFull(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+	defer ts.Close()
+
+	tracer := server.NewTracer(ts.URL, server.TraceQueueSize(1), server.TraceBatch(1, time.Hour))
+	handler := server.Trace(tracer)(http.NotFoundHandler())
+	serve := func() { handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)) }
+
+	// The first span is being exported, the second fills the queue, and the third is dropped.
+	serve()
+	<-started
+	serve()
+	serve()
+	if got := tracer.Dropped(); got != 1 {
+		t.Errorf("incorrect dropped count: expected=%d, got=%d", 1, got)
+	}
+	close(release)
+	tracer.Close(context.Background())
+}